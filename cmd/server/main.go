@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+	_ "time/tzdata" // quota timezones must load without the system database
 
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/webserver"
 )
@@ -10,6 +16,28 @@ import (
 func main() {
 	srv := webserver.NewServer()
 
-	log.Println("Server running on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", srv.Router))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := &http.Server{Addr: ":8080", Handler: srv.Router}
+
+	go func() {
+		log.Println("Server running on port 8080")
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down server:", err)
+	}
+
+	if err := srv.Close(); err != nil {
+		log.Println("Error closing server:", err)
+	}
 }
@@ -7,14 +7,35 @@ import (
 )
 
 type Conf struct {
-	RateLimiterMaxIPRequests    int           `mapstructure:"RATE_LIMITER_MAX_IP_REQUESTS"`
-	RateLimiterMaxTokenRequests int           `mapstructure:"RATE_LIMITER_MAX_TOKEN_REQUESTS"`
-	RateLimiterWindowDuration   time.Duration `mapstructure:"RATE_LIMITER_WINDOW_DURATION"`
-	RateLimiterBlockDuration    time.Duration `mapstructure:"RATE_LIMITER_BLOCK_DURATION"`
-	RedisHost                   string        `mapstructure:"REDIS_HOST"`
-	RedisPort                   int           `mapstructure:"REDIS_PORT"`
-	RedisPassword               string        `mapstructure:"REDIS_PASSWORD"`
-	RedisDB                     int           `mapstructure:"REDIS_DB"`
+	RateLimiterPoliciesFile          string        `mapstructure:"RATE_LIMITER_POLICIES_FILE"`
+	RateLimiterAlgorithm             string        `mapstructure:"RATE_LIMITER_ALGORITHM"`
+	RateLimiterRefillRate            float64       `mapstructure:"RATE_LIMITER_REFILL_RATE"`
+	RateLimiterBucketCapacity        int           `mapstructure:"RATE_LIMITER_BUCKET_CAPACITY"`
+	RateLimiterStorage               string        `mapstructure:"RATE_LIMITER_STORAGE"`
+	RateLimiterMemoryShards          int           `mapstructure:"RATE_LIMITER_MEMORY_SHARDS"`
+	RateLimiterMemoryMaxKeys         int           `mapstructure:"RATE_LIMITER_MEMORY_MAX_KEYS"`
+	RateLimiterMemoryCleanupInterval time.Duration `mapstructure:"RATE_LIMITER_MEMORY_CLEANUP_INTERVAL"`
+	RateLimiterStorageTimeout        time.Duration `mapstructure:"RATE_LIMITER_STORAGE_TIMEOUT"`
+	RateLimiterBreakerFailures       int           `mapstructure:"RATE_LIMITER_BREAKER_FAILURES"`
+	RateLimiterBreakerOpenDuration   time.Duration `mapstructure:"RATE_LIMITER_BREAKER_OPEN_DURATION"`
+	RateLimiterBreakerHalfOpen       int           `mapstructure:"RATE_LIMITER_BREAKER_HALF_OPEN_REQUESTS"`
+	RateLimiterBreakerProbeInterval  time.Duration `mapstructure:"RATE_LIMITER_BREAKER_PROBE_INTERVAL"`
+	RateLimiterTokenRegistry         string        `mapstructure:"RATE_LIMITER_TOKEN_REGISTRY"`
+	RateLimiterTokenRegistryFile     string        `mapstructure:"RATE_LIMITER_TOKEN_REGISTRY_FILE"`
+	RateLimiterUnknownTokens         string        `mapstructure:"RATE_LIMITER_UNKNOWN_TOKENS"`
+	RateLimiterTrustedProxies        string        `mapstructure:"RATE_LIMITER_TRUSTED_PROXIES"`
+	RateLimiterClientIPHeader        string        `mapstructure:"RATE_LIMITER_CLIENT_IP_HEADER"`
+	RateLimiterIPv4Prefix            int           `mapstructure:"RATE_LIMITER_IPV4_PREFIX"`
+	RateLimiterIPv6Prefix            int           `mapstructure:"RATE_LIMITER_IPV6_PREFIX"`
+	RateLimiterHeaders               string        `mapstructure:"RATE_LIMITER_HEADERS"`
+	RateLimiterAdminToken            string        `mapstructure:"RATE_LIMITER_ADMIN_TOKEN"`
+	TracingExporter                  string        `mapstructure:"TRACING_EXPORTER"`
+	OTLPEndpoint                     string        `mapstructure:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName                      string        `mapstructure:"OTEL_SERVICE_NAME"`
+	RedisHost                        string        `mapstructure:"REDIS_HOST"`
+	RedisPort                        int           `mapstructure:"REDIS_PORT"`
+	RedisPassword                    string        `mapstructure:"REDIS_PASSWORD"`
+	RedisDB                          int           `mapstructure:"REDIS_DB"`
 }
 
 func LoadConfig(path string) (*Conf, error) {
@@ -0,0 +1,492 @@
+package configs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"gopkg.in/yaml.v3"
+)
+
+// Key sources of a policy.
+const (
+	KeyIP     = "ip"
+	KeyToken  = "token"
+	KeyHeader = "header"
+	KeyJWT    = "jwt"
+)
+
+// Policy is a named set of limits applied to the requests it matches, keyed
+// by the client IP, the API token, a header or a JWT claim. Algorithm,
+// RefillRate and BucketCapacity inherit the environment configuration when
+// unset. OnStorageError tells how requests are decided while the storage is
+// unavailable, open, closed or fallback, and StorageErrorStatus the status of
+// the requests rejected in closed mode, 503 by default. A Shadow policy counts
+// the requests it matches and reports those it would deny without rejecting
+// them, and the next policy that matches still limits them. BlockMultiplier
+// multiplies the block of each repeat offense within OffenseLookback, 24h by
+// default, up to MaxBlockDuration, which defaults to the lookback. Costs
+// weight the requests matching them, which cost 1 otherwise. MaxInFlight
+// also limits the requests of a key in progress at once, with slots leased
+// for LeaseDuration, 30s by default, and renewed while the request runs.
+// Limits replace Limit and Window with several fixed windows enforced at once.
+// Quota also limits the requests of a key per calendar period. Each route
+// the policy matches, by method and pattern, has its own counters unless
+// SharedCounters is set.
+type Policy struct {
+	Name               string        `yaml:"name"`
+	Key                PolicyKey     `yaml:"key"`
+	Algorithm          string        `yaml:"algorithm"`
+	Limit              int           `yaml:"limit"`
+	UnknownTokenLimit  int           `yaml:"unknown_token_limit"`
+	Window             time.Duration `yaml:"window"`
+	BlockDuration      time.Duration `yaml:"block_duration"`
+	RefillRate         float64       `yaml:"refill_rate"`
+	BucketCapacity     int           `yaml:"bucket_capacity"`
+	Match              PolicyMatch   `yaml:"match"`
+	OnStorageError     string        `yaml:"on_storage_error"`
+	StorageErrorStatus int           `yaml:"storage_error_status"`
+	Shadow             bool          `yaml:"shadow"`
+	BlockMultiplier    float64       `yaml:"block_multiplier"`
+	MaxBlockDuration   time.Duration `yaml:"max_block_duration"`
+	OffenseLookback    time.Duration `yaml:"offense_lookback"`
+	Costs              []PolicyCost  `yaml:"costs"`
+	MaxInFlight        int           `yaml:"max_in_flight"`
+	LeaseDuration      time.Duration `yaml:"lease_duration"`
+	Limits             []PolicyLimit `yaml:"limits"`
+	Quota              *PolicyQuota  `yaml:"quota"`
+	SharedCounters     bool          `yaml:"shared_counters"`
+}
+
+// PolicyLimit is one of the windows of a policy with several, such as 500
+// requests per minute on top of 10 per second.
+type PolicyLimit struct {
+	Limit  int           `yaml:"limit"`
+	Window time.Duration `yaml:"window"`
+}
+
+// PolicyKey tells how the limited key is extracted from a request. Header
+// names the header of the header source and Claim the claim of the jwt source.
+type PolicyKey struct {
+	Type   string `yaml:"type"`
+	Header string `yaml:"header"`
+	Claim  string `yaml:"claim"`
+}
+
+// PolicyMatch restricts a policy to requests whose path, method and host match
+// one of the listed values. Paths are chi route patterns or path.Match globs,
+// hosts are path.Match globs, and an empty list matches everything.
+type PolicyMatch struct {
+	Paths   []string `yaml:"paths"`
+	Methods []string `yaml:"methods"`
+	Hosts   []string `yaml:"hosts"`
+}
+
+// PolicyCost is the units of quota used up by the requests of a policy that
+// match Match. The first matching cost applies.
+type PolicyCost struct {
+	Cost  int         `yaml:"cost"`
+	Match PolicyMatch `yaml:"match"`
+}
+
+// PolicyQuota is the quota of a policy per calendar period, day, week or
+// month, starting at midnight in Timezone, an IANA name such as
+// America/Sao_Paulo, UTC by default. WarnAt are the fractions of the quota,
+// between 0 and 1, from which responses carry a warning.
+type PolicyQuota struct {
+	Limit    int       `yaml:"limit"`
+	Period   string    `yaml:"period"`
+	Timezone string    `yaml:"timezone"`
+	WarnAt   []float64 `yaml:"warn_at"`
+}
+
+// Location returns the location of the timezone of the quota.
+func (q PolicyQuota) Location() (*time.Location, error) {
+	return time.LoadLocation(q.Timezone)
+}
+
+// AccessRule names networks, as CIDRs or single IP addresses, and API tokens
+// that bypass the rate limiter, in the allow list, or are always rejected, in
+// the deny list.
+type AccessRule struct {
+	Name   string   `yaml:"name"`
+	CIDRs  []string `yaml:"cidrs"`
+	Tokens []string `yaml:"tokens"`
+}
+
+// PolicySet holds the policies and access lists of a policies file. Version
+// is derived from the content of the file, so it only changes when they do.
+type PolicySet struct {
+	Policies []Policy
+	Allow    []AccessRule
+	Deny     []AccessRule
+	Version  string
+	LoadedAt time.Time
+}
+
+type policyFile struct {
+	Policies []Policy     `yaml:"policies"`
+	Allow    []AccessRule `yaml:"allow"`
+	Deny     []AccessRule `yaml:"deny"`
+}
+
+// LoadPolicySet reads and validates the policies of a YAML or JSON file shaped
+// as {"policies": [{"name": "ip", "key": {"type": "ip"}, "limit": 10, ...}]},
+// with optional "allow" and "deny" lists of access rules. Every invalid entry
+// is reported with its line.
+func LoadPolicySet(file string) (PolicySet, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return PolicySet{}, fmt.Errorf("configs: reading policies: %w", err)
+	}
+
+	pf, err := parsePolicyFile(data)
+	if err != nil {
+		return PolicySet{}, fmt.Errorf("configs: invalid policies %s:\n%w", file, err)
+	}
+
+	sum := sha256.Sum256(data)
+
+	return PolicySet{
+		Policies: pf.Policies,
+		Allow:    pf.Allow,
+		Deny:     pf.Deny,
+		Version:  hex.EncodeToString(sum[:6]),
+		LoadedAt: time.Now(),
+	}, nil
+}
+
+// ParsePolicies decodes and validates the policies of a YAML or JSON document.
+func ParsePolicies(data []byte) ([]Policy, error) {
+	pf, err := parsePolicyFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return pf.Policies, nil
+}
+
+func parsePolicyFile(data []byte) (policyFile, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return policyFile{}, err
+	}
+
+	var file policyFile
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return policyFile{}, errors.New(strings.Join(typeErr.Errors, "\n"))
+		}
+		return policyFile{}, err
+	}
+
+	if len(file.Policies) == 0 {
+		return policyFile{}, errors.New("no policies defined")
+	}
+
+	errs := validatePolicies(file.Policies, listNodes(&doc, "policies"))
+	errs = append(errs, validateAccessRules("allow", file.Allow, listNodes(&doc, "allow"))...)
+	errs = append(errs, validateAccessRules("deny", file.Deny, listNodes(&doc, "deny"))...)
+
+	if err := errors.Join(errs...); err != nil {
+		return policyFile{}, err
+	}
+
+	return file, nil
+}
+
+func validatePolicies(policies []Policy, nodes []*yaml.Node) []error {
+	names := make(map[string]int, len(policies))
+
+	var errs []error
+	for i, p := range policies {
+		node := nodes[i]
+		fail := func(field string, format string, args ...any) {
+			errs = append(errs, fmt.Errorf("line %d: policy %q: %s", fieldLine(node, field), p.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if p.Name == "" {
+			fail("name", "name is required")
+		} else if line, ok := names[p.Name]; ok {
+			fail("name", "name already used by the policy at line %d", line)
+		} else {
+			names[p.Name] = node.Line
+		}
+
+		switch p.Key.Type {
+		case KeyIP, KeyToken:
+		case KeyHeader:
+			if p.Key.Header == "" {
+				fail("key", "key.header is required for header keys")
+			}
+		case KeyJWT:
+			if p.Key.Claim == "" {
+				fail("key", "key.claim is required for jwt keys")
+			}
+		default:
+			fail("key", "key.type must be one of ip, token, header or jwt, got %q", p.Key.Type)
+		}
+
+		switch ratelimiter.Algorithm(p.Algorithm) {
+		case "", ratelimiter.FixedWindow, ratelimiter.TokenBucket, ratelimiter.SlidingLog, ratelimiter.SlidingCounter, ratelimiter.GCRA:
+		default:
+			fail("algorithm", "unknown algorithm %q", p.Algorithm)
+		}
+
+		if len(p.Limits) > 0 {
+			validateLimits(p, fail)
+		} else {
+			if p.Limit <= 0 {
+				fail("limit", "limit must be positive")
+			}
+			if p.Window <= 0 {
+				fail("window", "window must be positive")
+			}
+		}
+		if p.UnknownTokenLimit < 0 {
+			fail("unknown_token_limit", "unknown_token_limit must not be negative")
+		}
+		if p.UnknownTokenLimit > 0 && p.Key.Type != KeyToken {
+			fail("unknown_token_limit", "unknown_token_limit only applies to token keys")
+		}
+		if p.BlockDuration < 0 {
+			fail("block_duration", "block_duration must not be negative")
+		}
+		if p.RefillRate < 0 || p.BucketCapacity < 0 {
+			fail("refill_rate", "refill_rate and bucket_capacity must not be negative")
+		}
+
+		switch {
+		case p.BlockMultiplier == 0:
+			if p.MaxBlockDuration != 0 {
+				fail("max_block_duration", "max_block_duration only applies with block_multiplier")
+			}
+			if p.OffenseLookback != 0 {
+				fail("offense_lookback", "offense_lookback only applies with block_multiplier")
+			}
+		case p.BlockMultiplier < 1:
+			fail("block_multiplier", "block_multiplier must be at least 1, got %g", p.BlockMultiplier)
+		case p.BlockDuration <= 0:
+			fail("block_multiplier", "block_multiplier requires block_duration")
+		case p.Algorithm == string(ratelimiter.GCRA):
+			fail("block_multiplier", "block_multiplier does not apply to the gcra algorithm")
+		}
+		if p.MaxBlockDuration < 0 || p.OffenseLookback < 0 {
+			fail("max_block_duration", "max_block_duration and offense_lookback must not be negative")
+		} else if p.MaxBlockDuration > 0 && p.MaxBlockDuration < p.BlockDuration {
+			fail("max_block_duration", "max_block_duration must not be shorter than block_duration")
+		}
+
+		if p.MaxInFlight < 0 {
+			fail("max_in_flight", "max_in_flight must not be negative")
+		} else if p.MaxInFlight > 0 && p.Shadow {
+			fail("max_in_flight", "max_in_flight does not apply to shadow policies")
+		}
+		if p.LeaseDuration < 0 {
+			fail("lease_duration", "lease_duration must not be negative")
+		} else if p.LeaseDuration > 0 && p.MaxInFlight == 0 {
+			fail("lease_duration", "lease_duration only applies with max_in_flight")
+		}
+
+		switch ratelimiter.FailureMode(p.OnStorageError) {
+		case "", ratelimiter.FailOpen, ratelimiter.FailClosed, ratelimiter.FailFallback:
+		default:
+			fail("on_storage_error", "on_storage_error must be one of open, closed or fallback, got %q", p.OnStorageError)
+		}
+		switch p.StorageErrorStatus {
+		case 0, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		default:
+			fail("storage_error_status", "storage_error_status must be 429 or 503, got %d", p.StorageErrorStatus)
+		}
+		if p.StorageErrorStatus != 0 && p.OnStorageError != string(ratelimiter.FailClosed) {
+			fail("storage_error_status", "storage_error_status only applies to on_storage_error closed")
+		} else if p.StorageErrorStatus != 0 && p.Shadow {
+			fail("storage_error_status", "storage_error_status does not apply to shadow policies")
+		}
+
+		if p.Quota != nil {
+			validateQuota(p, fail)
+		}
+
+		validateMatch(p.Match, func(format string, args ...any) { fail("match", format, args...) })
+
+		limit := p.Limit
+		if len(p.Limits) > 0 {
+			limit = 0
+			for _, l := range p.Limits {
+				if l.Limit > 0 && (limit == 0 || l.Limit < limit) {
+					limit = l.Limit
+				}
+			}
+		}
+		for _, c := range p.Costs {
+			if c.Cost <= 0 {
+				fail("costs", "cost must be positive, got %d", c.Cost)
+			} else if limit > 0 && c.Cost > limit {
+				fail("costs", "cost %d exceeds the limit of %d, so its requests would never be allowed", c.Cost, limit)
+			} else if p.Quota != nil && p.Quota.Limit > 0 && c.Cost > p.Quota.Limit {
+				fail("costs", "cost %d exceeds the quota of %d, so its requests would never be allowed", c.Cost, p.Quota.Limit)
+			}
+			validateMatch(c.Match, func(format string, args ...any) { fail("costs", "cost match: "+format, args...) })
+		}
+	}
+
+	return errs
+}
+
+// validateLimits checks the windows of a policy with several, which are
+// counted as fixed windows, one per length, and replace its limit and window.
+func validateLimits(p Policy, fail func(field string, format string, args ...any)) {
+	if p.Limit != 0 || p.Window != 0 {
+		fail("limits", "limits replace limit and window, which must not be set")
+	}
+	switch ratelimiter.Algorithm(p.Algorithm) {
+	case "", ratelimiter.FixedWindow:
+	default:
+		fail("algorithm", "limits are counted as fixed windows, so they do not apply to the %s algorithm", p.Algorithm)
+	}
+	if p.UnknownTokenLimit > 0 {
+		fail("unknown_token_limit", "unknown_token_limit does not apply with limits")
+	}
+	if p.RefillRate > 0 || p.BucketCapacity > 0 {
+		fail("refill_rate", "refill_rate and bucket_capacity do not apply with limits")
+	}
+
+	windows := make(map[time.Duration]bool, len(p.Limits))
+	for _, l := range p.Limits {
+		if l.Limit <= 0 {
+			fail("limits", "limit must be positive, got %d", l.Limit)
+		}
+		switch {
+		case l.Window <= 0:
+			fail("limits", "window must be positive, got %s", l.Window)
+		case l.Window%time.Millisecond != 0:
+			fail("limits", "window %s must be a whole number of milliseconds", l.Window)
+		case windows[l.Window]:
+			fail("limits", "window %s is listed more than once", l.Window)
+		}
+		windows[l.Window] = true
+	}
+}
+
+func validateQuota(p Policy, fail func(field string, format string, args ...any)) {
+	q := p.Quota
+	if q.Limit <= 0 {
+		fail("quota", "quota.limit must be positive")
+	}
+	switch ratelimiter.QuotaPeriod(q.Period) {
+	case ratelimiter.QuotaDay, ratelimiter.QuotaWeek, ratelimiter.QuotaMonth:
+	default:
+		fail("quota", "quota.period must be one of day, week or month, got %q", q.Period)
+	}
+	if _, err := q.Location(); err != nil {
+		fail("quota", "unknown quota.timezone %q", q.Timezone)
+	}
+	for _, threshold := range q.WarnAt {
+		if threshold <= 0 || threshold >= 1 {
+			fail("quota", "quota.warn_at must be between 0 and 1, got %g", threshold)
+		}
+	}
+	if p.Shadow {
+		fail("quota", "quota does not apply to shadow policies")
+	}
+}
+
+func validateMatch(m PolicyMatch, fail func(format string, args ...any)) {
+	for _, pattern := range m.Paths {
+		if !strings.HasPrefix(pattern, "/") {
+			fail("path %q must start with /", pattern)
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			fail("invalid path %q: %v", pattern, err)
+		}
+	}
+	for _, method := range m.Methods {
+		if method == "" || strings.ToUpper(method) != method {
+			fail("method %q must be an uppercase HTTP method", method)
+		}
+	}
+	for _, host := range m.Hosts {
+		if _, err := path.Match(host, ""); err != nil || host == "" {
+			fail("invalid host %q", host)
+		}
+	}
+}
+
+func validateAccessRules(list string, rules []AccessRule, nodes []*yaml.Node) []error {
+	names := make(map[string]int, len(rules))
+
+	var errs []error
+	for i, rule := range rules {
+		node := nodes[i]
+		fail := func(field string, format string, args ...any) {
+			errs = append(errs, fmt.Errorf("line %d: %s rule %q: %s", fieldLine(node, field), list, rule.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if rule.Name == "" {
+			fail("name", "name is required")
+		} else if line, ok := names[rule.Name]; ok {
+			fail("name", "name already used by the rule at line %d", line)
+		} else {
+			names[rule.Name] = node.Line
+		}
+
+		if len(rule.CIDRs) == 0 && len(rule.Tokens) == 0 {
+			fail("name", "at least one cidr or token is required")
+		}
+		for _, cidr := range rule.CIDRs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				if _, err := netip.ParseAddr(cidr); err != nil {
+					fail("cidrs", "invalid network %q", cidr)
+				}
+			}
+		}
+		for _, token := range rule.Tokens {
+			if token == "" {
+				fail("tokens", "tokens must not be empty")
+			}
+		}
+	}
+
+	return errs
+}
+
+// listNodes returns the mapping node of every entry of a top-level list.
+func listNodes(doc *yaml.Node, field string) []*yaml.Node {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == field {
+			return root.Content[i+1].Content
+		}
+	}
+
+	return nil
+}
+
+// fieldLine returns the line of a field of a policy, or the line of the
+// policy itself when the field is not set.
+func fieldLine(policy *yaml.Node, field string) int {
+	for i := 0; i+1 < len(policy.Content); i += 2 {
+		if policy.Content[i].Value == field {
+			return policy.Content[i].Line
+		}
+	}
+
+	return policy.Line
+}
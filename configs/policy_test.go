@@ -0,0 +1,473 @@
+package configs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicies(t *testing.T) {
+	t.Run("should parse YAML policies", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: login
+    key:
+      type: ip
+    limit: 5
+    window: 1m
+    block_duration: 5m
+    match:
+      methods: [POST]
+      paths: [/login]
+  - name: tenant
+    key:
+      type: jwt
+      claim: tenant
+    algorithm: gcra
+    limit: 100
+    window: 1s
+    shared_counters: true
+`))
+
+		assert.NoError(t, err)
+		assert.Len(t, policies, 2)
+		assert.Equal(t, "login", policies[0].Name)
+		assert.Equal(t, KeyIP, policies[0].Key.Type)
+		assert.Equal(t, time.Minute, policies[0].Window)
+		assert.Equal(t, 5*time.Minute, policies[0].BlockDuration)
+		assert.Equal(t, []string{"POST"}, policies[0].Match.Methods)
+		assert.Equal(t, []string{"/login"}, policies[0].Match.Paths)
+		assert.Equal(t, "tenant", policies[1].Key.Claim)
+		assert.Equal(t, "gcra", policies[1].Algorithm)
+		assert.False(t, policies[0].SharedCounters)
+		assert.True(t, policies[1].SharedCounters)
+	})
+
+	t.Run("should parse JSON policies", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`{
+  "policies": [
+    {"name": "partner", "key": {"type": "header", "header": "X-Partner-ID"}, "limit": 10, "window": "1s",
+     "match": {"hosts": ["*.example.com"]}}
+  ]
+}`))
+
+		assert.NoError(t, err)
+		assert.Len(t, policies, 1)
+		assert.Equal(t, "X-Partner-ID", policies[0].Key.Header)
+		assert.Equal(t, time.Second, policies[0].Window)
+		assert.Equal(t, []string{"*.example.com"}, policies[0].Match.Hosts)
+	})
+
+	t.Run("should report invalid policies with their lines", func(t *testing.T) {
+		_, err := ParsePolicies([]byte(`
+policies:
+  - name: ip
+    key:
+      type: ip
+    limit: 0
+    window: 1s
+  - name: ip
+    key:
+      type: cookie
+    algorithm: leaky_bucket
+    limit: 1
+    window: 1s
+    match:
+      methods: [get]
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 6: policy "ip": limit must be positive`)
+		assert.Contains(t, err.Error(), `line 8: policy "ip": name already used by the policy at line 3`)
+		assert.Contains(t, err.Error(), `line 9: policy "ip": key.type must be one of ip, token, header or jwt, got "cookie"`)
+		assert.Contains(t, err.Error(), `line 11: policy "ip": unknown algorithm "leaky_bucket"`)
+		assert.Contains(t, err.Error(), `line 14: policy "ip": method "get" must be an uppercase HTTP method`)
+	})
+
+	t.Run("should validate the storage failure mode", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: login
+    key:
+      type: ip
+    limit: 5
+    window: 1m
+    on_storage_error: closed
+    storage_error_status: 429
+`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "closed", policies[0].OnStorageError)
+		assert.Equal(t, 429, policies[0].StorageErrorStatus)
+
+		_, err = ParsePolicies([]byte(`
+policies:
+  - name: ip
+    key:
+      type: ip
+    limit: 5
+    window: 1m
+    on_storage_error: ignore
+    storage_error_status: 500
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 8: policy "ip": on_storage_error must be one of open, closed or fallback, got "ignore"`)
+		assert.Contains(t, err.Error(), `line 9: policy "ip": storage_error_status must be 429 or 503, got 500`)
+	})
+
+	t.Run("should parse shadow policies", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: login-strict
+    key:
+      type: ip
+    limit: 3
+    window: 1m
+    shadow: true
+  - name: login
+    key:
+      type: ip
+    limit: 5
+    window: 1m
+`))
+
+		assert.NoError(t, err)
+		assert.True(t, policies[0].Shadow)
+		assert.False(t, policies[1].Shadow)
+
+		_, err = ParsePolicies([]byte(`
+policies:
+  - name: login-strict
+    key:
+      type: ip
+    limit: 3
+    window: 1m
+    shadow: true
+    on_storage_error: closed
+    storage_error_status: 429
+`))
+
+		assert.ErrorContains(t, err, `line 10: policy "login-strict": storage_error_status does not apply to shadow policies`)
+	})
+
+	t.Run("should validate escalating blocks", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: login
+    key:
+      type: ip
+    limit: 5
+    window: 1m
+    block_duration: 5m
+    block_multiplier: 2
+    max_block_duration: 24h
+    offense_lookback: 24h
+`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2.0, policies[0].BlockMultiplier)
+		assert.Equal(t, 24*time.Hour, policies[0].MaxBlockDuration)
+		assert.Equal(t, 24*time.Hour, policies[0].OffenseLookback)
+
+		_, err = ParsePolicies([]byte(`
+policies:
+  - name: login
+    key:
+      type: ip
+    limit: 5
+    window: 1m
+    block_multiplier: 2
+  - name: ip
+    key:
+      type: ip
+    algorithm: gcra
+    limit: 5
+    window: 1m
+    block_duration: 5m
+    block_multiplier: 0.5
+    max_block_duration: 1m
+  - name: token
+    key:
+      type: token
+    limit: 5
+    window: 1m
+    offense_lookback: 1h
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 8: policy "login": block_multiplier requires block_duration`)
+		assert.Contains(t, err.Error(), `line 16: policy "ip": block_multiplier must be at least 1, got 0.5`)
+		assert.Contains(t, err.Error(), `line 17: policy "ip": max_block_duration must not be shorter than block_duration`)
+		assert.Contains(t, err.Error(), `line 23: policy "token": offense_lookback only applies with block_multiplier`)
+	})
+
+	t.Run("should parse and validate request costs", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: api
+    key:
+      type: token
+    limit: 100
+    window: 1m
+    costs:
+      - cost: 10
+        match:
+          paths: ["/export"]
+          methods: [POST]
+`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, []PolicyCost{{Cost: 10, Match: PolicyMatch{Paths: []string{"/export"}, Methods: []string{"POST"}}}}, policies[0].Costs)
+
+		_, err = ParsePolicies([]byte(`
+policies:
+  - name: api
+    key:
+      type: token
+    limit: 5
+    window: 1m
+    costs:
+      - cost: 0
+      - cost: 10
+      - cost: 2
+        match:
+          paths: ["export"]
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 8: policy "api": cost must be positive, got 0`)
+		assert.Contains(t, err.Error(), `line 8: policy "api": cost 10 exceeds the limit of 5`)
+		assert.Contains(t, err.Error(), `line 8: policy "api": cost match: path "export" must start with /`)
+	})
+
+	t.Run("should validate the limit of requests in flight", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: api
+    key:
+      type: token
+    limit: 100
+    window: 1m
+    max_in_flight: 20
+    lease_duration: 1m
+`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 20, policies[0].MaxInFlight)
+		assert.Equal(t, time.Minute, policies[0].LeaseDuration)
+
+		_, err = ParsePolicies([]byte(`
+policies:
+  - name: api
+    key:
+      type: token
+    limit: 100
+    window: 1m
+    lease_duration: 1m
+  - name: shadow
+    key:
+      type: ip
+    limit: 100
+    window: 1m
+    shadow: true
+    max_in_flight: -1
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 8: policy "api": lease_duration only applies with max_in_flight`)
+		assert.Contains(t, err.Error(), `line 15: policy "shadow": max_in_flight must not be negative`)
+	})
+
+	t.Run("should parse and validate several windows", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: api
+    key:
+      type: token
+    limits:
+      - limit: 10
+        window: 1s
+      - limit: 500
+        window: 1m
+      - limit: 50000
+        window: 24h
+    costs:
+      - cost: 10
+        match:
+          paths: [/export]
+`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, []PolicyLimit{{10, time.Second}, {500, time.Minute}, {50000, 24 * time.Hour}}, policies[0].Limits)
+
+		_, err = ParsePolicies([]byte(`
+policies:
+  - name: api
+    key:
+      type: token
+    algorithm: token_bucket
+    limit: 100
+    limits:
+      - limit: 10
+        window: 1s
+      - limit: 0
+        window: 1s
+    costs:
+      - cost: 20
+        match:
+          paths: [/export]
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 6: policy "api": limits are counted as fixed windows, so they do not apply to the token_bucket algorithm`)
+		assert.Contains(t, err.Error(), `line 8: policy "api": limits replace limit and window, which must not be set`)
+		assert.Contains(t, err.Error(), `line 8: policy "api": limit must be positive, got 0`)
+		assert.Contains(t, err.Error(), `line 8: policy "api": window 1s is listed more than once`)
+		assert.Contains(t, err.Error(), `line 13: policy "api": cost 20 exceeds the limit of 10, so its requests would never be allowed`)
+	})
+
+	t.Run("should parse and validate quotas", func(t *testing.T) {
+		policies, err := ParsePolicies([]byte(`
+policies:
+  - name: plan
+    key:
+      type: token
+    limit: 100
+    window: 1m
+    quota:
+      limit: 100000
+      period: month
+      timezone: America/Sao_Paulo
+      warn_at: [0.8, 0.9]
+`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, &PolicyQuota{Limit: 100000, Period: "month", Timezone: "America/Sao_Paulo", WarnAt: []float64{0.8, 0.9}}, policies[0].Quota)
+
+		_, err = ParsePolicies([]byte(`
+policies:
+  - name: plan
+    key:
+      type: token
+    limit: 100
+    window: 1m
+    quota:
+      limit: 0
+      period: year
+      timezone: Mars/Olympus
+      warn_at: [1.5]
+  - name: shadow
+    key:
+      type: ip
+    limit: 100
+    window: 1m
+    shadow: true
+    quota:
+      limit: 10
+      period: day
+    costs:
+      - cost: 20
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 8: policy "plan": quota.limit must be positive`)
+		assert.Contains(t, err.Error(), `line 8: policy "plan": quota.period must be one of day, week or month, got "year"`)
+		assert.Contains(t, err.Error(), `line 8: policy "plan": unknown quota.timezone "Mars/Olympus"`)
+		assert.Contains(t, err.Error(), `line 8: policy "plan": quota.warn_at must be between 0 and 1, got 1.5`)
+		assert.Contains(t, err.Error(), `line 19: policy "shadow": quota does not apply to shadow policies`)
+		assert.Contains(t, err.Error(), `line 22: policy "shadow": cost 20 exceeds the quota of 10, so its requests would never be allowed`)
+	})
+
+	t.Run("should validate the access lists", func(t *testing.T) {
+		_, err := ParsePolicies([]byte(`
+policies:
+  - name: ip
+    key:
+      type: ip
+    limit: 5
+    window: 1m
+allow:
+  - name: health
+    cidrs: [10.0.0.0/8, 192.0.2.1]
+  - name: health
+    cidrs: [10.0.0.0/33]
+deny:
+  - name: abusers
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 11: allow rule "health": name already used by the rule at line 9`)
+		assert.Contains(t, err.Error(), `line 12: allow rule "health": invalid network "10.0.0.0/33"`)
+		assert.Contains(t, err.Error(), `line 14: deny rule "abusers": at least one cidr or token is required`)
+	})
+
+	t.Run("should report unknown fields and malformed values", func(t *testing.T) {
+		_, err := ParsePolicies([]byte(`
+policies:
+  - name: ip
+    key:
+      type: ip
+    max_requests: 10
+    window: soon
+`))
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "line 6: field max_requests not found")
+		assert.Contains(t, err.Error(), "line 7: cannot unmarshal")
+	})
+
+	t.Run("should require at least one policy", func(t *testing.T) {
+		_, err := ParsePolicies([]byte(`policies: []`))
+
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadPolicySet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+
+	t.Run("should version the policies by content", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("policies:\n  - name: ip\n    key: {type: ip}\n    limit: 10\n    window: 1s\n"), 0o600))
+		first, err := LoadPolicySet(path)
+		assert.NoError(t, err)
+		assert.Len(t, first.Policies, 1)
+		assert.Len(t, first.Version, 12)
+
+		again, err := LoadPolicySet(path)
+		assert.NoError(t, err)
+		assert.Equal(t, first.Version, again.Version)
+
+		assert.NoError(t, os.WriteFile(path, []byte("policies:\n  - name: ip\n    key: {type: ip}\n    limit: 20\n    window: 1s\n"), 0o600))
+		changed, err := LoadPolicySet(path)
+		assert.NoError(t, err)
+		assert.NotEqual(t, first.Version, changed.Version)
+	})
+
+	t.Run("should load the access lists", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("policies:\n  - name: ip\n    key: {type: ip}\n    limit: 10\n    window: 1s\nallow:\n  - name: health\n    cidrs: [10.0.0.0/8]\ndeny:\n  - name: abusers\n    tokens: [stolen]\n"), 0o600))
+
+		set, err := LoadPolicySet(path)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []AccessRule{{Name: "health", CIDRs: []string{"10.0.0.0/8"}}}, set.Allow)
+		assert.Equal(t, []AccessRule{{Name: "abusers", Tokens: []string{"stolen"}}}, set.Deny)
+	})
+
+	t.Run("should report the file and line of invalid policies", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("policies:\n  - name: ip\n    key: {type: ip}\n    limit: -1\n    window: 1s\n"), 0o600))
+
+		_, err := LoadPolicySet(path)
+
+		assert.ErrorContains(t, err, path)
+		assert.ErrorContains(t, err, "line 4")
+	})
+
+	t.Run("should fail on a missing file", func(t *testing.T) {
+		_, err := LoadPolicySet(filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,227 @@
+package webserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+)
+
+const (
+	defaultBlockedPageSize = 100
+	maxBlockedPageSize     = 1000
+)
+
+// adminStorage is a storage whose keys can be inspected and changed.
+type adminStorage interface {
+	ratelimiter.Storage
+	ratelimiter.KeyAdmin
+}
+
+// adminAPI lets support engineers inspect, reset, block and unblock single
+// keys without going to the storage. Keys are storage keys, such as
+// login:203.0.113.7, and must be path escaped when they contain a slash.
+type adminAPI struct {
+	storage adminStorage
+	token   string
+	logger  *slog.Logger
+}
+
+type keyStateResponse struct {
+	Key      string `json:"key"`
+	Count    int    `json:"count"`
+	TTL      int    `json:"ttl"`
+	Blocked  bool   `json:"blocked"`
+	BlockTTL int    `json:"block_ttl,omitempty"`
+	Offenses int    `json:"offenses,omitempty"`
+}
+
+type blockedKeysResponse struct {
+	Keys       []keyStateResponse `json:"keys"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+type blockRequest struct {
+	Duration string `json:"duration"`
+}
+
+type adminErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// newAdminRouter returns the routes of the admin API, which require the token
+// as a Bearer token.
+func newAdminRouter(storage adminStorage, token string, logger *slog.Logger) http.Handler {
+	api := &adminAPI{storage: storage, token: token, logger: logger}
+
+	r := chi.NewRouter()
+	r.Use(api.authenticate)
+
+	r.Get("/keys/{key}", api.inspect)
+	r.Delete("/keys/{key}/counter", api.reset)
+	r.Put("/keys/{key}/block", api.block)
+	r.Delete("/keys/{key}/block", api.unblock)
+	r.Get("/blocked", api.listBlocked)
+
+	return r
+}
+
+func (a *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized", "a valid admin token is required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminAPI) inspect(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyParam(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := a.storage.Inspect(r.Context(), key)
+	if err != nil {
+		a.storageError(w, "inspect", key, err)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, newKeyStateResponse(state))
+}
+
+func (a *adminAPI) reset(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.storage.Reset(r.Context(), key); err != nil {
+		a.storageError(w, "reset", key, err)
+		return
+	}
+
+	a.logger.Info("Admin reset key", slog.String("key", key))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) block(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyParam(w, r)
+	if !ok {
+		return
+	}
+
+	var req blockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid_request", "the body must be a JSON object with a duration, such as {\"duration\": \"10m\"}")
+		return
+	}
+
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		writeAdminError(w, http.StatusBadRequest, "invalid_duration", "duration must be a positive Go duration, such as 10m")
+		return
+	}
+
+	if err := a.storage.BlockRequest(r.Context(), key, duration); err != nil {
+		a.storageError(w, "block", key, err)
+		return
+	}
+
+	a.logger.Info("Admin blocked key", slog.String("key", key), slog.String("duration", duration.String()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) unblock(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.storage.Unblock(r.Context(), key); err != nil {
+		a.storageError(w, "unblock", key, err)
+		return
+	}
+
+	a.logger.Info("Admin unblocked key", slog.String("key", key))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) listBlocked(w http.ResponseWriter, r *http.Request) {
+	limit := defaultBlockedPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxBlockedPageSize {
+			writeAdminError(w, http.StatusBadRequest, "invalid_limit", "limit must be between 1 and "+strconv.Itoa(maxBlockedPageSize))
+			return
+		}
+		limit = n
+	}
+
+	keys, next, err := a.storage.ListBlocked(r.Context(), r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		a.storageError(w, "list_blocked", "", err)
+		return
+	}
+
+	resp := blockedKeysResponse{Keys: make([]keyStateResponse, 0, len(keys)), NextCursor: next}
+	for _, state := range keys {
+		resp.Keys = append(resp.Keys, newKeyStateResponse(state))
+	}
+
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func (a *adminAPI) storageError(w http.ResponseWriter, operation, key string, err error) {
+	a.logger.Error("Admin operation failed",
+		slog.String("operation", operation),
+		slog.String("key", key),
+		slog.String("error", err.Error()),
+	)
+	writeAdminError(w, http.StatusInternalServerError, "storage_error", err.Error())
+}
+
+// keyParam returns the unescaped key of the route, so keys holding a network
+// prefix, such as ip:10.0.0.0%2F24, can be addressed.
+func keyParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key, err := url.PathUnescape(chi.URLParam(r, "key"))
+	if err != nil || key == "" {
+		writeAdminError(w, http.StatusBadRequest, "invalid_key", "the key must be a path escaped storage key")
+		return "", false
+	}
+
+	return key, true
+}
+
+func newKeyStateResponse(state ratelimiter.KeyState) keyStateResponse {
+	return keyStateResponse{
+		Key:      state.Key,
+		Count:    state.Count,
+		TTL:      int(math.Ceil(state.TTL.Seconds())),
+		Blocked:  state.Blocked,
+		BlockTTL: int(math.Ceil(state.BlockTTL.Seconds())),
+		Offenses: state.Offenses,
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, code, message string) {
+	writeAdminJSON(w, status, adminErrorResponse{Error: code, Message: message})
+}
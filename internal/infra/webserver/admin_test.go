@@ -0,0 +1,108 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	ctx := context.Background()
+	storage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{})
+	defer storage.Close()
+
+	router := newAdminRouter(storage, "secret", slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	inspect := func(t *testing.T, target string) keyStateResponse {
+		w := send(http.MethodGet, target, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var state keyStateResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&state))
+		return state
+	}
+
+	t.Run("should require the admin token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/keys/ip:a", nil)
+		req.Header.Set("Authorization", "Bearer wrong")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("should inspect and reset a key", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, _, err := storage.IncrRequest(ctx, "ip:a", time.Minute, 10, 1)
+			require.NoError(t, err)
+		}
+
+		state := inspect(t, "/keys/ip:a")
+		assert.Equal(t, "ip:a", state.Key)
+		assert.Equal(t, 3, state.Count)
+		assert.Equal(t, 60, state.TTL)
+		assert.False(t, state.Blocked)
+
+		assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/keys/ip:a/counter", "").Code)
+		assert.Equal(t, 0, inspect(t, "/keys/ip:a").Count)
+	})
+
+	t.Run("should block and unblock escaped keys", func(t *testing.T) {
+		w := send(http.MethodPut, "/keys/ip:10.0.0.0%2F24/block", `{"duration": "10m"}`)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		state := inspect(t, "/keys/ip:10.0.0.0%2F24")
+		assert.Equal(t, "ip:10.0.0.0/24", state.Key)
+		assert.True(t, state.Blocked)
+		assert.Equal(t, 600, state.BlockTTL)
+
+		assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/keys/ip:10.0.0.0%2F24/block", "").Code)
+		assert.False(t, inspect(t, "/keys/ip:10.0.0.0%2F24").Blocked)
+	})
+
+	t.Run("should reject invalid block durations", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, "/keys/ip:a/block", `{"duration": "forever"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, "/keys/ip:a/block", `{"duration": "-1m"}`).Code)
+	})
+
+	t.Run("should list blocked keys with pagination", func(t *testing.T) {
+		for _, key := range []string{"ip:b", "ip:c", "ip:d"} {
+			require.NoError(t, storage.BlockRequest(ctx, key, time.Minute))
+		}
+
+		var page blockedKeysResponse
+		w := send(http.MethodGet, "/blocked?limit=2", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		assert.Len(t, page.Keys, 2)
+		assert.Equal(t, "ip:c", page.NextCursor)
+
+		cursor := page.NextCursor
+		page = blockedKeysResponse{}
+		w = send(http.MethodGet, "/blocked?limit=2&cursor="+cursor, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		assert.Equal(t, "ip:d", page.Keys[0].Key)
+		assert.Empty(t, page.NextCursor)
+
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/blocked?limit=0", "").Code)
+	})
+}
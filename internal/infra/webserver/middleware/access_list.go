@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+const HeaderRateLimitRule = "X-RateLimit-Rule"
+
+// AccessRule names a set of networks and API tokens. Networks are CIDRs or
+// single IP addresses.
+type AccessRule struct {
+	Name   string
+	CIDRs  []string
+	Tokens []string
+}
+
+// AccessAction is what an AccessList decides for a request.
+type AccessAction int
+
+const (
+	AccessNone AccessAction = iota
+	AccessAllow
+	AccessDeny
+)
+
+// AccessList lets requests from allowed networks or tokens bypass the rate
+// limiter and rejects requests from denied ones without touching the storage.
+// Deny rules are checked first, and among the networks of a list the most
+// specific one matches.
+type AccessList struct {
+	allow access
+	deny  access
+}
+
+type access struct {
+	networks prefixTrie
+	tokens   map[string]string
+}
+
+// NewAccessList builds the access list of the allow and deny rules.
+func NewAccessList(allow, deny []AccessRule) (*AccessList, error) {
+	a := &AccessList{}
+
+	if err := a.allow.add(allow); err != nil {
+		return nil, err
+	}
+	if err := a.deny.add(deny); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Match returns the action for a request from ip carrying token, and the name
+// of the rule that matched.
+func (a *AccessList) Match(ip, token string) (AccessAction, string) {
+	if a == nil {
+		return AccessNone, ""
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+
+	if rule, ok := a.deny.match(addr, err == nil, token); ok {
+		return AccessDeny, rule
+	}
+	if rule, ok := a.allow.match(addr, err == nil, token); ok {
+		return AccessAllow, rule
+	}
+
+	return AccessNone, ""
+}
+
+func (a *access) add(rules []AccessRule) error {
+	for _, rule := range rules {
+		for _, cidr := range rule.CIDRs {
+			prefix, err := parsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("middleware: access rule %q: %w", rule.Name, err)
+			}
+			a.networks.insert(prefix, rule.Name)
+		}
+
+		for _, token := range rule.Tokens {
+			if a.tokens == nil {
+				a.tokens = make(map[string]string)
+			}
+			a.tokens[token] = rule.Name
+		}
+	}
+
+	return nil
+}
+
+func (a *access) match(addr netip.Addr, valid bool, token string) (string, bool) {
+	if token != "" {
+		if rule, ok := a.tokens[token]; ok {
+			return rule, true
+		}
+	}
+
+	if !valid {
+		return "", false
+	}
+
+	return a.networks.lookup(addr)
+}
+
+// parsePrefix parses a CIDR or a single IP address as a prefix, with IPv4
+// mapped addresses unmapped so they match IPv4 clients.
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q", s)
+	}
+
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix.Masked(), nil
+}
+
+// prefixTrie is a binary trie of network prefixes, one per address family,
+// looked up by longest prefix match in at most one step per address bit.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	rule     string
+	set      bool
+}
+
+func (t *prefixTrie) root(addr netip.Addr) **trieNode {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func (t *prefixTrie) insert(prefix netip.Prefix, rule string) {
+	root := t.root(prefix.Addr())
+	if *root == nil {
+		*root = &trieNode{}
+	}
+
+	node := *root
+	bytes := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bytes[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+
+	if !node.set {
+		node.rule, node.set = rule, true
+	}
+}
+
+func (t *prefixTrie) lookup(addr netip.Addr) (string, bool) {
+	node := *t.root(addr)
+
+	var (
+		rule  string
+		found bool
+	)
+
+	bytes := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.set {
+			rule, found = node.rule, true
+		}
+		if i == len(bytes)*8 {
+			break
+		}
+		node = node.children[bytes[i/8]>>(7-i%8)&1]
+	}
+
+	return rule, found
+}
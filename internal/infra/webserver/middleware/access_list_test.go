@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessList_Match(t *testing.T) {
+	access, err := NewAccessList(
+		[]AccessRule{
+			{Name: "health-checkers", CIDRs: []string{"10.0.0.0/8", "192.0.2.10"}},
+			{Name: "partner", CIDRs: []string{"2001:db8::/32"}, Tokens: []string{"partner-token"}},
+			{Name: "office", CIDRs: []string{"10.1.0.0/16"}},
+		},
+		[]AccessRule{
+			{Name: "abusers", CIDRs: []string{"10.1.2.0/24", "::ffff:198.51.100.0/120"}, Tokens: []string{"stolen-token"}},
+		},
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		ip     string
+		token  string
+		action AccessAction
+		rule   string
+	}{
+		{"allowed network", "10.200.0.1", "", AccessAllow, "health-checkers"},
+		{"allowed address", "192.0.2.10", "", AccessAllow, "health-checkers"},
+		{"address next to an allowed one", "192.0.2.11", "", AccessNone, ""},
+		{"most specific allowed network", "10.1.9.9", "", AccessAllow, "office"},
+		{"denied network inside an allowed one", "10.1.2.3", "", AccessDeny, "abusers"},
+		{"denied IPv4 mapped network", "198.51.100.7", "", AccessDeny, "abusers"},
+		{"IPv4 mapped client", "::ffff:10.0.0.1", "", AccessAllow, "health-checkers"},
+		{"allowed IPv6 network", "2001:db8:1::1", "", AccessAllow, "partner"},
+		{"other IPv6 network", "2001:db9::1", "", AccessNone, ""},
+		{"allowed token", "203.0.113.1", "partner-token", AccessAllow, "partner"},
+		{"denied token from an allowed network", "10.0.0.1", "stolen-token", AccessDeny, "abusers"},
+		{"invalid address with a token", "unknown", "partner-token", AccessAllow, "partner"},
+		{"no match", "203.0.113.1", "other-token", AccessNone, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, rule := access.Match(tt.ip, tt.token)
+
+			assert.Equal(t, tt.action, action)
+			assert.Equal(t, tt.rule, rule)
+		})
+	}
+}
+
+func TestAccessList_Invalid(t *testing.T) {
+	_, err := NewAccessList([]AccessRule{{Name: "bad", CIDRs: []string{"10.0.0.0/33"}}}, nil)
+
+	assert.ErrorContains(t, err, `access rule "bad"`)
+}
+
+func TestAccessList_Nil(t *testing.T) {
+	var access *AccessList
+
+	action, rule := access.Match("10.0.0.1", "token")
+
+	assert.Equal(t, AccessNone, action)
+	assert.Empty(t, rule)
+}
@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderForwarded     = "Forwarded"
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// ClientIPResolver finds the address of the client behind a chain of trusted
+// proxies. Only the forwarding header set by the trusted proxies is honored,
+// and only when the direct peer is a trusted proxy. The hops it lists are
+// walked right to left, skipping trusted proxies, so a client cannot spoof its
+// address by prepending entries. A hop that is not an address, such as the
+// unknown or obfuscated _hidden identifiers of Forwarded, identifies the
+// client as it is, since the trusted proxy that wrote it had nothing better
+// to disclose, and the client is never taken for that proxy. Other forwarding
+// headers are ignored, since the proxy passes them through as sent by the
+// client.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// NewClientIPResolver parses the trusted proxies, given as CIDRs or single IP
+// addresses, and the forwarding header they set: Forwarded, X-Forwarded-For
+// or X-Real-IP, X-Forwarded-For by default.
+func NewClientIPResolver(trustedProxies []string, header string) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{header: HeaderXForwardedFor}
+
+	if header != "" {
+		switch http.CanonicalHeaderKey(header) {
+		case HeaderForwarded:
+			resolver.header = HeaderForwarded
+		case http.CanonicalHeaderKey(HeaderXForwardedFor):
+			resolver.header = HeaderXForwardedFor
+		case http.CanonicalHeaderKey(HeaderXRealIP):
+			resolver.header = HeaderXRealIP
+		default:
+			return nil, fmt.Errorf("middleware: client IP header must be Forwarded, X-Forwarded-For or X-Real-IP, got %q", header)
+		}
+	}
+
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("middleware: invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			resolver.trusted = append(resolver.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: invalid trusted proxy %q: %w", proxy, err)
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+
+	return resolver, nil
+}
+
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	peer := parseHop(r.RemoteAddr)
+	if peer == nil {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return host
+	}
+
+	if !c.isTrusted(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	switch c.header {
+	case HeaderForwarded:
+		hops = forwardedFor(r.Header.Values(HeaderForwarded))
+	case HeaderXForwardedFor:
+		hops = splitList(r.Header.Values(HeaderXForwardedFor))
+	case HeaderXRealIP:
+		if ip := r.Header.Get(HeaderXRealIP); ip != "" {
+			hops = []string{ip}
+		}
+	}
+
+	client := peer.String()
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		ip := parseHop(hop)
+		if ip == nil {
+			return hop
+		}
+
+		client = ip.String()
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+func (c *ClientIPResolver) isTrusted(ip net.IP) bool {
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHop parses an address that may carry a port and IPv6 brackets, as found
+// in RemoteAddr and forwarding headers. It returns nil for anything else.
+func parseHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+
+	if ip := net.ParseIP(hop); ip != nil {
+		return normalizeIP(ip)
+	}
+
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	} else {
+		hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	}
+
+	if i := strings.IndexByte(hop, '%'); i >= 0 {
+		hop = hop[:i]
+	}
+
+	if ip := net.ParseIP(hop); ip != nil {
+		return normalizeIP(ip)
+	}
+
+	return nil
+}
+
+// networkKey returns the network of ip for the given prefix lengths, such as
+// "2001:db8:1:2::/64", so that every address of a client network shares a
+// key. Prefixes that are not positive or that cover the whole address leave
+// the address unchanged.
+func networkKey(ip string, ipv4Prefix, ipv6Prefix int) string {
+	parsed := parseHop(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	prefix, bits := ipv6Prefix, 8*net.IPv6len
+	if len(parsed) == net.IPv4len {
+		prefix, bits = ipv4Prefix, 8*net.IPv4len
+	}
+
+	if prefix <= 0 || prefix >= bits {
+		return parsed.String()
+	}
+
+	network := &net.IPNet{IP: parsed.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+
+	return network.String()
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip
+}
+
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		items = append(items, strings.Split(value, ",")...)
+	}
+
+	return items
+}
+
+// forwardedFor returns the for= parameter of every element of RFC 7239
+// Forwarded headers. Elements without one yield the unknown identifier, since
+// the proxy that added them did not disclose the client.
+func forwardedFor(values []string) []string {
+	var hops []string
+
+	for _, element := range splitList(values) {
+		hop := "unknown"
+		for _, pair := range strings.Split(element, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		hops = append(hops, hop)
+	}
+
+	return hops
+}
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIPResolver_ClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{
+			name:       "uses the peer address without forwarding headers",
+			remoteAddr: "203.0.113.7:5000",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "ignores headers from untrusted peers",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"1.1.1.1"}, HeaderXRealIP: {"2.2.2.2"}},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "uses X-Forwarded-For from a trusted proxy",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"198.51.100.4"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "skips trusted hops right to left",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"198.51.100.4, 10.1.1.1, 192.168.1.1"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "ignores spoofed entries prepended by the client",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"6.6.6.6, 198.51.100.4"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "combines repeated X-Forwarded-For headers",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"198.51.100.4", "10.2.2.2"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "returns the leftmost hop when every hop is trusted",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"10.3.3.3, 10.2.2.2"}},
+			want:       "10.3.3.3",
+		},
+		{
+			name:       "uses X-Real-IP from a trusted proxy",
+			header:     HeaderXRealIP,
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXRealIP: {"198.51.100.4"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "uses Forwarded and ignores X-Forwarded-For when configured",
+			header:     HeaderForwarded,
+			remoteAddr: "10.0.0.1:5000",
+			headers: map[string][]string{
+				HeaderForwarded:     {`for=198.51.100.4;proto=https, for=10.1.1.1;by=10.0.0.1`},
+				HeaderXForwardedFor: {"6.6.6.6"},
+			},
+			want: "198.51.100.4",
+		},
+		{
+			name:       "ignores a Forwarded header sent by the client",
+			remoteAddr: "10.0.0.1:5000",
+			headers: map[string][]string{
+				HeaderForwarded:     {`for=6.6.6.6`},
+				HeaderXForwardedFor: {"198.51.100.4"},
+			},
+			want: "198.51.100.4",
+		},
+		{
+			name:       "does not fall back to another header",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXRealIP: {"6.6.6.6"}, HeaderForwarded: {`for=6.6.6.6`}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "parses quoted IPv6 Forwarded addresses with ports",
+			header:     HeaderForwarded,
+			remoteAddr: "[fd00::1]:5000",
+			headers:    map[string][]string{HeaderForwarded: {`for="[2001:db8:cafe::17]:4711"`}},
+			want:       "2001:db8:cafe::17",
+		},
+		{
+			name:       "parses IPv6 X-Forwarded-For behind an IPv6 proxy",
+			remoteAddr: "[fd00::1]:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"2001:db8::1, fd12::2"}},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "normalizes IPv4-mapped IPv6 addresses",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"::ffff:198.51.100.4"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "accepts addresses with ports in X-Forwarded-For",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"198.51.100.4:1234"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "uses a malformed hop as the client",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"198.51.100.4, not-an-ip, 10.1.1.1"}},
+			want:       "not-an-ip",
+		},
+		{
+			name:       "uses the only hop as the client when it is malformed",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"garbage"}},
+			want:       "garbage",
+		},
+		{
+			name:       "uses a malformed X-Real-IP as the client",
+			header:     HeaderXRealIP,
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXRealIP: {"garbage"}},
+			want:       "garbage",
+		},
+		{
+			name:       "uses obfuscated Forwarded identifiers as the client",
+			header:     HeaderForwarded,
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderForwarded: {`for=198.51.100.4, for=_hidden, for=10.1.1.1`}},
+			want:       "_hidden",
+		},
+		{
+			name:       "uses unknown Forwarded clients as the client",
+			header:     HeaderForwarded,
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderForwarded: {`for=unknown`}},
+			want:       "unknown",
+		},
+		{
+			name:       "takes Forwarded elements without for as unknown",
+			header:     HeaderForwarded,
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderForwarded: {`for=198.51.100.4, proto=https`}},
+			want:       "unknown",
+		},
+		{
+			name:       "skips empty X-Forwarded-For entries",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {"198.51.100.4, , 10.1.1.1"}},
+			want:       "198.51.100.4",
+		},
+		{
+			name:       "ignores empty X-Forwarded-For entries",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{HeaderXForwardedFor: {""}},
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "fd00::/8", "192.168.1.1"}, tt.header)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+
+			assert.Equal(t, tt.want, resolver.ClientIP(req))
+		})
+	}
+}
+
+func TestClientIPResolver_NoTrustedProxies(t *testing.T) {
+	resolver, err := NewClientIPResolver(nil, "")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set(HeaderXForwardedFor, "198.51.100.4")
+
+	assert.Equal(t, "10.0.0.1", resolver.ClientIP(req))
+}
+
+func TestNewClientIPResolver_InvalidProxy(t *testing.T) {
+	for _, proxy := range []string{"10.0.0.0/33", "not-an-ip", "fd00::/200"} {
+		_, err := NewClientIPResolver([]string{proxy}, "")
+		assert.Error(t, err, proxy)
+	}
+}
+
+func TestNewClientIPResolver_Header(t *testing.T) {
+	for _, header := range []string{"forwarded", "x-forwarded-for", "X-Real-Ip"} {
+		_, err := NewClientIPResolver(nil, header)
+		assert.NoError(t, err, header)
+	}
+
+	_, err := NewClientIPResolver(nil, "CF-Connecting-IP")
+	assert.Error(t, err)
+}
+
+func TestNetworkKey(t *testing.T) {
+	tests := []struct {
+		ip         string
+		ipv4Prefix int
+		ipv6Prefix int
+		want       string
+	}{
+		{ip: "198.51.100.77", ipv4Prefix: 32, ipv6Prefix: 64, want: "198.51.100.77"},
+		{ip: "198.51.100.77", ipv4Prefix: 24, ipv6Prefix: 64, want: "198.51.100.0/24"},
+		{ip: "198.51.100.77", ipv4Prefix: 0, ipv6Prefix: 0, want: "198.51.100.77"},
+		{ip: "2001:db8:1:2:aaaa:bbbb:cccc:dddd", ipv4Prefix: 32, ipv6Prefix: 64, want: "2001:db8:1:2::/64"},
+		{ip: "2001:db8:1:2ff:aaaa::1", ipv4Prefix: 32, ipv6Prefix: 56, want: "2001:db8:1:200::/56"},
+		{ip: "2001:db8::1", ipv4Prefix: 32, ipv6Prefix: 128, want: "2001:db8::1"},
+		{ip: "::ffff:198.51.100.77", ipv4Prefix: 24, ipv6Prefix: 64, want: "198.51.100.0/24"},
+		{ip: "not-an-ip", ipv4Prefix: 24, ipv6Prefix: 64, want: "not-an-ip"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, networkKey(tt.ip, tt.ipv4Prefix, tt.ipv6Prefix), tt.ip)
+	}
+}
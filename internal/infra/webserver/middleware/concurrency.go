@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+)
+
+const (
+	HeaderConcurrencyLimit    = "X-Concurrency-Limit"
+	HeaderConcurrencyInFlight = "X-Concurrency-In-Flight"
+)
+
+// WithConcurrency limits the requests in flight of the keys of the default
+// limiter with cl, on top of their rate limit.
+func WithConcurrency(cl *ratelimiter.ConcurrencyLimiter) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.concurrency = cl
+	}
+}
+
+// serveLimited serves r with next while holding a slot of rk, when p limits
+// the requests in flight, and once it fits in the quota of p, if any. The
+// slot is released when next returns, panics included, and a client that
+// disconnects releases it once next notices.
+func (rl *RateLimiterMiddleware) serveLimited(w http.ResponseWriter, r *http.Request, p Policy, rk ratelimiter.RateLimitKey, next http.Handler) {
+	if p.Concurrency == nil {
+		if rl.allowQuota(w, r, p, rk) {
+			next.ServeHTTP(w, r)
+		}
+		return
+	}
+
+	lease, resp, err := p.Concurrency.Acquire(r.Context(), rk)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer lease.Release()
+
+	switch {
+	case resp.Degraded:
+		w.Header().Set(HeaderWarning, degradedWarning)
+		if !resp.Allowed {
+			rl.unavailable(w, r, p, ratelimiter.RateLimiterResponse{
+				Policy:     resp.Policy,
+				Limit:      resp.Limit,
+				RetryAfter: time.Now().Add(time.Second),
+			})
+			return
+		}
+	case !resp.Allowed:
+		h := w.Header()
+		h.Set(HeaderConcurrencyLimit, strconv.Itoa(resp.Limit))
+		h.Set(HeaderConcurrencyInFlight, strconv.Itoa(resp.InFlight))
+		h.Set("Retry-After", "1")
+		rl.renderer.RenderDenial(w, r, Denial{
+			Status:     http.StatusTooManyRequests,
+			Reason:     ReasonConcurrencyLimited,
+			Detail:     "too many requests from this client are already in progress",
+			Policy:     resp.Policy,
+			Limit:      resp.Limit,
+			InFlight:   resp.InFlight,
+			RetryAfter: 1,
+		})
+		return
+	default:
+		w.Header().Set(HeaderConcurrencyLimit, strconv.Itoa(resp.Limit))
+	}
+
+	if rl.allowQuota(w, r, p, rk) {
+		next.ServeHTTP(w, r)
+	}
+}
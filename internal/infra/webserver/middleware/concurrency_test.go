@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterMiddleware_Concurrency(t *testing.T) {
+	storage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{})
+	defer storage.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	limiter := ratelimiter.NewRateLimiter(storage, ratelimiter.Options{MaxRequestIP: 100, WindowDuration: time.Minute}, logger)
+	concurrency := ratelimiter.NewConcurrencyLimiter(storage, ratelimiter.ConcurrencyOptions{MaxInFlightIP: 1}, logger)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := NewRateLimiterMiddleware(limiter, logger, WithConcurrency(concurrency)).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			close(started)
+			<-release
+		case "/panic":
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	t.Run("should reject requests over the limit in flight", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- send("/slow") }()
+		<-started
+
+		w := send("/")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "1", w.Header().Get(HeaderConcurrencyLimit))
+		assert.Equal(t, "1", w.Header().Get(HeaderConcurrencyInFlight))
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+		var problem Problem
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&problem))
+		assert.Equal(t, ReasonConcurrencyLimited, problem.Error)
+		assert.Equal(t, 1, problem.InFlight)
+
+		close(release)
+		assert.Equal(t, http.StatusOK, (<-done).Code)
+		assert.Equal(t, http.StatusOK, send("/").Code)
+	})
+
+	t.Run("should release the slot of a handler that panics", func(t *testing.T) {
+		assert.Panics(t, func() { send("/panic") })
+
+		w := send("/")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "1", w.Header().Get(HeaderConcurrencyLimit))
+	})
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// CostFunc returns the units of quota a request uses up, such as more for an
+// expensive export than for a cheap read. Costs below 1 count as 1.
+type CostFunc func(r *http.Request) int
+
+// RouteCost is the cost of the requests matching Match.
+type RouteCost struct {
+	Match Match
+	Cost  int
+}
+
+// RouteCosts returns a CostFunc giving requests the cost of the first route
+// they match, or 1 when they match none.
+func RouteCosts(routes ...RouteCost) CostFunc {
+	return func(r *http.Request) int {
+		for _, route := range routes {
+			if route.Match.matches(r) {
+				return route.Cost
+			}
+		}
+
+		return 1
+	}
+}
+
+// WithCost weights the requests limited by the default limiter, and by the
+// policies without a cost of their own, by fn. Every request costs 1 by
+// default.
+func WithCost(fn CostFunc) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.cost = fn
+	}
+}
+
+// requestCost returns the cost of r under p.
+func (rl *RateLimiterMiddleware) requestCost(r *http.Request, p Policy) int {
+	fn := p.Cost
+	if fn == nil {
+		fn = rl.cost
+	}
+	if fn == nil {
+		return 1
+	}
+
+	return max(fn(r), 1)
+}
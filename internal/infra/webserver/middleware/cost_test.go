@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteCosts(t *testing.T) {
+	cost := RouteCosts(
+		RouteCost{Match: Match{Methods: []string{http.MethodPost}, Paths: []string{"/export"}}, Cost: 10},
+		RouteCost{Match: Match{Paths: []string{"/export", "/reports/*"}}, Cost: 3},
+	)
+
+	tests := []struct {
+		method string
+		path   string
+		cost   int
+	}{
+		{http.MethodPost, "/export", 10},
+		{http.MethodGet, "/export", 3},
+		{http.MethodGet, "/reports/monthly", 3},
+		{http.MethodGet, "/", 1},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.cost, cost(httptest.NewRequest(tt.method, tt.path, nil)), tt.method+" "+tt.path)
+	}
+}
+
+func TestRateLimiterMiddleware_Cost(t *testing.T) {
+	storage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{})
+	defer storage.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	newLimiter := func() *ratelimiter.RateLimiter {
+		return ratelimiter.NewRateLimiter(storage, ratelimiter.Options{
+			MaxRequestIP:   10,
+			WindowDuration: time.Minute,
+			BlockDuration:  time.Minute,
+		}, logger)
+	}
+
+	middleware := NewRateLimiterMiddleware(newLimiter(), logger,
+		WithCost(RouteCosts(RouteCost{Match: Match{Paths: []string{"/search"}}, Cost: 5})),
+		WithPolicies(Policy{
+			Name:    "export",
+			Key:     KeyExtractor{Source: KeyIP},
+			Match:   Match{Paths: []string{"/export", "/export/*"}},
+			Limiter: newLimiter(),
+			Cost:    RouteCosts(RouteCost{Match: Match{Paths: []string{"/export"}}, Cost: 4}),
+		}),
+	)
+
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	t.Run("should weight policy requests by the cost of the policy", func(t *testing.T) {
+		w := send("/export")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "6", w.Header().Get("X-RateLimit-Remaining"))
+
+		w = send("/export")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get("X-RateLimit-Remaining"))
+	})
+
+	t.Run("should reject a request costing more than the quota left", func(t *testing.T) {
+		w := send("/export")
+
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "2", w.Header().Get("X-RateLimit-Remaining"))
+
+		var problem Problem
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&problem))
+		assert.Equal(t, 4, problem.Cost)
+		assert.Equal(t, 2, problem.Remaining)
+		assert.Contains(t, problem.Detail, "exceeds the quota left")
+	})
+
+	t.Run("should still admit cheaper requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("/export/status").Code)
+		assert.Equal(t, http.StatusOK, send("/export/status").Code)
+
+		w := send("/export/status")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+		assert.NotContains(t, w.Body.String(), `"cost"`)
+	})
+
+	t.Run("should weight default limiter requests by the middleware cost", func(t *testing.T) {
+		assert.Equal(t, "5", send("/search").Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, "4", send("/").Header().Get("X-RateLimit-Remaining"))
+	})
+}
@@ -0,0 +1,250 @@
+package middleware
+
+import (
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Reasons of a Denial.
+const (
+	ReasonRateLimited  = "rate_limit_exceeded"
+	ReasonUnavailable  = "rate_limiter_unavailable"
+	ReasonAccessDenied = "access_denied"
+	ReasonUnknownToken = "invalid_api_key"
+
+	ReasonConcurrencyLimited = "concurrency_limit_exceeded"
+	ReasonQuotaExceeded      = "quota_exceeded"
+)
+
+const (
+	mediaProblemJSON = "application/problem+json"
+	mediaJSON        = "application/json"
+	mediaText        = "text/plain"
+	mediaHTML        = "text/html"
+)
+
+// Denial describes a request rejected by the middleware. Window is the window
+// of Limit and RetryAfter, in seconds, Cost the quota the request would have
+// used when it is above 1, PenaltyLevel the offenses that escalated the block
+// of the client, InFlight the requests of the client in progress when too many
+// are, and the Retry-After and limit headers are already set when it is
+// rendered.
+type Denial struct {
+	Status       int
+	Reason       string
+	Detail       string
+	Policy       string
+	Rule         string
+	Limit        int
+	Window       int
+	Remaining    int
+	RetryAfter   int
+	Cost         int
+	PenaltyLevel int
+	InFlight     int
+}
+
+// DenialRenderer writes the status and body of the response to a denied
+// request.
+type DenialRenderer interface {
+	RenderDenial(w http.ResponseWriter, r *http.Request, d Denial)
+}
+
+// DenialRendererFunc adapts a function to a DenialRenderer.
+type DenialRendererFunc func(w http.ResponseWriter, r *http.Request, d Denial)
+
+func (f DenialRendererFunc) RenderDenial(w http.ResponseWriter, r *http.Request, d Denial) {
+	f(w, r, d)
+}
+
+// WithDenialRenderer replaces the default ProblemRenderer of the responses to
+// denied requests.
+func WithDenialRenderer(renderer DenialRenderer) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.renderer = renderer
+	}
+}
+
+// Problem is the RFC 9457 problem details document of a denial, with the
+// limit of the request as extension members.
+type Problem struct {
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	Status       int    `json:"status"`
+	Detail       string `json:"detail,omitempty"`
+	Instance     string `json:"instance,omitempty"`
+	Error        string `json:"error"`
+	Policy       string `json:"policy,omitempty"`
+	Rule         string `json:"rule,omitempty"`
+	Limit        int    `json:"limit,omitempty"`
+	Window       int    `json:"window,omitempty"`
+	Remaining    int    `json:"remaining"`
+	ResetAfter   int    `json:"reset_after,omitempty"`
+	Cost         int    `json:"cost,omitempty"`
+	PenaltyLevel int    `json:"penalty_level,omitempty"`
+	InFlight     int    `json:"in_flight,omitempty"`
+}
+
+// NewProblem returns the problem details of d for r. The type is typeBase
+// followed by the reason, or about:blank without a base.
+func NewProblem(r *http.Request, d Denial, typeBase string) Problem {
+	problemType := "about:blank"
+	if typeBase != "" {
+		problemType = typeBase + strings.ReplaceAll(d.Reason, "_", "-")
+	}
+
+	return Problem{
+		Type:         problemType,
+		Title:        http.StatusText(d.Status),
+		Status:       d.Status,
+		Detail:       d.Detail,
+		Instance:     r.URL.RequestURI(),
+		Error:        d.Reason,
+		Policy:       d.Policy,
+		Rule:         d.Rule,
+		Limit:        d.Limit,
+		Window:       d.Window,
+		Remaining:    d.Remaining,
+		ResetAfter:   d.RetryAfter,
+		Cost:         d.Cost,
+		PenaltyLevel: d.PenaltyLevel,
+		InFlight:     d.InFlight,
+	}
+}
+
+// Template is implemented by text/template and html/template templates.
+type Template interface {
+	Execute(w io.Writer, data any) error
+}
+
+var (
+	defaultTextTemplate = texttemplate.Must(texttemplate.New("text").Parse(
+		"{{.Status}} {{.Title}}: {{.Detail}}\n{{if .ResetAfter}}Retry after {{.ResetAfter}} seconds.\n{{end}}",
+	))
+	defaultHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(
+		`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+{{if .ResetAfter}}<p>Retry after {{.ResetAfter}} seconds.</p>
+{{end}}</body>
+</html>
+`))
+)
+
+// ProblemRenderer renders denials as problem details. The media type is
+// negotiated with the Accept header between application/problem+json, the
+// default, application/json, text/plain and text/html. Text and HTML bodies
+// are rendered by the Text and HTML templates, executed with the Problem,
+// or by built-in ones when they are nil.
+type ProblemRenderer struct {
+	TypeBase string
+	Text     Template
+	HTML     Template
+}
+
+func (p *ProblemRenderer) RenderDenial(w http.ResponseWriter, r *http.Request, d Denial) {
+	problem := NewProblem(r, d, p.TypeBase)
+
+	switch media := negotiate(r.Header.Get("Accept"), mediaProblemJSON, mediaJSON, mediaText, mediaHTML); media {
+	case mediaText:
+		renderTemplate(w, mediaText+"; charset=utf-8", d.Status, orDefault(p.Text, defaultTextTemplate), problem)
+	case mediaHTML:
+		renderTemplate(w, mediaHTML+"; charset=utf-8", d.Status, orDefault(p.HTML, defaultHTMLTemplate), problem)
+	default:
+		w.Header().Set("Content-Type", media)
+		w.WriteHeader(d.Status)
+		json.NewEncoder(w).Encode(problem)
+	}
+}
+
+// TemplateRenderer renders every denial with a single template, executed
+// with the Problem, ignoring the Accept header.
+type TemplateRenderer struct {
+	ContentType string
+	TypeBase    string
+	Template    Template
+}
+
+func (t *TemplateRenderer) RenderDenial(w http.ResponseWriter, r *http.Request, d Denial) {
+	renderTemplate(w, t.ContentType, d.Status, t.Template, NewProblem(r, d, t.TypeBase))
+}
+
+func renderTemplate(w http.ResponseWriter, contentType string, status int, tmpl Template, problem Problem) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, problem); err != nil {
+		http.Error(w, strconv.Itoa(status)+" "+http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	io.WriteString(w, b.String())
+}
+
+func orDefault(tmpl, fallback Template) Template {
+	if tmpl == nil {
+		return fallback
+	}
+	return tmpl
+}
+
+// negotiate returns the offer the Accept header prefers, the first one when
+// it accepts several equally or does not accept any.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// acceptQuality returns the quality the Accept header gives to media, from
+// its most specific matching range.
+func acceptQuality(accept, media string) float64 {
+	mediaType, _, _ := strings.Cut(media, "/")
+
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		rng := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch {
+		case rng == media:
+			s = 2
+		case rng == mediaType+"/*":
+			s = 1
+		case rng == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, 1
+		for _, param := range params[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+	}
+
+	return q
+}
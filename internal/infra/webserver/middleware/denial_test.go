@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProblemRenderer(t *testing.T) {
+	denial := Denial{
+		Status:       http.StatusTooManyRequests,
+		Reason:       ReasonRateLimited,
+		Detail:       "too many requests",
+		Policy:       "login",
+		Limit:        5,
+		RetryAfter:   30,
+		PenaltyLevel: 2,
+	}
+
+	render := func(renderer DenialRenderer, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login?next=/home", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		renderer.RenderDenial(w, req, denial)
+		return w
+	}
+
+	t.Run("should render problem details by default", func(t *testing.T) {
+		w := render(&ProblemRenderer{TypeBase: "https://errors.example.com/"}, "")
+
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+		var problem Problem
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&problem))
+		assert.Equal(t, Problem{
+			Type:         "https://errors.example.com/rate-limit-exceeded",
+			Title:        "Too Many Requests",
+			Status:       http.StatusTooManyRequests,
+			Detail:       "too many requests",
+			Instance:     "/login?next=/home",
+			Error:        ReasonRateLimited,
+			Policy:       "login",
+			Limit:        5,
+			ResetAfter:   30,
+			PenaltyLevel: 2,
+		}, problem)
+	})
+
+	t.Run("should use about:blank without a type base", func(t *testing.T) {
+		w := render(&ProblemRenderer{}, "*/*")
+
+		assert.Contains(t, w.Body.String(), `"type":"about:blank"`)
+		assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("should negotiate the media type", func(t *testing.T) {
+		tests := []struct {
+			accept      string
+			contentType string
+		}{
+			{"application/json", "application/json"},
+			{"text/plain", "text/plain; charset=utf-8"},
+			{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+			{"text/*;q=0.5, application/problem+json", "application/problem+json"},
+			{"text/html;q=0.2, text/plain;q=0.4", "text/plain; charset=utf-8"},
+			{"image/png", "application/problem+json"},
+		}
+
+		for _, tt := range tests {
+			w := render(&ProblemRenderer{}, tt.accept)
+
+			assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"), tt.accept)
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		}
+	})
+
+	t.Run("should render text and HTML", func(t *testing.T) {
+		assert.Equal(t, "429 Too Many Requests: too many requests\nRetry after 30 seconds.\n", render(&ProblemRenderer{}, "text/plain").Body.String())
+		assert.Contains(t, render(&ProblemRenderer{}, "text/html").Body.String(), "<h1>Too Many Requests</h1>")
+	})
+
+	t.Run("should render custom templates", func(t *testing.T) {
+		renderer := &ProblemRenderer{HTML: template.Must(template.New("html").Parse(`<p>{{.Policy}}: {{.Detail}}</p>`))}
+
+		assert.Equal(t, "<p>login: too many requests</p>", render(renderer, "text/html").Body.String())
+
+		w := render(&TemplateRenderer{
+			ContentType: "application/xml",
+			Template:    template.Must(template.New("xml").Parse(`<error status="{{.Status}}">{{.Error}}</error>`)),
+		}, "application/json")
+
+		assert.Equal(t, "application/xml", w.Header().Get("Content-Type"))
+		assert.Equal(t, `<error status="429">rate_limit_exceeded</error>`, w.Body.String())
+	})
+}
+
+func TestRateLimiterMiddleware_DenialRenderer(t *testing.T) {
+	storage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{})
+	defer storage.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	limiter := ratelimiter.NewRateLimiter(storage, ratelimiter.Options{MaxRequestIP: 1, WindowDuration: time.Minute}, logger)
+
+	var rendered Denial
+	handler := NewRateLimiterMiddleware(limiter, logger, WithDenialRenderer(DenialRendererFunc(func(w http.ResponseWriter, r *http.Request, d Denial) {
+		rendered = d
+		w.WriteHeader(d.Status)
+	}))).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, ReasonRateLimited, rendered.Reason)
+	assert.Equal(t, ratelimiter.DefaultPolicy, rendered.Policy)
+	assert.Equal(t, 1, rendered.Limit)
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+)
+
+const (
+	HeaderRateLimit       = "RateLimit"
+	HeaderRateLimitPolicy = "RateLimit-Policy"
+)
+
+// HeaderMode selects the rate limit headers of the responses.
+type HeaderMode string
+
+const (
+	// HeadersLegacy sends X-RateLimit-Limit, X-RateLimit-Remaining and
+	// X-RateLimit-Reset, with the reset as a Unix timestamp.
+	HeadersLegacy HeaderMode = "legacy"
+	// HeadersDraft sends the RateLimit and RateLimit-Policy structured fields
+	// of the IETF httpapi draft, with delta-seconds.
+	HeadersDraft HeaderMode = "draft"
+	HeadersBoth  HeaderMode = "both"
+	HeadersNone  HeaderMode = "none"
+)
+
+// WithHeaderMode selects the rate limit headers of the responses. The legacy
+// headers are sent by default.
+func WithHeaderMode(mode HeaderMode) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.headerMode = mode
+	}
+}
+
+// setLimitHeaders describes the limit of resp in h, with remaining requests
+// left until reset.
+func (rl *RateLimiterMiddleware) setLimitHeaders(h http.Header, resp ratelimiter.RateLimiterResponse, remaining int, reset time.Time) {
+	if rl.headerMode == "" || rl.headerMode == HeadersLegacy || rl.headerMode == HeadersBoth {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(resp.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(int(reset.Unix())))
+	}
+
+	if rl.headerMode == HeadersDraft || rl.headerMode == HeadersBoth {
+		policy := sfString(resp.Policy)
+		h.Set(HeaderRateLimitPolicy, fmt.Sprintf("%s;q=%d;w=%d", policy, resp.Limit, int(math.Ceil(resp.Window.Seconds()))))
+		h.Set(HeaderRateLimit, fmt.Sprintf("%s;r=%d;t=%d", policy, remaining, deltaSeconds(reset)))
+	}
+}
+
+// deltaSeconds returns the whole seconds until t, rounded up so clients do
+// not retry early.
+func deltaSeconds(t time.Time) int {
+	return max(int(math.Ceil(time.Until(t).Seconds())), 0)
+}
+
+// sfString encodes s as a structured field string (RFC 8941).
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 0x20 || c > 0x7e:
+			b.WriteByte('_')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
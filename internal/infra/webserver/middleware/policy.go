@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+)
+
+type KeySource string
+
+const (
+	KeyIP     KeySource = "ip"
+	KeyToken  KeySource = "token"
+	KeyHeader KeySource = "header"
+	KeyJWT    KeySource = "jwt"
+)
+
+// KeyExtractor tells how the limited key is taken from a request. Name is the
+// header of KeyHeader and the claim of KeyJWT.
+type KeyExtractor struct {
+	Source KeySource
+	Name   string
+}
+
+// Match restricts a policy to the requests matching one of its paths, methods
+// and hosts. A path matches the chi route pattern of the request or, as a
+// path.Match glob, its URL path, and an empty list matches every request.
+type Match struct {
+	Paths   []string
+	Methods []string
+	Hosts   []string
+}
+
+// Policy limits the requests it matches with its own limiter. Counters are
+// scoped to the policy name, so policies never share them. FailureStatus is
+// the status of requests rejected because the storage of a fail-closed
+// limiter failed, 503 Service Unavailable by default. Policies whose limiter
+// runs in shadow mode never reject requests and do not stop the search for
+// the enforcing policy, so they can run alongside it. Cost weights the
+// requests of the policy, falling back to the cost of the middleware,
+// Concurrency, when set, also limits the requests of a key in flight, and
+// Quota the requests of a key per calendar period. Each chi route the policy
+// matches, by method and pattern, has its own rate limit counters, unless
+// SharedCounters makes every route of the policy share them.
+type Policy struct {
+	Name           string
+	Key            KeyExtractor
+	Match          Match
+	Limiter        *ratelimiter.RateLimiter
+	FailureStatus  int
+	Cost           CostFunc
+	Concurrency    *ratelimiter.ConcurrencyLimiter
+	Quota          *ratelimiter.QuotaLimiter
+	SharedCounters bool
+}
+
+func (m Match) matches(r *http.Request) bool {
+	if len(m.Methods) > 0 && !contains(m.Methods, r.Method) {
+		return false
+	}
+
+	if len(m.Hosts) > 0 && !matchAny(m.Hosts, requestHost(r)) {
+		return false
+	}
+
+	if len(m.Paths) > 0 {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && contains(m.Paths, rctx.RoutePattern()) {
+			return true
+		}
+		return matchAny(m.Paths, r.URL.Path)
+	}
+
+	return true
+}
+
+// key extracts the key of the policy from r. It reports false when the
+// request does not carry one, such as a request without an API key under a
+// token policy, so the next policy can be tried.
+func (rl *RateLimiterMiddleware) key(r *http.Request, p Policy) (ratelimiter.RateLimitKey, bool) {
+	ip := rl.getIP(r)
+	rk := ratelimiter.RateLimitKey{KeyType: ratelimiter.API, IP: ip, Scope: p.Name}
+
+	switch p.Key.Source {
+	case KeyIP:
+		rk.Key = ip
+	case KeyToken:
+		rk.Key = rl.getToken(r)
+		rk.KeyType = ratelimiter.Token
+	case KeyHeader:
+		rk.Key = r.Header.Get(p.Key.Name)
+	case KeyJWT:
+		rk.Key = jwtClaim(r, p.Key.Name)
+	}
+
+	if !p.SharedCounters {
+		rk.Route = route(r)
+	}
+
+	return rk, rk.Key != ""
+}
+
+// route returns the method and chi route pattern of r, such as
+// "GET /users/{id}". Requests outside a chi route, whose URL paths are chosen
+// by the client, have no route.
+func route(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.RoutePattern() == "" {
+		return ""
+	}
+
+	return r.Method + " " + rctx.RoutePattern()
+}
+
+// jwtClaim returns a claim of the bearer token of r. The signature is not
+// verified, so the token must have been authenticated before reaching the
+// limiter.
+func jwtClaim(r *http.Request, claim string) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	switch value := claims[claim].(type) {
+	case string:
+		return value
+	case float64, bool:
+		return fmt.Sprint(value)
+	default:
+		return ""
+	}
+}
+
+func requestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+
+	return r.Host
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+)
+
+const (
+	HeaderQuotaLimit     = "X-Quota-Limit"
+	HeaderQuotaRemaining = "X-Quota-Remaining"
+	HeaderQuotaReset     = "X-Quota-Reset"
+	HeaderQuotaWarning   = "X-Quota-Warning"
+)
+
+// WithQuota limits the keys of the default limiter to a quota per calendar
+// period with ql, on top of their rate limit.
+func WithQuota(ql *ratelimiter.QuotaLimiter) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.quota = ql
+	}
+}
+
+// allowQuota counts r in the quota of p, when it has one, and reports whether
+// r may be served. The quota headers are set on every counted request, with a
+// warning once a threshold of the quota is reached, and rejected requests are
+// answered.
+func (rl *RateLimiterMiddleware) allowQuota(w http.ResponseWriter, r *http.Request, p Policy, rk ratelimiter.RateLimitKey) bool {
+	if p.Quota == nil {
+		return true
+	}
+
+	cost := rl.requestCost(r, p)
+	resp, err := p.Quota.AllowN(r.Context(), rk, cost)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return false
+	}
+
+	if resp.Degraded {
+		w.Header().Set(HeaderWarning, degradedWarning)
+		if !resp.Allowed {
+			rl.unavailable(w, r, p, ratelimiter.RateLimiterResponse{
+				Policy:     resp.Policy,
+				Limit:      resp.Limit,
+				RetryAfter: time.Now().Add(time.Second),
+			})
+		}
+		return resp.Allowed
+	}
+
+	h := w.Header()
+	h.Set(HeaderQuotaLimit, strconv.Itoa(resp.Limit))
+	h.Set(HeaderQuotaRemaining, strconv.Itoa(resp.Remaining))
+	h.Set(HeaderQuotaReset, strconv.FormatInt(resp.ResetTime.Unix(), 10))
+	if resp.Warning > 0 {
+		h.Set(HeaderQuotaWarning, strconv.Itoa(int(math.Round(resp.Warning*100)))+"%")
+	}
+
+	if resp.Allowed {
+		return true
+	}
+
+	retryAfterSeconds := max(int(math.Ceil(time.Until(resp.ResetTime).Seconds())), 1)
+	denial := Denial{
+		Status:     http.StatusTooManyRequests,
+		Reason:     ReasonQuotaExceeded,
+		Detail:     "the quota of the current " + string(resp.Period) + " is used up",
+		Policy:     resp.Policy,
+		Limit:      resp.Limit,
+		Remaining:  resp.Remaining,
+		RetryAfter: retryAfterSeconds,
+	}
+	if cost > 1 {
+		denial.Cost = cost
+	}
+
+	h.Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	rl.renderer.RenderDenial(w, r, denial)
+
+	return false
+}
+
+// QuotaUsage serves the usage of every quota of the client, one per policy
+// with a quota whose key the request carries, such as its API token, and of
+// the default quota, without counting the request. Policies are not matched
+// against the request, so it can be served on a route of its own. The client
+// is resolved as for limiting, so an unknown token limited by IP gets the
+// usage of its IP, and one that is rejected has no quota.
+func (rl *RateLimiterMiddleware) QuotaUsage(w http.ResponseWriter, r *http.Request) {
+	usage := []ratelimiter.QuotaResponse{}
+	add := func(p Policy, rk ratelimiter.RateLimitKey) bool {
+		if p.Limiter != nil {
+			client, err := p.Limiter.Resolve(r.Context(), rk)
+			if errors.Is(err, ratelimiter.ErrUnknownToken) {
+				return true
+			}
+			if err != nil {
+				rl.logger.Error("Error resolving quota client",
+					slog.String("policy", rk.Policy()),
+					slog.String("error", err.Error()),
+				)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return false
+			}
+			rk = client
+		}
+
+		resp, err := p.Quota.Usage(r.Context(), rk)
+		if err != nil {
+			rl.logger.Error("Error getting quota usage",
+				slog.String("policy", rk.Policy()),
+				slog.String("error", err.Error()),
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return false
+		}
+
+		usage = append(usage, resp)
+		return true
+	}
+
+	for _, p := range rl.loadConfig().policies {
+		if p.Quota == nil {
+			continue
+		}
+		if rk, ok := rl.key(r, p); ok && !add(p, rk) {
+			return
+		}
+	}
+	if rl.quota != nil && !add(Policy{Limiter: rl.limiter, Quota: rl.quota}, rl.defaultKey(r)) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"quotas": usage})
+}
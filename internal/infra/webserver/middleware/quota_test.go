@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterMiddleware_Quota(t *testing.T) {
+	storage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{})
+	defer storage.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	newLimiter := func() *ratelimiter.RateLimiter {
+		return ratelimiter.NewRateLimiter(storage, ratelimiter.Options{MaxRequestIP: 100, MaxRequestToken: 100, WindowDuration: time.Minute}, logger)
+	}
+
+	middleware := NewRateLimiterMiddleware(newLimiter(), logger,
+		WithQuota(ratelimiter.NewQuotaLimiter(storage, ratelimiter.QuotaOptions{Limit: 5, Period: ratelimiter.QuotaDay}, logger)),
+		WithPolicies(Policy{
+			Name:    "plan",
+			Key:     KeyExtractor{Source: KeyToken},
+			Match:   Match{Paths: []string{"/api/*"}},
+			Limiter: newLimiter(),
+			Quota: ratelimiter.NewQuotaLimiter(storage, ratelimiter.QuotaOptions{
+				Limit:  4,
+				Period: ratelimiter.QuotaMonth,
+				WarnAt: []float64{0.5, 0.75},
+			}, logger),
+		}),
+	)
+
+	served := 0
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(HeaderAPIKey, "abc123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("should report the quota left and warn near its end", func(t *testing.T) {
+		for i, warning := range []string{"", "50%", "75%", "75%"} {
+			w := send("/api/orders")
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "4", w.Header().Get(HeaderQuotaLimit))
+			assert.Equal(t, strconv.Itoa(3-i), w.Header().Get(HeaderQuotaRemaining))
+			assert.Equal(t, warning, w.Header().Get(HeaderQuotaWarning))
+		}
+	})
+
+	t.Run("should reject requests once the quota is used up", func(t *testing.T) {
+		w := send("/api/orders")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, 4, served)
+
+		reset, err := strconv.ParseInt(w.Header().Get(HeaderQuotaReset), 10, 64)
+		require.NoError(t, err)
+		retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		require.NoError(t, err)
+		assert.InDelta(t, time.Until(time.Unix(reset, 0)).Seconds(), retryAfter, 2)
+
+		var problem Problem
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&problem))
+		assert.Equal(t, ReasonQuotaExceeded, problem.Error)
+		assert.Equal(t, "plan", problem.Policy)
+	})
+
+	t.Run("should keep the default quota apart", func(t *testing.T) {
+		w := send("/")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "5", w.Header().Get(HeaderQuotaLimit))
+		assert.Equal(t, "4", w.Header().Get(HeaderQuotaRemaining))
+	})
+
+	t.Run("should serve the usage of every quota without counting the request", func(t *testing.T) {
+		for range 2 {
+			req := httptest.NewRequest(http.MethodGet, "/ratelimiter/usage", nil)
+			req.Header.Set(HeaderAPIKey, "abc123")
+			w := httptest.NewRecorder()
+			middleware.QuotaUsage(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var body struct {
+				Quotas []ratelimiter.QuotaResponse `json:"quotas"`
+			}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			require.Len(t, body.Quotas, 2)
+
+			assert.Equal(t, "plan", body.Quotas[0].Policy)
+			assert.Equal(t, ratelimiter.QuotaMonth, body.Quotas[0].Period)
+			assert.Equal(t, 4, body.Quotas[0].Used)
+			assert.Zero(t, body.Quotas[0].Remaining)
+			assert.False(t, body.Quotas[0].Allowed)
+
+			assert.Equal(t, ratelimiter.QuotaDay, body.Quotas[1].Period)
+			assert.Equal(t, 1, body.Quotas[1].Used)
+			assert.True(t, body.Quotas[1].Allowed)
+		}
+	})
+}
+
+func TestRateLimiterMiddleware_QuotaUnknownToken(t *testing.T) {
+	storage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{})
+	defer storage.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	limiter := ratelimiter.NewRateLimiter(storage, ratelimiter.Options{
+		MaxRequestIP:    100,
+		MaxRequestToken: 100,
+		WindowDuration:  time.Minute,
+		TokenRegistry:   emptyTokenRegistry{},
+		UnknownTokens:   ratelimiter.UnknownTokenFallback,
+	}, logger)
+
+	middleware := NewRateLimiterMiddleware(limiter, logger,
+		WithQuota(ratelimiter.NewQuotaLimiter(storage, ratelimiter.QuotaOptions{Limit: 2, Period: ratelimiter.QuotaDay}, logger)),
+		WithConcurrency(ratelimiter.NewConcurrencyLimiter(storage, ratelimiter.ConcurrencyOptions{MaxInFlightIP: 1, MaxInFlightToken: 1}, logger)),
+	)
+
+	send := func(handler http.Handler, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(HeaderAPIKey, token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("should count unknown tokens in the quota of their IP", func(t *testing.T) {
+		handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		assert.Equal(t, http.StatusOK, send(handler, "junk-1").Code)
+		assert.Equal(t, http.StatusOK, send(handler, "junk-2").Code)
+		assert.Equal(t, http.StatusTooManyRequests, send(handler, "junk-3").Code)
+
+		req := httptest.NewRequest(http.MethodGet, "/ratelimiter/usage", nil)
+		req.Header.Set(HeaderAPIKey, "junk-4")
+		w := httptest.NewRecorder()
+		middleware.QuotaUsage(w, req)
+
+		var body struct {
+			Quotas []ratelimiter.QuotaResponse `json:"quotas"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		require.Len(t, body.Quotas, 1)
+		assert.Equal(t, 2, body.Quotas[0].Used)
+	})
+
+	t.Run("should hold the slots of their IP", func(t *testing.T) {
+		require.NoError(t, storage.Reset(context.Background(), "192.0.2.1"))
+
+		var inner *httptest.ResponseRecorder
+		handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inner = send(middleware.Handler(http.NotFoundHandler()), "junk-2")
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		assert.Equal(t, http.StatusOK, send(handler, "junk-1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, inner.Code)
+		assert.Contains(t, inner.Body.String(), ReasonConcurrencyLimited)
+	})
+}
@@ -1,96 +1,336 @@
 package middleware
 
 import (
-	"encoding/json"
+	"errors"
 	"log/slog"
-	"net"
+	"math"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const HeaderAPIKey = "API_KEY"
+const (
+	HeaderAPIKey  = "API_KEY"
+	HeaderWarning = "Warning"
+)
+
+// degradedWarning tells clients that the request was decided without the
+// limiter storage, as allowed by the failure mode of its policy.
+const degradedWarning = `199 - "rate limiter storage unavailable, limits degraded"`
 
 type RateLimiterMiddleware struct {
-	limiter *ratelimiter.RateLimiter
-	logger  *slog.Logger
+	limiter     *ratelimiter.RateLimiter
+	logger      *slog.Logger
+	ipResolver  *ClientIPResolver
+	ipv4Prefix  int
+	ipv6Prefix  int
+	config      atomic.Pointer[config]
+	tracer      trace.Tracer
+	propagator  propagation.TextMapPropagator
+	headerMode  HeaderMode
+	renderer    DenialRenderer
+	cost        CostFunc
+	concurrency *ratelimiter.ConcurrencyLimiter
+	quota       *ratelimiter.QuotaLimiter
+}
+
+type Option func(*RateLimiterMiddleware)
+
+// config is the policies and access list of the middleware. It is replaced as
+// a whole, so a request never sees the policies of one version with the
+// access list of another.
+type config struct {
+	policies []Policy
+	access   *AccessList
+}
+
+// WithPolicies limits the requests with the first policy that matches them
+// and whose key they carry, instead of the default limiter. Requests that no
+// policy applies to fall back to the default limiter, or are not limited when
+// there is none.
+func WithPolicies(policies ...Policy) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.SetPolicies(policies)
+	}
+}
+
+// SetPolicies replaces the policies of the middleware. Requests in flight keep
+// the policies they started with.
+func (rl *RateLimiterMiddleware) SetPolicies(policies []Policy) {
+	rl.updateConfig(func(c *config) { c.policies = policies })
+}
+
+// WithAccessList makes requests matching an allow rule of access bypass the
+// limiter and rejects requests matching a deny rule with 403 Forbidden.
+func WithAccessList(access *AccessList) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.SetAccessList(access)
+	}
+}
+
+// SetAccessList replaces the access list of the middleware.
+func (rl *RateLimiterMiddleware) SetAccessList(access *AccessList) {
+	rl.updateConfig(func(c *config) { c.access = access })
 }
 
-type RateLimitErrorResponse struct {
-	Error      string `json:"error"`
-	Message    string `json:"message"`
-	Limit      int    `json:"limit"`
-	Remaining  int    `json:"remaining"`
-	ResetAfter int    `json:"reset_after"`
+// SetConfig replaces the policies and the access list of the middleware at
+// once. Requests in flight keep the ones they started with.
+func (rl *RateLimiterMiddleware) SetConfig(policies []Policy, access *AccessList) {
+	rl.config.Store(&config{policies: policies, access: access})
 }
 
-func NewRateLimiterMiddleware(l *ratelimiter.RateLimiter, logger *slog.Logger) *RateLimiterMiddleware {
-	return &RateLimiterMiddleware{
-		limiter: l,
-		logger:  logger,
+func (rl *RateLimiterMiddleware) updateConfig(update func(*config)) {
+	for {
+		current := rl.config.Load()
+		next := config{}
+		if current != nil {
+			next = *current
+		}
+		update(&next)
+
+		if rl.config.CompareAndSwap(current, &next) {
+			return
+		}
 	}
 }
 
+func (rl *RateLimiterMiddleware) loadConfig() *config {
+	if c := rl.config.Load(); c != nil {
+		return c
+	}
+
+	return &config{}
+}
+
+// WithClientIPResolver makes the middleware resolve the client IP through
+// trusted proxies instead of using the address of the direct peer.
+func WithClientIPResolver(resolver *ClientIPResolver) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.ipResolver = resolver
+	}
+}
+
+// WithIPPrefixes makes IP-based keys cover a whole network, such as an IPv6
+// /64, instead of a single address, so a client cannot bypass the limit by
+// rotating addresses inside its allocation.
+func WithIPPrefixes(ipv4Prefix, ipv6Prefix int) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.ipv4Prefix = ipv4Prefix
+		rl.ipv6Prefix = ipv6Prefix
+	}
+}
+
+func NewRateLimiterMiddleware(l *ratelimiter.RateLimiter, logger *slog.Logger, opts ...Option) *RateLimiterMiddleware {
+	rl := &RateLimiterMiddleware{
+		limiter:    l,
+		logger:     logger,
+		ipResolver: &ClientIPResolver{},
+		renderer:   &ProblemRenderer{},
+	}
+
+	for _, opt := range opts {
+		opt(rl)
+	}
+
+	return rl
+}
+
 func (rl *RateLimiterMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		ip := rl.getIP(r)
-		token := rl.getToken(r)
-
-		var rk ratelimiter.RateLimitKey
-
-		if token != "" {
-			rk.Key = token
-			rk.KeyType = ratelimiter.Token
-		} else {
-			rk.Key = ip
-			rk.KeyType = ratelimiter.API
+		r, span := rl.startSpan(r)
+		cfg := rl.loadConfig()
+
+		switch action, rule := cfg.access.Match(rl.ipResolver.ClientIP(r), rl.getToken(r)); action {
+		case AccessAllow:
+			rl.endAccessSpan(span, "allow", rule)
+			w.Header().Set(HeaderRateLimitRule, "allow:"+rule)
+			next.ServeHTTP(w, r)
+			return
+		case AccessDeny:
+			rl.endAccessSpan(span, "deny", rule)
+			w.Header().Set(HeaderRateLimitRule, "deny:"+rule)
+			rl.renderer.RenderDenial(w, r, Denial{
+				Status: http.StatusForbidden,
+				Reason: ReasonAccessDenied,
+				Detail: "requests from this client are not allowed",
+				Rule:   rule,
+			})
+			return
 		}
 
-		resp, err := rl.limiter.Allow(ctx, rk)
+		rl.shadow(r, cfg.policies)
+
+		p, rk, ok := rl.policy(r, cfg.policies)
+		if !ok {
+			rl.endUnlimitedSpan(span)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rl.setSpanKey(span, rk)
+		resp, err := p.Limiter.AllowN(r.Context(), rk, rl.requestCost(r, p))
+		rl.endSpan(span, resp, err)
+		if errors.Is(err, ratelimiter.ErrUnknownToken) {
+			rl.renderer.RenderDenial(w, r, Denial{
+				Status: http.StatusUnauthorized,
+				Reason: ReasonUnknownToken,
+				Detail: "the provided API key is not registered or has expired",
+				Policy: rk.Policy(),
+			})
+			return
+		}
 		if err != nil {
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		resetTime := resp.ResetTime.Unix()
+		// The slots and the quota are counted for the client the request
+		// was limited as, its IP when its token is unknown.
+		if resp.Key.Key != "" {
+			rk = resp.Key
+		}
 
-		if !resp.Allowed {
-			retryAfterSeconds := int(time.Until(resp.RetryAfter).Seconds())
-			resetTime = resp.RetryAfter.Unix()
-
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(resp.Limit))
-			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(0))
-			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(resetTime)))
-			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
-			w.WriteHeader(http.StatusTooManyRequests)
-
-			response := RateLimitErrorResponse{
-				Error:      "rate_limit_exceeded",
-				Message:    "you have reached the maximum number of requests or actions allowed within a certain time frame",
-				Limit:      resp.Limit,
-				Remaining:  0,
-				ResetAfter: retryAfterSeconds,
+		if resp.Degraded {
+			w.Header().Set(HeaderWarning, degradedWarning)
+
+			// Without a fallback storage nothing was counted, so there are
+			// no limits to report.
+			if resp.FailureMode != ratelimiter.FailFallback {
+				if !resp.Allowed {
+					rl.unavailable(w, r, p, resp)
+					return
+				}
+				rl.serveLimited(w, r, p, rk, next)
+				return
 			}
+		}
 
-			json.NewEncoder(w).Encode(response)
+		if !resp.Allowed {
+			rl.tooManyRequests(w, r, resp)
 			return
 		}
 
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(resp.Limit))
-		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(resp.RequestsLeft))
-		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(resetTime)))
+		rl.setLimitHeaders(w.Header(), resp, resp.RequestsLeft, resp.ResetTime)
 
-		next.ServeHTTP(w, r)
+		rl.serveLimited(w, r, p, rk, next)
 	})
 }
 
+// tooManyRequests rejects a request over the limit of its policy. A request
+// whose cost does not fit in the quota left is told how much is left.
+func (rl *RateLimiterMiddleware) tooManyRequests(w http.ResponseWriter, r *http.Request, resp ratelimiter.RateLimiterResponse) {
+	retryAfterSeconds := int(time.Until(resp.RetryAfter).Seconds())
+
+	detail := "you have reached the maximum number of requests or actions allowed within a certain time frame"
+	if resp.RequestsLeft > 0 {
+		detail = "the cost of this request exceeds the quota left within the current time frame"
+	}
+
+	denial := Denial{
+		Status:       http.StatusTooManyRequests,
+		Reason:       ReasonRateLimited,
+		Detail:       detail,
+		Policy:       resp.Policy,
+		Limit:        resp.Limit,
+		Window:       int(math.Ceil(resp.Window.Seconds())),
+		Remaining:    resp.RequestsLeft,
+		RetryAfter:   retryAfterSeconds,
+		PenaltyLevel: resp.PenaltyLevel,
+	}
+	if resp.Cost > 1 {
+		denial.Cost = resp.Cost
+	}
+
+	rl.setLimitHeaders(w.Header(), resp, resp.RequestsLeft, resp.RetryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	rl.renderer.RenderDenial(w, r, denial)
+}
+
+// unavailable rejects a request because the storage of a fail-closed policy
+// failed, with the status of the policy.
+func (rl *RateLimiterMiddleware) unavailable(w http.ResponseWriter, r *http.Request, p Policy, resp ratelimiter.RateLimiterResponse) {
+	status := p.FailureStatus
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+
+	retryAfterSeconds := max(int(time.Until(resp.RetryAfter).Seconds()), 1)
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	rl.renderer.RenderDenial(w, r, Denial{
+		Status:     status,
+		Reason:     ReasonUnavailable,
+		Detail:     "the rate limiter is temporarily unavailable, please retry later",
+		Policy:     resp.Policy,
+		Limit:      resp.Limit,
+		RetryAfter: retryAfterSeconds,
+	})
+}
+
+// shadow evaluates r against every shadow policy that applies to it, and the
+// default limiter when it runs in shadow mode. Their limiters count r and
+// report the requests they would deny, but r is never rejected by them.
+func (rl *RateLimiterMiddleware) shadow(r *http.Request, policies []Policy) {
+	for _, p := range policies {
+		if !p.Limiter.Shadow() || !p.Match.matches(r) {
+			continue
+		}
+		if rk, ok := rl.key(r, p); ok {
+			rl.allowShadow(r, p, rk)
+		}
+	}
+
+	if rl.limiter != nil && rl.limiter.Shadow() {
+		rl.allowShadow(r, Policy{Limiter: rl.limiter}, rl.defaultKey(r))
+	}
+}
+
+func (rl *RateLimiterMiddleware) allowShadow(r *http.Request, p Policy, rk ratelimiter.RateLimitKey) {
+	if _, err := p.Limiter.AllowN(r.Context(), rk, rl.requestCost(r, p)); err != nil {
+		rl.logger.Warn("Shadow rate limit policy failed",
+			slog.String("policy", rk.Policy()),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// policy returns the policy and key for r, from the first enforcing policy
+// that applies to it or else from the default limiter, keyed by the API token
+// or, without one, by the client IP. It reports false when nothing limits r.
+func (rl *RateLimiterMiddleware) policy(r *http.Request, policies []Policy) (Policy, ratelimiter.RateLimitKey, bool) {
+	for _, p := range policies {
+		if p.Limiter.Shadow() || !p.Match.matches(r) {
+			continue
+		}
+		if rk, ok := rl.key(r, p); ok {
+			return p, rk, true
+		}
+	}
+
+	if rl.limiter == nil || rl.limiter.Shadow() {
+		return Policy{}, ratelimiter.RateLimitKey{}, false
+	}
+
+	return Policy{Limiter: rl.limiter, Concurrency: rl.concurrency, Quota: rl.quota}, rl.defaultKey(r), true
+}
+
+// defaultKey returns the key of r for the default limiter.
+func (rl *RateLimiterMiddleware) defaultKey(r *http.Request) ratelimiter.RateLimitKey {
+	ip := rl.getIP(r)
+	if token := rl.getToken(r); token != "" {
+		return ratelimiter.RateLimitKey{Key: token, KeyType: ratelimiter.Token, IP: ip}
+	}
+
+	return ratelimiter.RateLimitKey{Key: ip, KeyType: ratelimiter.API, IP: ip}
+}
+
 func (rl *RateLimiterMiddleware) getIP(r *http.Request) string {
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return host
+	return networkKey(rl.ipResolver.ClientIP(r), rl.ipv4Prefix, rl.ipv6Prefix)
 }
 
 func (rl *RateLimiterMiddleware) getToken(r *http.Request) string {
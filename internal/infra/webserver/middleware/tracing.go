@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/webserver/middleware"
+
+// decisionUnlimited is the decision recorded for requests that no policy
+// limits.
+const decisionUnlimited = "unlimited"
+
+// WithTracing makes the middleware record a span for each rate limit decision.
+// The trace context of incoming requests is extracted with propagator, such as
+// propagation.TraceContext for W3C traceparent headers, and handed to the next
+// handler.
+func WithTracing(tp trace.TracerProvider, propagator propagation.TextMapPropagator) Option {
+	return func(rl *RateLimiterMiddleware) {
+		rl.tracer = tp.Tracer(tracerName)
+		rl.propagator = propagator
+	}
+}
+
+// startSpan extracts the incoming trace context of r and starts the span of
+// its rate limit decision, under which the access list, the shadow policies
+// and the enforcing policy are evaluated. Without tracing, r and the span of
+// its context are returned unchanged.
+func (rl *RateLimiterMiddleware) startSpan(r *http.Request) (*http.Request, trace.Span) {
+	if rl.tracer == nil {
+		return r, trace.SpanFromContext(r.Context())
+	}
+
+	ctx := rl.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", r.Method),
+	}
+	if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+		attrs = append(attrs, attribute.String("http.route", rctx.RoutePattern()))
+	}
+
+	var span trace.Span
+	ctx, span = rl.tracer.Start(ctx, "ratelimiter.Handler", trace.WithAttributes(attrs...))
+
+	return r.WithContext(ctx), span
+}
+
+// setSpanKey records on span the policy and key type of rk, the key the
+// request is limited by.
+func (rl *RateLimiterMiddleware) setSpanKey(span trace.Span, rk ratelimiter.RateLimitKey) {
+	if rl.tracer == nil {
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("ratelimiter.policy", rk.Policy()),
+		attribute.String("ratelimiter.key_type", rk.KeyType.String()),
+	)
+}
+
+// endAccessSpan ends the span of a request the access list decided on, allow
+// or deny, by rule, before any policy was evaluated.
+func (rl *RateLimiterMiddleware) endAccessSpan(span trace.Span, action, rule string) {
+	if rl.tracer == nil {
+		return
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("ratelimiter.access", action),
+		attribute.String("ratelimiter.access_rule", rule),
+	)
+}
+
+// endUnlimitedSpan ends the span of a request that no policy limits.
+func (rl *RateLimiterMiddleware) endUnlimitedSpan(span trace.Span) {
+	if rl.tracer == nil {
+		return
+	}
+	defer span.End()
+
+	span.SetAttributes(attribute.String("ratelimiter.decision", decisionUnlimited))
+}
+
+func (rl *RateLimiterMiddleware) endSpan(span trace.Span, resp ratelimiter.RateLimiterResponse, err error) {
+	if rl.tracer == nil {
+		return
+	}
+	defer span.End()
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("ratelimiter.decision", resp.Decision()),
+		attribute.Int("ratelimiter.limit", resp.Limit),
+		attribute.Int("ratelimiter.remaining", resp.RequestsLeft),
+		attribute.Int("ratelimiter.cost", resp.Cost),
+	)
+}
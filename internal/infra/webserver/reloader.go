@@ -0,0 +1,166 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/configs"
+
+	md "github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/webserver/middleware"
+)
+
+// reloadDelay groups the bursts of events editors produce when saving a file
+// into a single reload.
+const reloadDelay = 100 * time.Millisecond
+
+// policyReloader loads the policies and access lists of the policies file into
+// the rate limiter middleware and reloads them when the file changes or the
+// process receives SIGHUP. Policies that fail validation are rejected and the
+// active ones keep running.
+type policyReloader struct {
+	path   string
+	build  func(configs.PolicySet) []md.Policy
+	rl     *md.RateLimiterMiddleware
+	logger *slog.Logger
+	active atomic.Pointer[configs.PolicySet]
+}
+
+func newPolicyReloader(path string, build func(configs.PolicySet) []md.Policy, rl *md.RateLimiterMiddleware, logger *slog.Logger) *policyReloader {
+	return &policyReloader{
+		path:   path,
+		build:  build,
+		rl:     rl,
+		logger: logger,
+	}
+}
+
+// Reload reads the policies file and swaps the policies of the middleware
+// when they are valid and differ from the active ones.
+func (p *policyReloader) Reload() error {
+	set, err := configs.LoadPolicySet(p.path)
+	if err != nil {
+		p.logger.Error("Rejected rate limit policies, keeping the active ones",
+			slog.String("path", p.path),
+			slog.String("active_version", p.Active().Version),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	if active := p.active.Load(); active != nil && active.Version == set.Version {
+		return nil
+	}
+
+	access, err := newAccessList(set)
+	if err != nil {
+		p.logger.Error("Rejected rate limit access lists, keeping the active ones",
+			slog.String("path", p.path),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	p.rl.SetConfig(p.build(set), access)
+	p.active.Store(&set)
+
+	p.logger.Info("Rate limit policies loaded",
+		slog.String("path", p.path),
+		slog.String("version", set.Version),
+		slog.Int("policies", len(set.Policies)),
+		slog.Int("allow_rules", len(set.Allow)),
+		slog.Int("deny_rules", len(set.Deny)),
+	)
+
+	return nil
+}
+
+// Active returns the policies in use.
+func (p *policyReloader) Active() configs.PolicySet {
+	if set := p.active.Load(); set != nil {
+		return *set
+	}
+
+	return configs.PolicySet{}
+}
+
+// Watch reloads the policies whenever the file changes or the process
+// receives SIGHUP, until ctx is done. The directory of the file is watched, so
+// that files replaced by a rename, as editors do, are seen. A file reached
+// through symlinks, such as a Kubernetes ConfigMap, whose ..data symlink is
+// swapped to a new directory on updates, is reloaded whenever an event in the
+// directory changes the file the path resolves to.
+func (p *policyReloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(p.path)); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	target := filepath.Clean(p.path)
+	resolved, _ := filepath.EvalSymlinks(target)
+	var delay <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			current, _ := filepath.EvalSymlinks(target)
+			if filepath.Clean(event.Name) == target || current != resolved {
+				resolved = current
+				delay = time.After(reloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			p.logger.Warn("Watching rate limit policies", slog.String("error", err.Error()))
+		case <-delay:
+			delay = nil
+			p.Reload()
+		case <-hup:
+			p.logger.Info("Received SIGHUP, reloading rate limit policies")
+			p.Reload()
+		}
+	}
+}
+
+// ServeHTTP reports the active policies version.
+func (p *policyReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	set := p.Active()
+
+	names := make([]string, 0, len(set.Policies))
+	for _, policy := range set.Policies {
+		names = append(names, policy.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version  string    `json:"version"`
+		LoadedAt time.Time `json:"loaded_at"`
+		Policies []string  `json:"policies"`
+	}{set.Version, set.LoadedAt, names})
+}
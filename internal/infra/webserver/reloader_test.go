@@ -0,0 +1,140 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/configs"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"github.com/stretchr/testify/assert"
+
+	md "github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/webserver/middleware"
+)
+
+func writePolicies(t *testing.T, path string, limit string) {
+	t.Helper()
+	data := "policies:\n  - name: ip\n    key: {type: ip}\n    limit: " + limit + "\n    window: 1m\n"
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+}
+
+func TestPolicyReloader(t *testing.T) {
+	storage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{})
+	defer storage.Close()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	rl := md.NewRateLimiterMiddleware(nil, logger)
+	build := func(set configs.PolicySet) []md.Policy {
+		policies := make([]md.Policy, 0, len(set.Policies))
+		for _, p := range set.Policies {
+			policies = append(policies, md.Policy{
+				Name: p.Name,
+				Key:  md.KeyExtractor{Source: md.KeyIP},
+				Limiter: ratelimiter.NewRateLimiter(storage, ratelimiter.Options{
+					MaxRequestIP:   p.Limit,
+					WindowDuration: p.Window,
+				}, logger),
+			})
+		}
+		return policies
+	}
+
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	writePolicies(t, path, "5")
+
+	reloader := newPolicyReloader(path, build, rl, logger)
+	handler := rl.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	limit := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Header().Get("X-RateLimit-Limit")
+	}
+
+	t.Run("should load the policies", func(t *testing.T) {
+		assert.NoError(t, reloader.Reload())
+		assert.NotEmpty(t, reloader.Active().Version)
+		assert.Equal(t, "5", limit())
+	})
+
+	t.Run("should keep the active policies when the file is invalid", func(t *testing.T) {
+		version := reloader.Active().Version
+		writePolicies(t, path, "-1")
+
+		assert.Error(t, reloader.Reload())
+		assert.Equal(t, version, reloader.Active().Version)
+		assert.Equal(t, "5", limit())
+	})
+
+	t.Run("should reload when the file changes", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- reloader.Watch(ctx) }()
+		defer func() {
+			cancel()
+			assert.NoError(t, <-done)
+		}()
+
+		version := reloader.Active().Version
+		time.Sleep(50 * time.Millisecond)
+		writePolicies(t, path, "7")
+
+		assert.Eventually(t, func() bool {
+			return reloader.Active().Version != version
+		}, 2*time.Second, 20*time.Millisecond)
+		assert.Equal(t, "7", limit())
+	})
+
+	t.Run("should reload when a ConfigMap swaps its data directory", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, "..v1"), 0o700))
+		writePolicies(t, filepath.Join(dir, "..v1", "policies.yaml"), "3")
+		assert.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+		assert.NoError(t, os.Symlink(filepath.Join("..data", "policies.yaml"), filepath.Join(dir, "policies.yaml")))
+
+		reloader := newPolicyReloader(filepath.Join(dir, "policies.yaml"), build, rl, logger)
+		assert.NoError(t, reloader.Reload())
+		assert.Equal(t, "3", limit())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- reloader.Watch(ctx) }()
+		defer func() {
+			cancel()
+			assert.NoError(t, <-done)
+		}()
+
+		version := reloader.Active().Version
+		time.Sleep(50 * time.Millisecond)
+
+		// The way the kubelet updates a ConfigMap volume.
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, "..v2"), 0o700))
+		writePolicies(t, filepath.Join(dir, "..v2", "policies.yaml"), "9")
+		assert.NoError(t, os.Symlink("..v2", filepath.Join(dir, "..data_tmp")))
+		assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+
+		assert.Eventually(t, func() bool {
+			return reloader.Active().Version != version
+		}, 2*time.Second, 20*time.Millisecond)
+		assert.Equal(t, "9", limit())
+	})
+
+	t.Run("should report the active version", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		reloader.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ratelimiter/config", nil))
+
+		var body struct {
+			Version  string   `json:"version"`
+			Policies []string `json:"policies"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, reloader.Active().Version, body.Version)
+		assert.Equal(t, []string{"ip"}, body.Policies)
+	})
+}
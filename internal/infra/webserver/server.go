@@ -1,21 +1,38 @@
 package webserver
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/configs"
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/database"
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/handlers"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/tracing"
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/logger"
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	md "github.com/jhonasalves/go-expert-fc-rate-limiter/internal/infra/webserver/middleware"
 )
 
 type Server struct {
-	Router *chi.Mux
+	Router          *chi.Mux
+	storage         ratelimiter.Storage
+	fallbackStorage *ratelimiter.MemoryStorage
+	stopWatcher     context.CancelFunc
+	tracerProvider  *sdktrace.TracerProvider
 }
 
 func NewServer() *Server {
@@ -27,26 +44,300 @@ func NewServer() *Server {
 	logger := logger.NewLogger()
 
 	redisDB := database.NewRedisDatabase(configs)
-	storage := ratelimiter.NewRedisStorage(redisDB.Client, logger)
-	limiter := ratelimiter.NewRateLimiter(
-		storage,
-		ratelimiter.Options{
-			MaxRequestIP:    configs.RateLimiterMaxIPRequests,
-			MaxRequestToken: configs.RateLimiterMaxTokenRequests,
-			WindowDuration:  configs.RateLimiterWindowDuration,
-			BlockDuration:   configs.RateLimiterBlockDuration,
-		},
-		logger,
-	)
-
-	rl := md.NewRateLimiterMiddleware(limiter, logger)
+	storage := newStorage(configs, redisDB, logger)
+	metrics := ratelimiter.NewMetrics(prometheus.DefaultRegisterer, storage)
+	fallbackStorage := ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{
+		Shards:          configs.RateLimiterMemoryShards,
+		MaxKeys:         configs.RateLimiterMemoryMaxKeys,
+		CleanupInterval: configs.RateLimiterMemoryCleanupInterval,
+	})
+	opts := ratelimiter.Options{
+		Algorithm:       ratelimiter.Algorithm(configs.RateLimiterAlgorithm),
+		RefillRate:      configs.RateLimiterRefillRate,
+		BucketCapacity:  configs.RateLimiterBucketCapacity,
+		TokenRegistry:   newTokenRegistry(configs, redisDB, logger),
+		UnknownTokens:   ratelimiter.UnknownTokenPolicy(configs.RateLimiterUnknownTokens),
+		Metrics:         metrics,
+		FallbackStorage: fallbackStorage,
+	}
+	breaker := ratelimiter.NewCircuitBreaker(ratelimiter.BreakerOptions{
+		Timeout:          configs.RateLimiterStorageTimeout,
+		FailureThreshold: configs.RateLimiterBreakerFailures,
+		OpenDuration:     configs.RateLimiterBreakerOpenDuration,
+		HalfOpenRequests: configs.RateLimiterBreakerHalfOpen,
+		ProbeInterval:    configs.RateLimiterBreakerProbeInterval,
+		Metrics:          metrics,
+	}, logger)
+	limiterStorage := metrics.Storage(breaker.Storage(storage))
+
+	ipResolver, err := md.NewClientIPResolver(strings.Split(configs.RateLimiterTrustedProxies, ","), configs.RateLimiterClientIPHeader)
+	if err != nil {
+		panic(err)
+	}
+
+	headerMode := md.HeaderMode(configs.RateLimiterHeaders)
+	switch headerMode {
+	case "", md.HeadersLegacy, md.HeadersDraft, md.HeadersBoth, md.HeadersNone:
+	default:
+		panic(fmt.Sprintf("invalid RATE_LIMITER_HEADERS %q, must be legacy, draft, both or none", headerMode))
+	}
+
+	mdOpts := []md.Option{
+		md.WithClientIPResolver(ipResolver),
+		md.WithIPPrefixes(configs.RateLimiterIPv4Prefix, configs.RateLimiterIPv6Prefix),
+		md.WithHeaderMode(headerMode),
+	}
+
+	tp, err := tracing.NewTracerProvider(context.Background(), configs)
+	if err != nil {
+		panic(err)
+	}
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+		opts.Tracing = ratelimiter.NewTracing(tp)
+		limiterStorage = opts.Tracing.Storage(limiterStorage)
+		mdOpts = append(mdOpts, md.WithTracing(tp, otel.GetTextMapPropagator()))
+	}
+
+	rl := md.NewRateLimiterMiddleware(nil, logger, mdOpts...)
+
+	// Leases and quotas go through the same decorators as the rate limiting
+	// operations, when the storage is able to keep them.
+	var concurrencyStorage ratelimiter.ConcurrencyStorage
+	if _, ok := storage.(ratelimiter.ConcurrencyStorage); ok {
+		concurrencyStorage = limiterStorage.(ratelimiter.ConcurrencyStorage)
+	}
+	var quotaStorage ratelimiter.QuotaStorage
+	if _, ok := storage.(ratelimiter.QuotaStorage); ok {
+		quotaStorage = limiterStorage.(ratelimiter.QuotaStorage)
+	}
+
+	reloader := newPolicyReloader(configs.RateLimiterPoliciesFile, policyBuilder(opts, limiterStorage, concurrencyStorage, quotaStorage, logger), rl, logger)
+	if err := reloader.Reload(); err != nil {
+		panic(err)
+	}
+
+	watchCtx, stopWatcher := context.WithCancel(context.Background())
+	if pinger, ok := storage.(ratelimiter.Pinger); ok {
+		go breaker.Probe(watchCtx, pinger)
+	}
+	go func() {
+		if err := reloader.Watch(watchCtx); err != nil {
+			logger.Warn("Rate limit policies will only be reloaded on restart", slog.String("error", err.Error()))
+		}
+	}()
 
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	r.Handle("/", rl.Handler(http.HandlerFunc(handlers.HomeHandler)))
+	r.Handle("/metrics", promhttp.Handler())
+	r.Handle("/ratelimiter/config", reloader)
+	r.Get("/ratelimiter/usage", rl.QuotaUsage)
+
+	// Like leases and quotas, the admin API goes through the decorators.
+	if _, ok := storage.(adminStorage); ok && configs.RateLimiterAdminToken != "" {
+		r.Mount("/admin", newAdminRouter(limiterStorage.(adminStorage), configs.RateLimiterAdminToken, logger))
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(rl.Handler)
+		r.Handle("/", http.HandlerFunc(handlers.HomeHandler))
+	})
+
+	return &Server{
+		Router:          r,
+		storage:         storage,
+		fallbackStorage: fallbackStorage,
+		stopWatcher:     stopWatcher,
+		tracerProvider:  tp,
+	}
+}
 
-	return &Server{Router: r}
+// Close stops watching the policies file and probing the storage, flushes the pending spans and
+// releases the resources held by the rate limiter storages.
+func (s *Server) Close() error {
+	s.stopWatcher()
+
+	var errs []error
+	if s.tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errs = append(errs, s.tracerProvider.Shutdown(ctx))
+	}
+
+	if closer, ok := s.storage.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	errs = append(errs, s.fallbackStorage.Close())
+
+	return errors.Join(errs...)
+}
+
+func newStorage(cfg *configs.Conf, redisDB *database.RedisDatabase, logger *slog.Logger) ratelimiter.Storage {
+	switch cfg.RateLimiterStorage {
+	case "memory":
+		return ratelimiter.NewMemoryStorage(ratelimiter.MemoryOptions{
+			Shards:          cfg.RateLimiterMemoryShards,
+			MaxKeys:         cfg.RateLimiterMemoryMaxKeys,
+			CleanupInterval: cfg.RateLimiterMemoryCleanupInterval,
+		})
+	case "redis":
+		return ratelimiter.NewRedisStorage(redisDB.Client, logger)
+	default:
+		storage := ratelimiter.NewRedisScriptStorage(redisDB.Client, logger)
+		if err := storage.LoadScripts(context.Background()); err != nil {
+			logger.Warn("Scripts will be loaded on first use", slog.String("error", err.Error()))
+		}
+		return storage
+	}
+}
+
+// policyBuilder returns a function that builds a limiter for each policy of a
+// set, sharing the storage and the options the policy does not set. Only token
+// policies look tokens up in the token registry. Policies limiting the
+// requests in flight hold their leases in concurrency, and policies with a
+// quota keep its usage in quotas, when they are not nil.
+func policyBuilder(opts ratelimiter.Options, storage ratelimiter.Storage, concurrency ratelimiter.ConcurrencyStorage, quotas ratelimiter.QuotaStorage, logger *slog.Logger) func(configs.PolicySet) []md.Policy {
+	return func(set configs.PolicySet) []md.Policy {
+		return newPolicies(opts, set, storage, concurrency, quotas, logger)
+	}
+}
+
+func newPolicies(base ratelimiter.Options, set configs.PolicySet, storage ratelimiter.Storage, concurrency ratelimiter.ConcurrencyStorage, quotas ratelimiter.QuotaStorage, logger *slog.Logger) []md.Policy {
+	result := make([]md.Policy, 0, len(set.Policies))
+	for _, p := range set.Policies {
+		opts := base
+		opts.MaxRequestIP = p.Limit
+		opts.MaxRequestToken = p.Limit
+		opts.WindowDuration = p.Window
+		opts.BlockDuration = p.BlockDuration
+		if p.Algorithm != "" {
+			opts.Algorithm = ratelimiter.Algorithm(p.Algorithm)
+		}
+		if p.RefillRate > 0 {
+			opts.RefillRate = p.RefillRate
+		}
+		if p.BucketCapacity > 0 {
+			opts.BucketCapacity = p.BucketCapacity
+		}
+		opts.FailureMode = ratelimiter.FailureMode(p.OnStorageError)
+		opts.Shadow = p.Shadow
+		opts.BlockMultiplier = p.BlockMultiplier
+		opts.MaxBlockDuration = p.MaxBlockDuration
+		opts.OffenseLookback = p.OffenseLookback
+		if len(p.Limits) > 0 {
+			// The first window describes the policy when its storage fails.
+			opts.MaxRequestIP, opts.MaxRequestToken = p.Limits[0].Limit, p.Limits[0].Limit
+			opts.WindowDuration = p.Limits[0].Window
+			opts.Windows = make([]ratelimiter.Window, 0, len(p.Limits))
+			for _, l := range p.Limits {
+				opts.Windows = append(opts.Windows, ratelimiter.Window{Limit: l.Limit, Duration: l.Window})
+			}
+		}
+
+		key := md.KeyExtractor{Source: md.KeySource(p.Key.Type)}
+		switch p.Key.Type {
+		case configs.KeyToken:
+			if p.UnknownTokenLimit > 0 {
+				opts.MaxRequestIP = p.UnknownTokenLimit
+			}
+		case configs.KeyHeader:
+			key.Name = p.Key.Header
+		case configs.KeyJWT:
+			key.Name = p.Key.Claim
+		}
+		if p.Key.Type != configs.KeyToken {
+			opts.TokenRegistry = nil
+		}
+
+		var cost md.CostFunc
+		if len(p.Costs) > 0 {
+			routes := make([]md.RouteCost, 0, len(p.Costs))
+			for _, c := range p.Costs {
+				routes = append(routes, md.RouteCost{Match: newMatch(c.Match), Cost: c.Cost})
+			}
+			cost = md.RouteCosts(routes...)
+		}
+
+		var inFlight *ratelimiter.ConcurrencyLimiter
+		switch {
+		case p.MaxInFlight > 0 && concurrency == nil:
+			logger.Warn("The storage cannot limit requests in flight, ignoring max_in_flight", slog.String("policy", p.Name))
+		case p.MaxInFlight > 0:
+			inFlight = ratelimiter.NewConcurrencyLimiter(concurrency, ratelimiter.ConcurrencyOptions{
+				MaxInFlightIP:    p.MaxInFlight,
+				MaxInFlightToken: p.MaxInFlight,
+				LeaseDuration:    p.LeaseDuration,
+				FailureMode:      opts.FailureMode,
+				Metrics:          opts.Metrics,
+			}, logger)
+		}
+
+		var quota *ratelimiter.QuotaLimiter
+		switch {
+		case p.Quota != nil && quotas == nil:
+			logger.Warn("The storage cannot keep quotas, ignoring quota", slog.String("policy", p.Name))
+		case p.Quota != nil:
+			// The location was loaded when the policies were validated.
+			location, _ := p.Quota.Location()
+			quota = ratelimiter.NewQuotaLimiter(quotas, ratelimiter.QuotaOptions{
+				Limit:       p.Quota.Limit,
+				Period:      ratelimiter.QuotaPeriod(p.Quota.Period),
+				Location:    location,
+				WarnAt:      p.Quota.WarnAt,
+				FailureMode: opts.FailureMode,
+				Metrics:     opts.Metrics,
+			}, logger)
+		}
+
+		result = append(result, md.Policy{
+			Name:           p.Name,
+			Key:            key,
+			Match:          newMatch(p.Match),
+			Limiter:        ratelimiter.NewRateLimiter(storage, opts, logger),
+			FailureStatus:  p.StorageErrorStatus,
+			Cost:           cost,
+			Concurrency:    inFlight,
+			Quota:          quota,
+			SharedCounters: p.SharedCounters,
+		})
+	}
+
+	return result
+}
+
+func newMatch(m configs.PolicyMatch) md.Match {
+	return md.Match{Paths: m.Paths, Methods: m.Methods, Hosts: m.Hosts}
+}
+
+// newAccessList builds the access list of the allow and deny rules of a set.
+func newAccessList(set configs.PolicySet) (*md.AccessList, error) {
+	convert := func(rules []configs.AccessRule) []md.AccessRule {
+		result := make([]md.AccessRule, 0, len(rules))
+		for _, rule := range rules {
+			result = append(result, md.AccessRule{Name: rule.Name, CIDRs: rule.CIDRs, Tokens: rule.Tokens})
+		}
+		return result
+	}
+
+	return md.NewAccessList(convert(set.Allow), convert(set.Deny))
+}
+
+func newTokenRegistry(cfg *configs.Conf, redisDB *database.RedisDatabase, logger *slog.Logger) ratelimiter.TokenRegistry {
+	switch cfg.RateLimiterTokenRegistry {
+	case "file":
+		registry, err := ratelimiter.NewFileTokenRegistry(cfg.RateLimiterTokenRegistryFile)
+		if err != nil {
+			panic(err)
+		}
+		return registry
+	case "redis":
+		return ratelimiter.NewRedisTokenRegistry(redisDB.Client, logger)
+	default:
+		return nil
+	}
 }
@@ -16,8 +16,8 @@ func (m *StorageMock) IsBlocked(ctx context.Context, key string) (bool, time.Dur
 	return args.Bool(0), args.Get(1).(time.Duration), args.Error(2)
 }
 
-func (m *StorageMock) IncrRequest(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
-	args := m.Called(ctx, key, window)
+func (m *StorageMock) IncrRequest(ctx context.Context, key string, window time.Duration, limit int, cost int) (int, time.Duration, error) {
+	args := m.Called(ctx, key, window, limit, cost)
 	return args.Int(0), args.Get(1).(time.Duration), args.Error(2)
 }
 
@@ -26,6 +26,77 @@ func (m *StorageMock) BlockRequest(ctx context.Context, key string, duration tim
 	return args.Error(0)
 }
 
+func (m *StorageMock) TakeToken(ctx context.Context, key string, rate float64, capacity int, cost int) (bool, float64, error) {
+	args := m.Called(ctx, key, rate, capacity, cost)
+	return args.Bool(0), args.Get(1).(float64), args.Error(2)
+}
+
+func (m *StorageMock) SlidingLog(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error) {
+	args := m.Called(ctx, key, window, limit, cost)
+	return args.Bool(0), args.Int(1), args.Get(2).(time.Duration), args.Error(3)
+}
+
+func (m *StorageMock) SlidingCounter(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error) {
+	args := m.Called(ctx, key, window, limit, cost)
+	return args.Bool(0), args.Int(1), args.Get(2).(time.Duration), args.Error(3)
+}
+
+func (m *StorageMock) GCRA(ctx context.Context, key string, emissionInterval time.Duration, burst int, blockDuration time.Duration, cost int) (bool, int, time.Duration, time.Duration, error) {
+	args := m.Called(ctx, key, emissionInterval, burst, blockDuration, cost)
+	return args.Bool(0), args.Int(1), args.Get(2).(time.Duration), args.Get(3).(time.Duration), args.Error(4)
+}
+
+func (m *StorageMock) HitWindows(ctx context.Context, key string, windows []time.Duration, limits []int, blockDuration time.Duration, cost int) (bool, []int, []time.Duration, time.Duration, error) {
+	args := m.Called(ctx, key, windows, limits, blockDuration, cost)
+	counts, _ := args.Get(1).([]int)
+	resets, _ := args.Get(2).([]time.Duration)
+	return args.Bool(0), counts, resets, args.Get(3).(time.Duration), args.Error(4)
+}
+
+func (m *StorageMock) RecordOffense(ctx context.Context, key string, lookback time.Duration) (int, error) {
+	args := m.Called(ctx, key, lookback)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *StorageMock) Offenses(ctx context.Context, key string) (int, error) {
+	args := m.Called(ctx, key)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *StorageMock) AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, int, error) {
+	args := m.Called(ctx, key, id, limit, lease)
+	return args.Bool(0), args.Int(1), args.Error(2)
+}
+
+func (m *StorageMock) RenewLease(ctx context.Context, key, id string, lease time.Duration) error {
+	args := m.Called(ctx, key, id, lease)
+	return args.Error(0)
+}
+
+func (m *StorageMock) ReleaseLease(ctx context.Context, key, id string) error {
+	args := m.Called(ctx, key, id)
+	return args.Error(0)
+}
+
 func (m *StorageMock) ClearMocks() {
 	m.ExpectedCalls = nil
 }
+
+type AtomicStorageMock struct {
+	StorageMock
+}
+
+func (m *AtomicStorageMock) Hit(ctx context.Context, key string, window time.Duration, limit int, blockDuration time.Duration, cost int) (bool, int, time.Duration, error) {
+	args := m.Called(ctx, key, window, limit, blockDuration, cost)
+	return args.Bool(0), args.Int(1), args.Get(2).(time.Duration), args.Error(3)
+}
+
+func (m *StorageMock) IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (bool, int, error) {
+	args := m.Called(ctx, key, period, ttl, limit, cost)
+	return args.Bool(0), args.Int(1), args.Error(2)
+}
+
+func (m *StorageMock) QuotaUsage(ctx context.Context, key, period string) (int, error) {
+	args := m.Called(ctx, key, period)
+	return args.Int(0), args.Error(1)
+}
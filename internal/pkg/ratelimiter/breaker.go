@@ -0,0 +1,416 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var ErrBreakerOpen = errors.New("ratelimiter: storage circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// Pinger is implemented by storages able to check their health without
+// touching any key.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// BreakerOptions configures a CircuitBreaker. Timeout bounds each storage
+// call. After FailureThreshold consecutive failures the breaker opens and
+// rejects calls for OpenDuration, then lets HalfOpenRequests trial calls
+// through, closing again once they all succeed. A zero FailureThreshold
+// disables the breaker, leaving only the timeout.
+type BreakerOptions struct {
+	Timeout          time.Duration
+	FailureThreshold int
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+	ProbeInterval    time.Duration // how often Probe checks the storage while open
+	Metrics          *Metrics
+}
+
+// CircuitBreaker stops calling a storage that keeps failing, so requests fail
+// fast with ErrBreakerOpen, and are decided by the failure mode of their
+// policy, instead of waiting on a storage that is down.
+type CircuitBreaker struct {
+	opts   BreakerOptions
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trials   int
+	passed   int
+}
+
+func NewCircuitBreaker(opts BreakerOptions, logger *slog.Logger) *CircuitBreaker {
+	return newCircuitBreaker(opts, logger, time.Now)
+}
+
+func newCircuitBreaker(opts BreakerOptions, logger *slog.Logger, now func() time.Time) *CircuitBreaker {
+	if opts.HalfOpenRequests <= 0 {
+		opts.HalfOpenRequests = 1
+	}
+
+	b := &CircuitBreaker{opts: opts, logger: logger, now: now}
+	opts.Metrics.observeBreakerState(b.state)
+
+	return b
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Storage wraps storage so that every call to it is bounded by the timeout and
+// rejected while the breaker is open.
+func (b *CircuitBreaker) Storage(storage Storage) Storage {
+	s := &breakerStorage{storage: storage, leases: concurrencyStorageOf(storage), quotas: quotaStorageOf(storage), admin: keyAdminOf(storage), breaker: b}
+	if atomic, ok := storage.(AtomicStorage); ok {
+		return &breakerAtomicStorage{breakerStorage: s, atomic: atomic}
+	}
+
+	return s
+}
+
+// Probe pings the storage every ProbeInterval while the breaker is open, and
+// lets trial calls through as soon as it answers, instead of waiting for
+// OpenDuration to elapse. It returns when ctx is done.
+func (b *CircuitBreaker) Probe(ctx context.Context, pinger Pinger) {
+	if b.opts.ProbeInterval <= 0 || b.opts.FailureThreshold <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(b.opts.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if b.State() != BreakerOpen {
+				continue
+			}
+
+			probeCtx, cancel := b.withTimeout(ctx)
+			err := pinger.Ping(probeCtx)
+			cancel()
+			if err != nil {
+				b.logger.Debug("Storage health probe failed", slog.String("error", err.Error()))
+				continue
+			}
+
+			b.mu.Lock()
+			if b.state == BreakerOpen {
+				b.setState(BreakerHalfOpen)
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+func (b *CircuitBreaker) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.opts.Timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, b.opts.Timeout)
+}
+
+// call runs fn with the call timeout when the breaker lets it through, and
+// records its outcome. Calls abandoned by the caller are not counted.
+func (b *CircuitBreaker) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	if b.opts.FailureThreshold <= 0 {
+		callCtx, cancel := b.withTimeout(ctx)
+		defer cancel()
+		return fn(callCtx)
+	}
+
+	trial, err := b.acquire()
+	if err != nil {
+		return err
+	}
+
+	callCtx, cancel := b.withTimeout(ctx)
+	defer cancel()
+
+	err = fn(callCtx)
+	if err != nil && ctx.Err() != nil {
+		b.release(trial)
+		return err
+	}
+
+	b.record(trial, err)
+	return err
+}
+
+func (b *CircuitBreaker) acquire() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.opts.OpenDuration {
+		b.setState(BreakerHalfOpen)
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return false, ErrBreakerOpen
+	case BreakerHalfOpen:
+		if b.trials >= b.opts.HalfOpenRequests {
+			return false, ErrBreakerOpen
+		}
+		b.trials++
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (b *CircuitBreaker) release(trial bool) {
+	if !trial {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.trials--
+	}
+}
+
+func (b *CircuitBreaker) record(trial bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		b.failures++
+		if (trial && b.state == BreakerHalfOpen) || (b.state == BreakerClosed && b.failures >= b.opts.FailureThreshold) {
+			b.logger.Warn("Storage call failed, opening the circuit breaker", slog.String("error", err.Error()))
+			b.setState(BreakerOpen)
+		}
+		return
+	}
+
+	b.failures = 0
+	if trial && b.state == BreakerHalfOpen {
+		b.passed++
+		if b.passed >= b.opts.HalfOpenRequests {
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+// setState moves the breaker to state, resetting the counters of the new
+// state. It must be called with mu held.
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+
+	b.logger.Info("Storage circuit breaker state changed",
+		slog.String("from", b.state.String()),
+		slog.String("to", state.String()),
+	)
+
+	b.state = state
+	b.failures = 0
+	b.trials = 0
+	b.passed = 0
+	if state == BreakerOpen {
+		b.openedAt = b.now()
+	}
+
+	b.opts.Metrics.observeBreakerState(state)
+}
+
+type breakerStorage struct {
+	storage Storage
+	leases  ConcurrencyStorage
+	quotas  QuotaStorage
+	admin   KeyAdmin
+	breaker *CircuitBreaker
+}
+
+func (s *breakerStorage) IncrRequest(ctx context.Context, key string, window time.Duration, limit int, cost int) (count int, ttl time.Duration, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		count, ttl, err = s.storage.IncrRequest(ctx, key, window, limit, cost)
+		return err
+	})
+	return count, ttl, err
+}
+
+func (s *breakerStorage) IsBlocked(ctx context.Context, key string) (blocked bool, ttl time.Duration, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		blocked, ttl, err = s.storage.IsBlocked(ctx, key)
+		return err
+	})
+	return blocked, ttl, err
+}
+
+func (s *breakerStorage) BlockRequest(ctx context.Context, key string, duration time.Duration) error {
+	return s.breaker.call(ctx, func(ctx context.Context) error {
+		return s.storage.BlockRequest(ctx, key, duration)
+	})
+}
+
+func (s *breakerStorage) TakeToken(ctx context.Context, key string, rate float64, capacity int, cost int) (allowed bool, tokens float64, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		allowed, tokens, err = s.storage.TakeToken(ctx, key, rate, capacity, cost)
+		return err
+	})
+	return allowed, tokens, err
+}
+
+func (s *breakerStorage) SlidingLog(ctx context.Context, key string, window time.Duration, limit int, cost int) (allowed bool, count int, reset time.Duration, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		allowed, count, reset, err = s.storage.SlidingLog(ctx, key, window, limit, cost)
+		return err
+	})
+	return allowed, count, reset, err
+}
+
+func (s *breakerStorage) SlidingCounter(ctx context.Context, key string, window time.Duration, limit int, cost int) (allowed bool, count int, reset time.Duration, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		allowed, count, reset, err = s.storage.SlidingCounter(ctx, key, window, limit, cost)
+		return err
+	})
+	return allowed, count, reset, err
+}
+
+func (s *breakerStorage) GCRA(ctx context.Context, key string, emissionInterval time.Duration, burst int, blockDuration time.Duration, cost int) (allowed bool, remaining int, retryAfter, resetAfter time.Duration, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		allowed, remaining, retryAfter, resetAfter, err = s.storage.GCRA(ctx, key, emissionInterval, burst, blockDuration, cost)
+		return err
+	})
+	return allowed, remaining, retryAfter, resetAfter, err
+}
+
+func (s *breakerStorage) HitWindows(ctx context.Context, key string, windows []time.Duration, limits []int, blockDuration time.Duration, cost int) (allowed bool, counts []int, resets []time.Duration, blockTTL time.Duration, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		allowed, counts, resets, blockTTL, err = s.storage.HitWindows(ctx, key, windows, limits, blockDuration, cost)
+		return err
+	})
+	return allowed, counts, resets, blockTTL, err
+}
+
+func (s *breakerStorage) RecordOffense(ctx context.Context, key string, lookback time.Duration) (offenses int, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		offenses, err = s.storage.RecordOffense(ctx, key, lookback)
+		return err
+	})
+	return offenses, err
+}
+
+func (s *breakerStorage) Offenses(ctx context.Context, key string) (offenses int, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		offenses, err = s.storage.Offenses(ctx, key)
+		return err
+	})
+	return offenses, err
+}
+
+func (s *breakerStorage) AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (acquired bool, inFlight int, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		acquired, inFlight, err = s.leases.AcquireLease(ctx, key, id, limit, lease)
+		return err
+	})
+	return acquired, inFlight, err
+}
+
+func (s *breakerStorage) RenewLease(ctx context.Context, key, id string, lease time.Duration) error {
+	return s.breaker.call(ctx, func(ctx context.Context) error {
+		return s.leases.RenewLease(ctx, key, id, lease)
+	})
+}
+
+func (s *breakerStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	return s.breaker.call(ctx, func(ctx context.Context) error {
+		return s.leases.ReleaseLease(ctx, key, id)
+	})
+}
+
+func (s *breakerStorage) IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (allowed bool, used int, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		allowed, used, err = s.quotas.IncrQuota(ctx, key, period, ttl, limit, cost)
+		return err
+	})
+	return allowed, used, err
+}
+
+func (s *breakerStorage) QuotaUsage(ctx context.Context, key, period string) (used int, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		used, err = s.quotas.QuotaUsage(ctx, key, period)
+		return err
+	})
+	return used, err
+}
+
+func (s *breakerStorage) Inspect(ctx context.Context, key string) (state KeyState, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		state, err = s.admin.Inspect(ctx, key)
+		return err
+	})
+	return state, err
+}
+
+func (s *breakerStorage) Reset(ctx context.Context, key string) error {
+	return s.breaker.call(ctx, func(ctx context.Context) error {
+		return s.admin.Reset(ctx, key)
+	})
+}
+
+func (s *breakerStorage) Unblock(ctx context.Context, key string) error {
+	return s.breaker.call(ctx, func(ctx context.Context) error {
+		return s.admin.Unblock(ctx, key)
+	})
+}
+
+func (s *breakerStorage) ListBlocked(ctx context.Context, cursor string, count int) (keys []KeyState, next string, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		keys, next, err = s.admin.ListBlocked(ctx, cursor, count)
+		return err
+	})
+	return keys, next, err
+}
+
+type breakerAtomicStorage struct {
+	*breakerStorage
+	atomic AtomicStorage
+}
+
+func (s *breakerAtomicStorage) Hit(ctx context.Context, key string, window time.Duration, limit int, blockDuration time.Duration, cost int) (blocked bool, count int, ttl time.Duration, err error) {
+	err = s.breaker.call(ctx, func(ctx context.Context) (err error) {
+		blocked, count, ttl, err = s.atomic.Hit(ctx, key, window, limit, blockDuration, cost)
+		return err
+	})
+	return blocked, count, ttl, err
+}
@@ -0,0 +1,234 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/mocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type pingFunc func(ctx context.Context) error
+
+func (f pingFunc) Ping(ctx context.Context) error { return f(ctx) }
+
+func TestCircuitBreaker(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctx := context.Background()
+	errStorage := errors.New("connection refused")
+
+	newBreaker := func(opts BreakerOptions) (*CircuitBreaker, *mocks.StorageMock, Storage, *fakeClock) {
+		clock := &fakeClock{now: time.Now()}
+		mockStorage := new(mocks.StorageMock)
+		breaker := newCircuitBreaker(opts, logger, clock.Now)
+		return breaker, mockStorage, breaker.Storage(mockStorage), clock
+	}
+
+	t.Run("should open after consecutive failures and fail fast", func(t *testing.T) {
+		breaker, mockStorage, storage, _ := newBreaker(BreakerOptions{FailureThreshold: 3, OpenDuration: time.Minute})
+		mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), errStorage).Times(3)
+
+		for i := 0; i < 3; i++ {
+			_, _, err := storage.IsBlocked(ctx, "key")
+			assert.ErrorIs(t, err, errStorage)
+		}
+
+		_, _, err := storage.IsBlocked(ctx, "key")
+
+		assert.ErrorIs(t, err, ErrBreakerOpen)
+		assert.Equal(t, BreakerOpen, breaker.State())
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should reset the failures on success", func(t *testing.T) {
+		breaker, mockStorage, storage, _ := newBreaker(BreakerOptions{FailureThreshold: 2, OpenDuration: time.Minute})
+		mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), errStorage).Once()
+		mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), nil).Once()
+		mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), errStorage).Once()
+
+		for i := 0; i < 3; i++ {
+			storage.IsBlocked(ctx, "key")
+		}
+
+		assert.Equal(t, BreakerClosed, breaker.State())
+	})
+
+	t.Run("should close after successful trial calls once open duration elapses", func(t *testing.T) {
+		breaker, mockStorage, storage, clock := newBreaker(BreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute, HalfOpenRequests: 2})
+		mockStorage.On("IncrRequest", mock.Anything, "key", time.Minute, 10, 1).Return(0, time.Duration(0), errStorage).Once()
+		mockStorage.On("IncrRequest", mock.Anything, "key", time.Minute, 10, 1).Return(1, time.Minute, nil)
+
+		storage.IncrRequest(ctx, "key", time.Minute, 10, 1)
+		assert.Equal(t, BreakerOpen, breaker.State())
+
+		clock.Advance(time.Minute)
+
+		count, _, err := storage.IncrRequest(ctx, "key", time.Minute, 10, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, BreakerHalfOpen, breaker.State())
+
+		storage.IncrRequest(ctx, "key", time.Minute, 10, 1)
+		assert.Equal(t, BreakerClosed, breaker.State())
+	})
+
+	t.Run("should reopen when a trial call fails", func(t *testing.T) {
+		breaker, mockStorage, storage, clock := newBreaker(BreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute})
+		mockStorage.On("BlockRequest", mock.Anything, "key", time.Minute).Return(errStorage)
+
+		storage.BlockRequest(ctx, "key", time.Minute)
+		clock.Advance(time.Minute)
+		storage.BlockRequest(ctx, "key", time.Minute)
+
+		assert.Equal(t, BreakerOpen, breaker.State())
+		assert.ErrorIs(t, storage.BlockRequest(ctx, "key", time.Minute), ErrBreakerOpen)
+	})
+
+	t.Run("should bound calls with the timeout", func(t *testing.T) {
+		breaker, mockStorage, storage, _ := newBreaker(BreakerOptions{Timeout: 10 * time.Millisecond, FailureThreshold: 1, OpenDuration: time.Minute})
+		mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), context.DeadlineExceeded).Run(func(args mock.Arguments) {
+			deadline, ok := args.Get(0).(context.Context).Deadline()
+			assert.True(t, ok)
+			assert.WithinDuration(t, time.Now().Add(10*time.Millisecond), deadline, 10*time.Millisecond)
+		})
+
+		_, _, err := storage.IsBlocked(ctx, "key")
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, BreakerOpen, breaker.State())
+	})
+
+	t.Run("should not count calls abandoned by the caller", func(t *testing.T) {
+		breaker, mockStorage, storage, _ := newBreaker(BreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute})
+		mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), context.Canceled)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		storage.IsBlocked(canceled, "key")
+
+		assert.Equal(t, BreakerClosed, breaker.State())
+	})
+
+	t.Run("should only apply the timeout without a threshold", func(t *testing.T) {
+		breaker, mockStorage, storage, _ := newBreaker(BreakerOptions{Timeout: time.Second})
+		mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), errStorage)
+
+		for i := 0; i < 10; i++ {
+			_, _, err := storage.IsBlocked(ctx, "key")
+			assert.ErrorIs(t, err, errStorage)
+		}
+
+		assert.Equal(t, BreakerClosed, breaker.State())
+	})
+
+	t.Run("should pass leases through", func(t *testing.T) {
+		breaker, mockStorage, storage, _ := newBreaker(BreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute})
+		mockStorage.On("AcquireLease", mock.Anything, "key", "id", 1, time.Minute).Return(false, 0, errStorage).Once()
+
+		leases := storage.(ConcurrencyStorage)
+		_, _, err := leases.AcquireLease(ctx, "key", "id", 1, time.Minute)
+		assert.ErrorIs(t, err, errStorage)
+		assert.Equal(t, BreakerOpen, breaker.State())
+
+		_, _, err = leases.AcquireLease(ctx, "key", "id", 1, time.Minute)
+		assert.ErrorIs(t, err, ErrBreakerOpen)
+		mockStorage.AssertExpectations(t)
+
+		unsupported := NewCircuitBreaker(BreakerOptions{}, logger).Storage(struct{ Storage }{mockStorage})
+		_, _, err = unsupported.(ConcurrencyStorage).AcquireLease(ctx, "key", "id", 1, time.Minute)
+		assert.ErrorIs(t, err, errors.ErrUnsupported)
+	})
+
+	t.Run("should pass quotas through", func(t *testing.T) {
+		breaker, mockStorage, storage, _ := newBreaker(BreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute})
+		mockStorage.On("IncrQuota", mock.Anything, "key", "2026-10-01", 31*24*time.Hour, 10, 1).Return(false, 0, errStorage).Once()
+
+		quotas := storage.(QuotaStorage)
+		_, _, err := quotas.IncrQuota(ctx, "key", "2026-10-01", 31*24*time.Hour, 10, 1)
+		assert.ErrorIs(t, err, errStorage)
+		assert.Equal(t, BreakerOpen, breaker.State())
+
+		_, err = quotas.QuotaUsage(ctx, "key", "2026-10-01")
+		assert.ErrorIs(t, err, ErrBreakerOpen)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should pass key administration through", func(t *testing.T) {
+		memory := NewMemoryStorage(MemoryOptions{})
+		defer memory.Close()
+
+		storage := NewCircuitBreaker(BreakerOptions{}, logger).Storage(memory)
+		require.NoError(t, storage.BlockRequest(ctx, "key", time.Minute))
+
+		admin := storage.(KeyAdmin)
+		state, err := admin.Inspect(ctx, "key")
+		require.NoError(t, err)
+		assert.True(t, state.Blocked)
+
+		require.NoError(t, admin.Unblock(ctx, "key"))
+		blocked, _, err := memory.IsBlocked(ctx, "key")
+		require.NoError(t, err)
+		assert.False(t, blocked)
+
+		unsupported := NewCircuitBreaker(BreakerOptions{}, logger).Storage(struct{ Storage }{new(mocks.StorageMock)})
+		assert.ErrorIs(t, unsupported.(KeyAdmin).Reset(ctx, "key"), errors.ErrUnsupported)
+	})
+
+	t.Run("should keep atomic storages atomic", func(t *testing.T) {
+		breaker := NewCircuitBreaker(BreakerOptions{FailureThreshold: 1}, logger)
+		memory := NewMemoryStorage(MemoryOptions{})
+		defer memory.Close()
+
+		_, ok := breaker.Storage(memory).(AtomicStorage)
+
+		assert.True(t, ok)
+	})
+}
+
+func TestCircuitBreaker_Probe(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, nil)
+
+	breaker := NewCircuitBreaker(BreakerOptions{
+		FailureThreshold: 1,
+		OpenDuration:     time.Hour,
+		ProbeInterval:    5 * time.Millisecond,
+		Metrics:          metrics,
+	}, logger)
+
+	mockStorage := new(mocks.StorageMock)
+	mockStorage.On("IsBlocked", mock.Anything, "key").Return(false, time.Duration(0), errors.New("connection refused"))
+	breaker.Storage(mockStorage).IsBlocked(context.Background(), "key")
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.breakerState.WithLabelValues("open")))
+
+	var healthy atomic.Bool
+	pinger := pingFunc(func(ctx context.Context) error {
+		if !healthy.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go breaker.Probe(ctx, pinger)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	healthy.Store(true)
+
+	assert.Eventually(t, func() bool { return breaker.State() == BreakerHalfOpen }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.breakerState.WithLabelValues("half_open")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.breakerState.WithLabelValues("open")))
+}
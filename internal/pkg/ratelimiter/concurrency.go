@@ -0,0 +1,204 @@
+package ratelimiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultLeaseDuration is the time a slot stays held without being renewed,
+// after which the slot of a crashed instance is freed.
+const DefaultLeaseDuration = 30 * time.Second
+
+// ConcurrencyStorage is implemented by storages able to hold leases on the
+// slots of a key, limiting its requests in flight across instances. Leases
+// expire after their duration unless renewed, so the slots of an instance
+// that crashed are eventually freed.
+type ConcurrencyStorage interface {
+	// AcquireLease adds the lease id to key when it holds fewer than limit
+	// unexpired leases, reporting whether it did and the leases key holds.
+	AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, int, error)
+	// RenewLease extends the lease id of key, if it is still held.
+	RenewLease(ctx context.Context, key, id string, lease time.Duration) error
+	ReleaseLease(ctx context.Context, key, id string) error
+}
+
+// concurrencyStorageOf returns storage as a ConcurrencyStorage, or one failing
+// with errors.ErrUnsupported when storage cannot hold leases, for decorators
+// to pass leases through.
+func concurrencyStorageOf(storage Storage) ConcurrencyStorage {
+	if leases, ok := storage.(ConcurrencyStorage); ok {
+		return leases
+	}
+
+	return unsupportedStorage{}
+}
+
+// ConcurrencyOptions are the limits of a ConcurrencyLimiter. Leases are
+// renewed every half LeaseDuration while their request is in flight.
+// FailureMode tells how requests are decided while the storage fails: open
+// and fallback admit them without a slot, closed rejects them.
+type ConcurrencyOptions struct {
+	MaxInFlightIP    int
+	MaxInFlightToken int
+	LeaseDuration    time.Duration // defaults to DefaultLeaseDuration
+	FailureMode      FailureMode
+	Metrics          *Metrics
+}
+
+// ConcurrencyResponse is the decision on a request limited by the number of
+// requests of its key in flight, including itself when Allowed. Degraded
+// tells a decision taken by the failure mode because the storage failed.
+type ConcurrencyResponse struct {
+	Allowed  bool   `json:"allowed"`
+	Degraded bool   `json:"degraded,omitempty"`
+	Policy   string `json:"policy,omitempty"`
+	Limit    int    `json:"limit"`
+	InFlight int    `json:"in_flight"`
+}
+
+// ConcurrencyLimiter limits the requests each key has in flight at once,
+// unlike RateLimiter, which limits the requests started per window.
+type ConcurrencyLimiter struct {
+	storage ConcurrencyStorage
+	opts    ConcurrencyOptions
+	logger  *slog.Logger
+}
+
+func NewConcurrencyLimiter(storage ConcurrencyStorage, opts ConcurrencyOptions, logger *slog.Logger) *ConcurrencyLimiter {
+	if opts.LeaseDuration <= 0 {
+		opts.LeaseDuration = DefaultLeaseDuration
+	}
+
+	return &ConcurrencyLimiter{
+		storage: storage,
+		opts:    opts,
+		logger:  logger,
+	}
+}
+
+// Acquire takes a slot of rk for a request. The returned lease must be
+// released once the request is done, and is nil when no slot was taken.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, rk RateLimitKey) (*Lease, ConcurrencyResponse, error) {
+	resp := ConcurrencyResponse{Policy: rk.Policy(), Limit: cl.opts.MaxInFlightIP}
+	if rk.KeyType == Token {
+		resp.Limit = cl.opts.MaxInFlightToken
+	}
+
+	key := rk.Key
+	if rk.Scope != "" {
+		key = rk.Scope + ":" + key
+	}
+
+	id := leaseID()
+	allowed, inFlight, err := cl.storage.AcquireLease(ctx, key, id, resp.Limit, cl.opts.LeaseDuration)
+	if err != nil {
+		if cl.opts.FailureMode == "" {
+			return nil, ConcurrencyResponse{}, err
+		}
+
+		cl.logger.Warn("Concurrency limiter storage failed",
+			slog.String("policy", rk.Policy()),
+			slog.String("failure_mode", string(cl.opts.FailureMode)),
+			slog.String("error", err.Error()),
+		)
+		cl.opts.Metrics.observeFailure(rk, cl.opts.FailureMode)
+
+		resp.Allowed, resp.Degraded = cl.opts.FailureMode != FailClosed, true
+		return nil, resp, nil
+	}
+
+	resp.Allowed, resp.InFlight = allowed, inFlight
+	if !allowed {
+		cl.opts.Metrics.observeConcurrencyRejection(rk)
+		return nil, resp, nil
+	}
+
+	return cl.newLease(ctx, key, id), resp, nil
+}
+
+// Lease is a slot held by a request in flight.
+type Lease struct {
+	limiter *ConcurrencyLimiter
+	ctx     context.Context
+	key     string
+	id      string
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func (cl *ConcurrencyLimiter) newLease(ctx context.Context, key, id string) *Lease {
+	l := &Lease{
+		limiter: cl,
+		// The lease outlives the request context, which is canceled when
+		// the client disconnects, until it is released.
+		ctx:  context.WithoutCancel(ctx),
+		key:  key,
+		id:   id,
+		stop: make(chan struct{}),
+	}
+	go l.renew()
+
+	return l
+}
+
+// renew extends the lease every half lease duration until it is released.
+func (l *Lease) renew() {
+	ticker := time.NewTicker(l.limiter.opts.LeaseDuration / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := l.withTimeout()
+			err := l.limiter.storage.RenewLease(ctx, l.key, l.id, l.limiter.opts.LeaseDuration)
+			cancel()
+			if err != nil {
+				l.limiter.logger.Warn("Error renewing concurrency lease",
+					slog.String("key", l.key),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+	}
+}
+
+// Release frees the slot of the lease. It is safe to call more than once and
+// on a nil lease.
+func (l *Lease) Release() {
+	if l == nil {
+		return
+	}
+
+	l.once.Do(func() {
+		close(l.stop)
+
+		ctx, cancel := l.withTimeout()
+		defer cancel()
+
+		if err := l.limiter.storage.ReleaseLease(ctx, l.key, l.id); err != nil {
+			l.limiter.logger.Warn("Error releasing concurrency lease, it will expire",
+				slog.String("key", l.key),
+				slog.String("error", err.Error()),
+			)
+		}
+	})
+}
+
+// withTimeout bounds a call on the lease by half its duration, the interval
+// between renewals, after which the call is no longer useful.
+func (l *Lease) withTimeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(l.ctx, l.limiter.opts.LeaseDuration/2)
+}
+
+func leaseID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,118 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter_Acquire(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctx := context.Background()
+	ip := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "export"}
+	token := RateLimitKey{Key: "abc123", KeyType: Token, IP: "127.0.0.1", Scope: "export"}
+
+	t.Run("should limit the requests in flight of each key", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{})
+		defer storage.Close()
+
+		limiter := NewConcurrencyLimiter(storage, ConcurrencyOptions{MaxInFlightIP: 2, MaxInFlightToken: 3}, logger)
+
+		var leases []*Lease
+		for i := 1; i <= 2; i++ {
+			lease, resp, err := limiter.Acquire(ctx, ip)
+			require.NoError(t, err)
+			assert.True(t, resp.Allowed)
+			assert.Equal(t, i, resp.InFlight)
+			leases = append(leases, lease)
+		}
+
+		lease, resp, err := limiter.Acquire(ctx, ip)
+		require.NoError(t, err)
+		assert.Nil(t, lease)
+		assert.Equal(t, ConcurrencyResponse{Policy: "export", Limit: 2, InFlight: 2}, resp)
+
+		_, resp, err = limiter.Acquire(ctx, token)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 3, resp.Limit)
+
+		leases[0].Release()
+		leases[0].Release()
+
+		_, resp, err = limiter.Acquire(ctx, ip)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 2, resp.InFlight)
+	})
+
+	t.Run("should renew the leases of requests in flight", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{})
+		defer storage.Close()
+
+		limiter := NewConcurrencyLimiter(storage, ConcurrencyOptions{MaxInFlightIP: 1, LeaseDuration: 100 * time.Millisecond}, logger)
+
+		lease, resp, err := limiter.Acquire(ctx, ip)
+		require.NoError(t, err)
+		require.True(t, resp.Allowed)
+
+		time.Sleep(250 * time.Millisecond)
+
+		_, resp, err = limiter.Acquire(ctx, ip)
+		require.NoError(t, err)
+		assert.False(t, resp.Allowed, "a renewed lease must keep its slot")
+
+		lease.Release()
+
+		_, resp, err = limiter.Acquire(ctx, ip)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+	})
+
+	t.Run("should release leases after the request context is canceled, within a timeout", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		limiter := NewConcurrencyLimiter(mockStorage, ConcurrencyOptions{MaxInFlightIP: 1}, logger)
+
+		reqCtx, cancel := context.WithCancel(ctx)
+		mockStorage.On("AcquireLease", reqCtx, "export:127.0.0.1", mock.Anything, 1, DefaultLeaseDuration).Return(true, 1, nil)
+		mockStorage.On("ReleaseLease", mock.MatchedBy(func(ctx context.Context) bool {
+			deadline, ok := ctx.Deadline()
+			return ctx.Err() == nil && ok && time.Until(deadline) <= DefaultLeaseDuration/2
+		}), "export:127.0.0.1", mock.Anything).Return(nil).Once()
+
+		lease, _, err := limiter.Acquire(reqCtx, ip)
+		require.NoError(t, err)
+
+		cancel()
+		lease.Release()
+
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should follow the failure mode when the storage fails", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		mockStorage.On("AcquireLease", ctx, "export:127.0.0.1", mock.Anything, 1, DefaultLeaseDuration).Return(false, 0, errors.New("connection refused"))
+
+		_, _, err := NewConcurrencyLimiter(mockStorage, ConcurrencyOptions{MaxInFlightIP: 1}, logger).Acquire(ctx, ip)
+		assert.Error(t, err)
+
+		lease, resp, err := NewConcurrencyLimiter(mockStorage, ConcurrencyOptions{MaxInFlightIP: 1, FailureMode: FailOpen}, logger).Acquire(ctx, ip)
+		assert.NoError(t, err)
+		assert.Nil(t, lease)
+		assert.True(t, resp.Allowed)
+		assert.True(t, resp.Degraded)
+
+		_, resp, err = NewConcurrencyLimiter(mockStorage, ConcurrencyOptions{MaxInFlightIP: 1, FailureMode: FailClosed}, logger).Acquire(ctx, ip)
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.True(t, resp.Degraded)
+	})
+}
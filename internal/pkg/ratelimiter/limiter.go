@@ -2,7 +2,10 @@ package ratelimiter
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
 	"time"
 )
 
@@ -13,17 +16,126 @@ const (
 	API
 )
 
+func (k KeyType) String() string {
+	if k == Token {
+		return "token"
+	}
+
+	return "ip"
+}
+
+type Algorithm string
+
+const (
+	FixedWindow    Algorithm = "fixed_window"
+	TokenBucket    Algorithm = "token_bucket"
+	SlidingLog     Algorithm = "sliding_log"
+	SlidingCounter Algorithm = "sliding_counter"
+	GCRA           Algorithm = "gcra"
+)
+
+type UnknownTokenPolicy string
+
+const (
+	UnknownTokenFallback UnknownTokenPolicy = "fallback"
+	UnknownTokenReject   UnknownTokenPolicy = "reject"
+)
+
+// FailureMode tells how requests are decided when the storage or the token
+// registry fails. Without one, the error is returned.
+type FailureMode string
+
+const (
+	FailOpen     FailureMode = "open"
+	FailClosed   FailureMode = "closed"
+	FailFallback FailureMode = "fallback"
+)
+
+var ErrUnknownToken = errors.New("ratelimiter: unknown or expired token")
+
+// RateLimitKey identifies the client being limited. IP is used instead of a
+// token that is not found in the token registry. A non-empty Scope, such as
+// the name of a policy, gives the client separate counters in that scope, and
+// a non-empty Route, such as "GET /users/{id}", separate counters per route
+// within the scope. Route only applies to the rate limit counters.
 type RateLimitKey struct {
 	Key     string
 	KeyType KeyType
+	IP      string
+	Scope   string
+	Route   string
+}
+
+// DefaultPolicy names the policy of keys that are not scoped to one.
+const DefaultPolicy = "default"
+
+// Policy returns the scope of rk, or DefaultPolicy.
+func (rk RateLimitKey) Policy() string {
+	if rk.Scope == "" {
+		return DefaultPolicy
+	}
+
+	return rk.Scope
 }
 
+// scoped returns rk with its key prefixed with its scope and its route, if
+// any, as the rate limit counters are kept.
+func (rk RateLimitKey) scoped() RateLimitKey {
+	if rk.Route != "" {
+		rk.Key = rk.Route + ":" + rk.Key
+	}
+	if rk.Scope != "" {
+		rk.Key = rk.Scope + ":" + rk.Key
+	}
+
+	return rk
+}
+
+const (
+	DecisionAllowed = "allowed"
+	DecisionDenied  = "denied"
+	DecisionBlocked = "blocked"
+)
+
+// RateLimiterResponse is the decision on a request. Blocked tells a request
+// rejected because its key was already blocked from one that went over limit,
+// Degraded a decision taken by FailureMode because the storage failed, and
+// Shadow a decision of a shadow limiter, which must not be enforced. Only
+// requests decided by FailFallback are counted, by the fallback storage.
+// Policy and Window describe the limit the request was counted against, Cost
+// the quota the request used or would have used, and PenaltyLevel the
+// offenses that escalated the block of the key, if any. Key is the client the
+// request was counted as, which is its IP when its token is unknown, for the
+// other limits of the request to count the same client.
 type RateLimiterResponse struct {
-	Allowed      bool      `json:"allowed"`
-	ResetTime    time.Time `json:"reset_time,omitempty"`
-	RetryAfter   time.Time `json:"retry_after,omitempty"`
-	RequestsLeft int       `json:"requests_left"`
-	Limit        int       `json:"limit"`
+	Allowed      bool          `json:"allowed"`
+	Policy       string        `json:"policy,omitempty"`
+	Window       time.Duration `json:"window,omitempty"`
+	Blocked      bool          `json:"blocked,omitempty"`
+	Degraded     bool          `json:"degraded,omitempty"`
+	FailureMode  FailureMode   `json:"failure_mode,omitempty"`
+	Shadow       bool          `json:"shadow,omitempty"`
+	ResetTime    time.Time     `json:"reset_time,omitempty"`
+	RetryAfter   time.Time     `json:"retry_after,omitempty"`
+	RequestsLeft int           `json:"requests_left"`
+	Limit        int           `json:"limit"`
+	TokensLeft   float64       `json:"tokens_left,omitempty"`
+	NextTokenAt  time.Time     `json:"next_token_at,omitempty"`
+	Cost         int           `json:"cost,omitempty"`
+	PenaltyLevel int           `json:"penalty_level,omitempty"`
+	Key          RateLimitKey  `json:"-"`
+}
+
+// Decision returns DecisionAllowed, DecisionDenied or DecisionBlocked.
+func (r RateLimiterResponse) Decision() string {
+	switch {
+	case r.Blocked:
+		return DecisionBlocked
+	case !r.Allowed:
+		return DecisionDenied
+	default:
+		return DecisionAllowed
+	}
 }
 
 type Options struct {
@@ -31,52 +143,274 @@ type Options struct {
 	MaxRequestToken int
 	WindowDuration  time.Duration
 	BlockDuration   time.Duration
+	Algorithm       Algorithm
+	RefillRate      float64 // tokens per second, defaults to limit / WindowDuration
+	BucketCapacity  int     // defaults to the limit of the key type
+	TokenRegistry   TokenRegistry
+	UnknownTokens   UnknownTokenPolicy
+	Metrics         *Metrics
+	Tracing         *Tracing
+	FailureMode     FailureMode
+	FallbackStorage Storage // limits the requests in FailFallback mode while the storage fails
+	Shadow          bool    // counts and reports the requests it would deny, without denying them
+
+	// BlockMultiplier escalates the block of a key that keeps going over
+	// limit: the block of each offense is the block of the previous one
+	// multiplied by it, up to MaxBlockDuration, and offenses are forgotten
+	// once the key goes OffenseLookback without one. Blocks are not escalated
+	// when it is not above 1, nor by the GCRA algorithm.
+	BlockMultiplier  float64
+	MaxBlockDuration time.Duration // defaults to OffenseLookback
+	OffenseLookback  time.Duration // defaults to DefaultOffenseLookback
+
+	// Windows limits every key in several fixed windows at once, such as 10
+	// per second and 500 per minute, instead of MaxRequestIP and
+	// MaxRequestToken per WindowDuration and whatever the Algorithm. A request
+	// is counted in all windows only when it fits in each, and the key is
+	// blocked when it requests more after any of them ran out. Windows are
+	// aligned to the Unix epoch, so a day window resets at midnight UTC.
+	// Tokens with their own limits in the token registry keep them.
+	Windows []Window
+}
+
+// Window is a limit of requests per fixed window of Duration.
+type Window struct {
+	Limit    int
+	Duration time.Duration
+}
+
+// DefaultOffenseLookback is the time a key must go without going over limit
+// for its escalated blocks to start over.
+const DefaultOffenseLookback = 24 * time.Hour
+
+// limits are the effective limits of a single key, resolved from Options and
+// the token registry, and the cost of the request checked against them.
+type limits struct {
+	max      int
+	window   time.Duration
+	block    time.Duration
+	capacity int
+	rate     float64
+	cost     int
+	windows  []Window
 }
 
 type RateLimiter struct {
-	storage Storage
-	opts    Options
-	logger  *slog.Logger
+	storage  Storage
+	opts     Options
+	logger   *slog.Logger
+	fallback *RateLimiter
 }
 
 func NewRateLimiter(storage Storage, opts Options, logger *slog.Logger) *RateLimiter {
-	return &RateLimiter{
+	rl := &RateLimiter{
 		storage: storage,
 		opts:    opts,
 		logger:  logger,
 	}
+
+	if opts.FailureMode == FailFallback && opts.FallbackStorage != nil {
+		fallbackOpts := opts
+		fallbackOpts.TokenRegistry = nil
+		fallbackOpts.FailureMode = ""
+		fallbackOpts.FallbackStorage = nil
+		rl.fallback = NewRateLimiter(opts.FallbackStorage, fallbackOpts, logger)
+	}
+
+	return rl
 }
 
 func (rl *RateLimiter) Allow(ctx context.Context, rk RateLimitKey) (RateLimiterResponse, error) {
+	return rl.AllowN(ctx, rk, 1)
+}
+
+// AllowN decides a request that uses up cost units of quota, at least 1. A
+// request whose cost does not fit in the quota left is rejected without using
+// any of it nor blocking the key, which is only blocked when it requests more
+// after running out of quota.
+func (rl *RateLimiter) AllowN(ctx context.Context, rk RateLimitKey, cost int) (resp RateLimiterResponse, err error) {
+	cost = max(cost, 1)
+	ctx, span := rl.opts.Tracing.startAllow(ctx, rk, cost)
+
+	resolved := rk
+	defer func() { rl.opts.Tracing.endAllow(span, resolved, resp, err) }()
+
+	var (
+		client RateLimitKey
+		l      limits
+	)
+	client, l, err = rl.resolve(ctx, rk)
+	if err == nil {
+		resolved = client.scoped()
+		l.cost = cost
+		resp, err = rl.allow(ctx, resolved, l)
+		resp.Policy, resp.Cost, resp.Key = resolved.Policy(), cost, client
+		if resp.Window == 0 {
+			resp.Window = l.window
+		}
+	}
+
+	if err != nil && !errors.Is(err, ErrUnknownToken) && rl.opts.FailureMode != "" {
+		return rl.fail(ctx, rk, cost, err)
+	}
+
+	if err == nil {
+		rl.opts.Metrics.observeDecision(resolved, resp)
+		if rl.opts.Shadow {
+			rl.shadow(resolved, resp)
+			resp.Shadow = true
+		}
+	}
+
+	return resp, err
+}
+
+// Shadow reports whether the limiter runs in shadow mode, evaluating requests
+// without its decisions being enforced.
+func (rl *RateLimiter) Shadow() bool {
+	return rl.opts.Shadow
+}
+
+// shadow reports a request a shadow limiter would have denied.
+func (rl *RateLimiter) shadow(rk RateLimitKey, resp RateLimiterResponse) {
+	if resp.Allowed || resp.Degraded {
+		return
+	}
+
+	rl.logger.Info("Rate limiter would have denied request",
+		slog.String("policy", rk.Policy()),
+		slog.String("key", rk.Key),
+		slog.String("key_type", rk.KeyType.String()),
+		slog.String("decision", resp.Decision()),
+		slog.Int("limit", resp.Limit),
+	)
+	rl.opts.Metrics.observeShadowDenial(rk, resp)
+}
+
+// fail decides a request whose limit could not be checked because of err,
+// according to Options.FailureMode. In FailFallback mode the request is
+// limited by the fallback storage, with the default limits of its key type.
+func (rl *RateLimiter) fail(ctx context.Context, rk RateLimitKey, cost int, err error) (RateLimiterResponse, error) {
+	rl.logger.Warn("Rate limiter storage failed",
+		slog.String("policy", rk.Policy()),
+		slog.String("failure_mode", string(rl.opts.FailureMode)),
+		slog.String("error", err.Error()),
+	)
+	rl.opts.Metrics.observeFailure(rk, rl.opts.FailureMode)
+
+	switch rl.opts.FailureMode {
+	case FailOpen:
+		return RateLimiterResponse{
+			Allowed:     true,
+			Degraded:    true,
+			FailureMode: FailOpen,
+			Limit:       rl.getMaxRequest(rk),
+			Policy:      rk.Policy(),
+			Window:      rl.opts.WindowDuration,
+			Cost:        cost,
+		}, nil
+	case FailClosed:
+		return RateLimiterResponse{
+			Allowed:     false,
+			Degraded:    true,
+			FailureMode: FailClosed,
+			RetryAfter:  time.Now().Add(rl.opts.WindowDuration),
+			Limit:       rl.getMaxRequest(rk),
+			Policy:      rk.Policy(),
+			Window:      rl.opts.WindowDuration,
+			Cost:        cost,
+		}, nil
+	case FailFallback:
+		if rl.fallback != nil {
+			resp, err := rl.fallback.AllowN(ctx, rk, cost)
+			resp.Degraded, resp.FailureMode = true, FailFallback
+			return resp, err
+		}
+	}
+
+	return RateLimiterResponse{}, err
+}
+
+func (rl *RateLimiter) allow(ctx context.Context, rk RateLimitKey, l limits) (RateLimiterResponse, error) {
+	if len(l.windows) > 0 {
+		return rl.allowWindows(ctx, rk, l)
+	}
+
+	switch rl.opts.Algorithm {
+	case FixedWindow, "":
+		if storage, ok := rl.storage.(AtomicStorage); ok {
+			return rl.allowAtomicFixedWindow(ctx, storage, rk, l)
+		}
+	case GCRA:
+		return rl.allowGCRA(ctx, rk, l)
+	}
+
 	blocked, retryAfter, err := rl.storage.IsBlocked(ctx, rk.Key)
 	if err != nil {
 		return RateLimiterResponse{}, err
 	}
 
-	maxRequest := rl.getMaxRequest(rk)
-
 	if blocked {
+		level, err := rl.penaltyLevel(ctx, rk)
+		if err != nil {
+			return RateLimiterResponse{}, err
+		}
+
 		return RateLimiterResponse{
 			Allowed:      false,
+			Blocked:      true,
 			RetryAfter:   time.Now().Add(retryAfter),
 			RequestsLeft: 0,
-			Limit:        maxRequest,
+			Limit:        l.max,
+			PenaltyLevel: level,
 		}, nil
 	}
 
-	count, resetTime, err := rl.storage.IncrRequest(ctx, rk.Key, rl.opts.WindowDuration)
+	switch rl.opts.Algorithm {
+	case FixedWindow, "":
+		return rl.allowFixedWindow(ctx, rk, l)
+	case TokenBucket:
+		return rl.allowTokenBucket(ctx, rk, l)
+	case SlidingLog, SlidingCounter:
+		return rl.allowSlidingWindow(ctx, rk, l)
+	default:
+		return RateLimiterResponse{}, fmt.Errorf("ratelimiter: unknown algorithm %q", rl.opts.Algorithm)
+	}
+}
+
+func (rl *RateLimiter) allowFixedWindow(ctx context.Context, rk RateLimitKey, l limits) (RateLimiterResponse, error) {
+	count, resetTime, err := rl.storage.IncrRequest(ctx, rk.Key, l.window, l.max, l.cost)
 	if err != nil {
 		return RateLimiterResponse{}, err
 	}
 
-	if count > maxRequest {
-		rl.storage.BlockRequest(ctx, rk.Key, rl.opts.BlockDuration)
+	if used := count - l.cost; count > l.max && used < l.max {
+		// The key has quota left, just not enough for this request, which
+		// the storage did not count.
+		return RateLimiterResponse{
+			Allowed:      false,
+			ResetTime:    time.Now().Add(resetTime),
+			RetryAfter:   time.Now().Add(resetTime),
+			RequestsLeft: l.max - used,
+			Limit:        l.max,
+		}, nil
+	}
+
+	if count > l.max {
+		block, level, err := rl.penalty(ctx, rk, l)
+		if err != nil {
+			return RateLimiterResponse{}, err
+		}
+
+		rl.storage.BlockRequest(ctx, rk.Key, block)
 
 		return RateLimiterResponse{
 			Allowed:      false,
 			ResetTime:    time.Now().Add(resetTime),
+			RetryAfter:   time.Now().Add(block),
 			RequestsLeft: 0,
-			Limit:        maxRequest,
+			Limit:        l.max,
+			PenaltyLevel: level,
 		}, nil
 	}
 
@@ -84,11 +418,432 @@ func (rl *RateLimiter) Allow(ctx context.Context, rk RateLimitKey) (RateLimiterR
 		Allowed:      true,
 		ResetTime:    time.Now().Add(resetTime),
 		RetryAfter:   time.Time{},
-		RequestsLeft: maxRequest - count,
-		Limit:        maxRequest,
+		RequestsLeft: l.max - count,
+		Limit:        l.max,
 	}, nil
 }
 
+func (rl *RateLimiter) allowAtomicFixedWindow(ctx context.Context, storage AtomicStorage, rk RateLimitKey, l limits) (RateLimiterResponse, error) {
+	blocked, count, ttl, err := storage.Hit(ctx, rk.Key, l.window, l.max, l.block, l.cost)
+	if err != nil {
+		return RateLimiterResponse{}, err
+	}
+
+	now := time.Now()
+
+	if blocked {
+		level, err := rl.penaltyLevel(ctx, rk)
+		if err != nil {
+			return RateLimiterResponse{}, err
+		}
+
+		return RateLimiterResponse{
+			Allowed:      false,
+			Blocked:      true,
+			RetryAfter:   now.Add(ttl),
+			RequestsLeft: 0,
+			Limit:        l.max,
+			PenaltyLevel: level,
+		}, nil
+	}
+
+	if used := count - l.cost; count > l.max && used < l.max {
+		// Hit did not count a request that does not fit in the quota left.
+		return RateLimiterResponse{
+			Allowed:      false,
+			ResetTime:    now.Add(ttl),
+			RetryAfter:   now.Add(ttl),
+			RequestsLeft: l.max - used,
+			Limit:        l.max,
+		}, nil
+	}
+
+	if count > l.max {
+		resp := RateLimiterResponse{
+			Allowed:      false,
+			ResetTime:    now.Add(ttl),
+			RetryAfter:   now.Add(ttl),
+			RequestsLeft: 0,
+			Limit:        l.max,
+		}
+
+		if l.block > 0 {
+			// Hit already blocked the key for the base duration, which
+			// only has to be extended for repeat offenses.
+			block, level, err := rl.penalty(ctx, rk, l)
+			if err != nil {
+				return RateLimiterResponse{}, err
+			}
+			if block != l.block {
+				if err := rl.storage.BlockRequest(ctx, rk.Key, block); err != nil {
+					return RateLimiterResponse{}, err
+				}
+			}
+			resp.RetryAfter, resp.PenaltyLevel = now.Add(block), level
+		}
+
+		return resp, nil
+	}
+
+	return RateLimiterResponse{
+		Allowed:      true,
+		ResetTime:    now.Add(ttl),
+		RequestsLeft: l.max - count,
+		Limit:        l.max,
+	}, nil
+}
+
+// allowWindows counts the request in every window of l in a single storage
+// call, which checks and sets the block of the key too. The response describes
+// the most restrictive window, or the first one for a key already blocked.
+func (rl *RateLimiter) allowWindows(ctx context.Context, rk RateLimitKey, l limits) (RateLimiterResponse, error) {
+	durations := make([]time.Duration, len(l.windows))
+	maxes := make([]int, len(l.windows))
+	for i, w := range l.windows {
+		durations[i], maxes[i] = w.Duration, w.Limit
+	}
+
+	allowed, counts, resets, blockTTL, err := rl.storage.HitWindows(ctx, rk.Key, durations, maxes, l.block, l.cost)
+	if err != nil {
+		return RateLimiterResponse{}, err
+	}
+
+	now := time.Now()
+
+	if counts == nil {
+		level, err := rl.penaltyLevel(ctx, rk)
+		if err != nil {
+			return RateLimiterResponse{}, err
+		}
+
+		return RateLimiterResponse{
+			Allowed:      false,
+			Blocked:      true,
+			Window:       l.windows[0].Duration,
+			RetryAfter:   now.Add(blockTTL),
+			RequestsLeft: 0,
+			Limit:        l.windows[0].Limit,
+			PenaltyLevel: level,
+		}, nil
+	}
+
+	i := restrictiveWindow(l.windows, counts, resets, allowed, l.cost)
+	resp := RateLimiterResponse{
+		Allowed:      allowed,
+		Window:       l.windows[i].Duration,
+		ResetTime:    now.Add(resets[i]),
+		RequestsLeft: max(l.windows[i].Limit-counts[i], 0),
+		Limit:        l.windows[i].Limit,
+	}
+
+	if allowed {
+		return resp, nil
+	}
+
+	resp.RetryAfter = resp.ResetTime
+	if blockTTL > 0 {
+		// HitWindows already blocked the key for the base duration, which
+		// only has to be extended for repeat offenses.
+		block, level, err := rl.penalty(ctx, rk, l)
+		if err != nil {
+			return RateLimiterResponse{}, err
+		}
+		if block != l.block {
+			if err := rl.storage.BlockRequest(ctx, rk.Key, block); err != nil {
+				return RateLimiterResponse{}, err
+			}
+		}
+		resp.RetryAfter, resp.PenaltyLevel = now.Add(block), level
+	}
+
+	return resp, nil
+}
+
+// restrictiveWindow returns the index of the window limiting a request the
+// most: for a denied request, the last to reset among the windows it does not
+// fit in, and for an allowed one, the window with the fewest requests left or,
+// between equals, the last to reset.
+func restrictiveWindow(windows []Window, counts []int, resets []time.Duration, allowed bool, cost int) int {
+	best := -1
+	for i, w := range windows {
+		if !allowed && counts[i]+cost <= w.Limit {
+			continue
+		}
+
+		if best >= 0 {
+			left, bestLeft := w.Limit-counts[i], windows[best].Limit-counts[best]
+			switch {
+			case allowed && left > bestLeft:
+				continue
+			case allowed && left < bestLeft:
+			case resets[i] <= resets[best]:
+				continue
+			}
+		}
+		best = i
+	}
+
+	return max(best, 0)
+}
+
+func (rl *RateLimiter) allowTokenBucket(ctx context.Context, rk RateLimitKey, l limits) (RateLimiterResponse, error) {
+	capacity, rate := l.capacity, l.rate
+
+	allowed, tokens, err := rl.storage.TakeToken(ctx, rk.Key, rate, capacity, l.cost)
+	if err != nil {
+		return RateLimiterResponse{}, err
+	}
+
+	now := time.Now()
+	nextTokenAt := now
+	if tokens < 1 {
+		nextTokenAt = now.Add(secondsToDuration((1 - tokens) / rate))
+	}
+
+	resp := RateLimiterResponse{
+		Allowed:      allowed,
+		ResetTime:    now.Add(secondsToDuration((float64(capacity) - tokens) / rate)),
+		RequestsLeft: int(tokens),
+		Limit:        capacity,
+		TokensLeft:   tokens,
+		NextTokenAt:  nextTokenAt,
+	}
+
+	if allowed {
+		return resp, nil
+	}
+
+	if tokens >= 1 {
+		resp.RetryAfter = now.Add(secondsToDuration((float64(l.cost) - tokens) / rate))
+		return resp, nil
+	}
+
+	return rl.deny(ctx, rk, l, resp, nextTokenAt)
+}
+
+func (rl *RateLimiter) allowSlidingWindow(ctx context.Context, rk RateLimitKey, l limits) (RateLimiterResponse, error) {
+	var (
+		allowed bool
+		count   int
+		reset   time.Duration
+		err     error
+	)
+
+	if rl.opts.Algorithm == SlidingLog {
+		allowed, count, reset, err = rl.storage.SlidingLog(ctx, rk.Key, l.window, l.max, l.cost)
+	} else {
+		allowed, count, reset, err = rl.storage.SlidingCounter(ctx, rk.Key, l.window, l.max, l.cost)
+	}
+	if err != nil {
+		return RateLimiterResponse{}, err
+	}
+
+	resp := RateLimiterResponse{
+		Allowed:      allowed,
+		ResetTime:    time.Now().Add(reset),
+		RequestsLeft: max(l.max-count, 0),
+		Limit:        l.max,
+	}
+
+	if allowed {
+		return resp, nil
+	}
+
+	if count < l.max {
+		resp.RetryAfter = resp.ResetTime
+		return resp, nil
+	}
+
+	resp.RequestsLeft = 0
+
+	return rl.deny(ctx, rk, l, resp, resp.ResetTime)
+}
+
+// allowGCRA checks the block and the theoretical arrival time of the key in a
+// single storage call, so it does not go through IsBlocked and BlockRequest.
+func (rl *RateLimiter) allowGCRA(ctx context.Context, rk RateLimitKey, l limits) (RateLimiterResponse, error) {
+	if l.max <= 0 {
+		return RateLimiterResponse{Allowed: false, RetryAfter: time.Now().Add(l.window), Limit: l.max}, nil
+	}
+
+	emissionInterval := l.window / time.Duration(l.max)
+
+	allowed, remaining, retryAfter, resetAfter, err := rl.storage.GCRA(ctx, rk.Key, emissionInterval, l.max, l.block, l.cost)
+	if err != nil {
+		return RateLimiterResponse{}, err
+	}
+
+	now := time.Now()
+
+	if remaining < 0 {
+		level, err := rl.penaltyLevel(ctx, rk)
+		if err != nil {
+			return RateLimiterResponse{}, err
+		}
+
+		return RateLimiterResponse{
+			Allowed:      false,
+			Blocked:      true,
+			RetryAfter:   now.Add(retryAfter),
+			RequestsLeft: 0,
+			Limit:        l.max,
+			PenaltyLevel: level,
+		}, nil
+	}
+
+	resp := RateLimiterResponse{
+		Allowed:      allowed,
+		ResetTime:    now.Add(resetAfter),
+		RequestsLeft: remaining,
+		Limit:        l.max,
+	}
+
+	if !allowed {
+		resp.RetryAfter = now.Add(retryAfter)
+	}
+
+	return resp, nil
+}
+
+// deny finalizes a rejected response. The key is blocked when a block
+// duration is configured, otherwise the client may retry at retryAfter.
+func (rl *RateLimiter) deny(ctx context.Context, rk RateLimitKey, l limits, resp RateLimiterResponse, retryAfter time.Time) (RateLimiterResponse, error) {
+	resp.RetryAfter = retryAfter
+
+	if l.block > 0 {
+		block, level, err := rl.penalty(ctx, rk, l)
+		if err != nil {
+			return RateLimiterResponse{}, err
+		}
+		if err := rl.storage.BlockRequest(ctx, rk.Key, block); err != nil {
+			return RateLimiterResponse{}, err
+		}
+		resp.RetryAfter, resp.PenaltyLevel = time.Now().Add(block), level
+	}
+
+	return resp, nil
+}
+
+// escalates reports whether repeat offenses get longer blocks.
+func (rl *RateLimiter) escalates() bool {
+	return rl.opts.BlockMultiplier > 1
+}
+
+// penalty records an offense of rk when blocks escalate, and returns the
+// block for it with the offenses of rk. Without escalation, the block is the
+// base block of l.
+func (rl *RateLimiter) penalty(ctx context.Context, rk RateLimitKey, l limits) (time.Duration, int, error) {
+	if !rl.escalates() || l.block <= 0 {
+		return l.block, 0, nil
+	}
+
+	offenses, err := rl.storage.RecordOffense(ctx, rk.Key, rl.offenseLookback())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return rl.escalate(l.block, offenses), offenses, nil
+}
+
+// penaltyLevel returns the offenses of a blocked key when blocks escalate.
+func (rl *RateLimiter) penaltyLevel(ctx context.Context, rk RateLimitKey) (int, error) {
+	if !rl.escalates() {
+		return 0, nil
+	}
+
+	return rl.storage.Offenses(ctx, rk.Key)
+}
+
+// escalate returns block multiplied by BlockMultiplier once per offense after
+// the first, up to MaxBlockDuration.
+func (rl *RateLimiter) escalate(block time.Duration, offenses int) time.Duration {
+	ceiling := rl.opts.MaxBlockDuration
+	if ceiling <= 0 {
+		ceiling = rl.offenseLookback()
+	}
+
+	escalated := float64(block) * math.Pow(rl.opts.BlockMultiplier, float64(offenses-1))
+	if escalated >= float64(ceiling) {
+		return max(ceiling, block)
+	}
+
+	return time.Duration(escalated)
+}
+
+func (rl *RateLimiter) offenseLookback() time.Duration {
+	if rl.opts.OffenseLookback <= 0 {
+		return DefaultOffenseLookback
+	}
+
+	return rl.opts.OffenseLookback
+}
+
+// Resolve returns the client rk is limited as, without counting a request:
+// rk itself, or its IP when its token is unknown and limited by IP. It fails
+// with ErrUnknownToken when unknown tokens are rejected.
+func (rl *RateLimiter) Resolve(ctx context.Context, rk RateLimitKey) (RateLimitKey, error) {
+	client, _, err := rl.resolve(ctx, rk)
+	return client, err
+}
+
+// resolve returns the client to limit and its limits. Tokens registered in the
+// token registry get their own limits, and tokens that are unknown or expired
+// are either rejected or limited by IP, depending on Options.UnknownTokens.
+func (rl *RateLimiter) resolve(ctx context.Context, rk RateLimitKey) (RateLimitKey, limits, error) {
+	l := limits{
+		max:    rl.getMaxRequest(rk),
+		window: rl.opts.WindowDuration,
+		block:  rl.opts.BlockDuration,
+	}
+	custom := false
+
+	if rk.KeyType == Token && rl.opts.TokenRegistry != nil {
+		tokenLimit, found, err := rl.opts.TokenRegistry.Lookup(ctx, rk.Key)
+		if err != nil {
+			return rk, limits{}, err
+		}
+
+		switch {
+		case found && !tokenLimit.Expired(time.Now()):
+			custom = true
+			if tokenLimit.Limit > 0 {
+				l.max = tokenLimit.Limit
+			}
+			if tokenLimit.Window > 0 {
+				l.window = tokenLimit.Window
+			}
+			if tokenLimit.BlockDuration > 0 {
+				l.block = tokenLimit.BlockDuration
+			}
+		case rl.opts.UnknownTokens == UnknownTokenReject:
+			return rk, limits{}, ErrUnknownToken
+		default:
+			rl.logger.Info("Unknown token, limiting by IP",
+				slog.String("ip", rk.IP),
+				slog.Bool("expired", found),
+			)
+			rk = RateLimitKey{Key: rk.IP, KeyType: API, IP: rk.IP, Scope: rk.Scope, Route: rk.Route}
+			l.max = rl.opts.MaxRequestIP
+		}
+	}
+
+	if !custom {
+		l.windows = rl.opts.Windows
+	}
+
+	l.capacity = rl.opts.BucketCapacity
+	if custom || l.capacity <= 0 {
+		l.capacity = l.max
+	}
+
+	l.rate = rl.opts.RefillRate
+	if custom || l.rate <= 0 {
+		l.rate = float64(l.max) / l.window.Seconds()
+	}
+
+	return rk, l, nil
+}
+
 func (rl *RateLimiter) getMaxRequest(rk RateLimitKey) int {
 	if rk.KeyType == Token {
 		return rl.opts.MaxRequestToken
@@ -96,3 +851,7 @@ func (rl *RateLimiter) getMaxRequest(rk RateLimitKey) int {
 
 	return rl.opts.MaxRequestIP
 }
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
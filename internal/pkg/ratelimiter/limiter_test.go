@@ -1,16 +1,19 @@
 package ratelimiter
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"log/slog"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRateLimiter_Allow(t *testing.T) {
@@ -33,7 +36,7 @@ func TestRateLimiter_Allow(t *testing.T) {
 		rk := RateLimitKey{Key: "test-key", KeyType: Token}
 
 		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
-		mockStorage.On("IncrRequest", ctx, rk.Key, opts.WindowDuration).Return(1, time.Minute, nil)
+		mockStorage.On("IncrRequest", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(1, time.Minute, nil)
 
 		resp, err := rateLimiter.Allow(ctx, rk)
 
@@ -68,7 +71,7 @@ func TestRateLimiter_Allow(t *testing.T) {
 		rk := RateLimitKey{Key: "test-key", KeyType: Token}
 
 		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
-		mockStorage.On("IncrRequest", ctx, rk.Key, opts.WindowDuration).Return(11, time.Minute, nil)
+		mockStorage.On("IncrRequest", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(11, time.Minute, nil)
 		mockStorage.On("BlockRequest", ctx, rk.Key, opts.BlockDuration).Return(nil)
 
 		resp, err := rateLimiter.Allow(ctx, rk)
@@ -102,7 +105,7 @@ func TestRateLimiter_Allow(t *testing.T) {
 		rk := RateLimitKey{Key: "test-key", KeyType: Token}
 
 		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
-		mockStorage.On("IncrRequest", ctx, rk.Key, opts.WindowDuration).Return(0, time.Duration(0), errors.New("storage error"))
+		mockStorage.On("IncrRequest", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(0, time.Duration(0), errors.New("storage error"))
 
 		resp, err := rateLimiter.Allow(ctx, rk)
 
@@ -118,7 +121,7 @@ func TestRateLimiter_Allow(t *testing.T) {
 		rk := RateLimitKey{Key: "test-key", KeyType: Token}
 
 		mockStorage.On("IsBlocked", mock.Anything, rk.Key).Return(false, time.Duration(0), nil)
-		mockStorage.On("IncrRequest", mock.Anything, rk.Key, opts.WindowDuration).Return(1, time.Minute, nil).Times(10)
+		mockStorage.On("IncrRequest", mock.Anything, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(1, time.Minute, nil).Times(10)
 
 		concurrentRequests := 10
 		results := make(chan RateLimiterResponse, concurrentRequests)
@@ -145,3 +148,973 @@ func TestRateLimiter_Allow(t *testing.T) {
 		mockStorage.AssertExpectations(t)
 	})
 }
+
+func TestRateLimiter_AllowTokenBucket(t *testing.T) {
+	mockStorage := new(mocks.StorageMock)
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	opts := Options{
+		MaxRequestIP:    5,
+		MaxRequestToken: 10,
+		WindowDuration:  time.Second,
+		BlockDuration:   0,
+		Algorithm:       TokenBucket,
+		RefillRate:      2,
+		BucketCapacity:  4,
+	}
+	rateLimiter := NewRateLimiter(mockStorage, opts, logger.NewLogger())
+
+	t.Run("should allow request when a token is available", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("TakeToken", ctx, rk.Key, opts.RefillRate, opts.BucketCapacity, 1).Return(true, 2.5, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 2, resp.RequestsLeft)
+		assert.Equal(t, 2.5, resp.TokensLeft)
+		assert.Equal(t, opts.BucketCapacity, resp.Limit)
+		assert.WithinDuration(t, time.Now(), resp.NextTokenAt, 10*time.Millisecond)
+		assert.WithinDuration(t, time.Now().Add(750*time.Millisecond), resp.ResetTime, 10*time.Millisecond)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should deny request and report next token when bucket is empty", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("TakeToken", ctx, rk.Key, opts.RefillRate, opts.BucketCapacity, 1).Return(false, 0.5, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Equal(t, 0, resp.RequestsLeft)
+		assert.Equal(t, 0.5, resp.TokensLeft)
+		assert.WithinDuration(t, time.Now().Add(250*time.Millisecond), resp.NextTokenAt, 10*time.Millisecond)
+		assert.Equal(t, resp.NextTokenAt, resp.RetryAfter)
+		mockStorage.AssertNotCalled(t, "BlockRequest", mock.Anything, mock.Anything, mock.Anything)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should block key when bucket is empty and block duration is set", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+		blockOpts := opts
+		blockOpts.BlockDuration = time.Minute
+		limiter := NewRateLimiter(mockStorage, blockOpts, logger.NewLogger())
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("TakeToken", ctx, rk.Key, opts.RefillRate, opts.BucketCapacity, 1).Return(false, 0.0, nil)
+		mockStorage.On("BlockRequest", ctx, rk.Key, time.Minute).Return(nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), resp.RetryAfter, 10*time.Millisecond)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should derive rate and capacity from the key limit", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "127.0.0.1", KeyType: API}
+		limiter := NewRateLimiter(mockStorage, Options{
+			MaxRequestIP:   5,
+			WindowDuration: time.Second,
+			Algorithm:      TokenBucket,
+		}, logger.NewLogger())
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("TakeToken", ctx, rk.Key, 5.0, 5, 1).Return(true, 4.0, nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 5, resp.Limit)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should return error when TakeToken fails", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("TakeToken", ctx, rk.Key, opts.RefillRate, opts.BucketCapacity, 1).Return(false, 0.0, errors.New("storage error"))
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.Error(t, err)
+		assert.False(t, resp.Allowed)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestRateLimiter_AllowSlidingWindow(t *testing.T) {
+	mockStorage := new(mocks.StorageMock)
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	opts := Options{
+		MaxRequestIP:    5,
+		MaxRequestToken: 10,
+		WindowDuration:  time.Minute,
+		Algorithm:       SlidingLog,
+	}
+	slidingLog := NewRateLimiter(mockStorage, opts, logger.NewLogger())
+
+	counterOpts := opts
+	counterOpts.Algorithm = SlidingCounter
+	slidingCounter := NewRateLimiter(mockStorage, counterOpts, logger.NewLogger())
+
+	t.Run("should allow request within the sliding log", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("SlidingLog", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(true, 4, 30*time.Second, nil)
+
+		resp, err := slidingLog.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 6, resp.RequestsLeft)
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), resp.ResetTime, 10*time.Millisecond)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should deny request when the sliding log is full", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "127.0.0.1", KeyType: API}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("SlidingLog", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestIP, 1).Return(false, 5, 2*time.Second, nil)
+
+		resp, err := slidingLog.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Equal(t, 0, resp.RequestsLeft)
+		assert.Equal(t, resp.ResetTime, resp.RetryAfter)
+		mockStorage.AssertNotCalled(t, "BlockRequest", mock.Anything, mock.Anything, mock.Anything)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should allow request within the sliding counter", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("SlidingCounter", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(true, 7, 10*time.Second, nil)
+
+		resp, err := slidingCounter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 3, resp.RequestsLeft)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should block key when the sliding counter is exceeded", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+		blockOpts := counterOpts
+		blockOpts.BlockDuration = time.Minute
+		limiter := NewRateLimiter(mockStorage, blockOpts, logger.NewLogger())
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("SlidingCounter", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(false, 10, time.Second, nil)
+		mockStorage.On("BlockRequest", ctx, rk.Key, time.Minute).Return(nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), resp.RetryAfter, 10*time.Millisecond)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should return error when SlidingCounter fails", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("SlidingCounter", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, 1).Return(false, 0, time.Duration(0), errors.New("storage error"))
+
+		resp, err := slidingCounter.Allow(ctx, rk)
+
+		assert.Error(t, err)
+		assert.False(t, resp.Allowed)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestRateLimiter_AllowGCRA(t *testing.T) {
+	mockStorage := new(mocks.StorageMock)
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	opts := Options{
+		MaxRequestIP:    5,
+		MaxRequestToken: 10,
+		WindowDuration:  time.Second,
+		BlockDuration:   time.Minute,
+		Algorithm:       GCRA,
+	}
+	rateLimiter := NewRateLimiter(mockStorage, opts, logger.NewLogger())
+
+	t.Run("should allow request in a single storage call", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("GCRA", ctx, rk.Key, 100*time.Millisecond, opts.MaxRequestToken, opts.BlockDuration, 1).
+			Return(true, 9, time.Duration(0), 100*time.Millisecond, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 9, resp.RequestsLeft)
+		assert.Equal(t, opts.MaxRequestToken, resp.Limit)
+		assert.True(t, resp.RetryAfter.IsZero())
+		assert.WithinDuration(t, time.Now().Add(100*time.Millisecond), resp.ResetTime, 10*time.Millisecond)
+		mockStorage.AssertNotCalled(t, "IsBlocked", mock.Anything, mock.Anything)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should deny request with the exact retry delay", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "127.0.0.1", KeyType: API}
+
+		mockStorage.On("GCRA", ctx, rk.Key, 200*time.Millisecond, opts.MaxRequestIP, opts.BlockDuration, 1).
+			Return(false, 0, time.Minute, time.Second, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.False(t, resp.Blocked)
+		assert.Equal(t, opts.MaxRequestIP, resp.Limit)
+		assert.Equal(t, 0, resp.RequestsLeft)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), resp.RetryAfter, 10*time.Millisecond)
+		assert.WithinDuration(t, time.Now().Add(time.Second), resp.ResetTime, 10*time.Millisecond)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should report a key already blocked", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "127.0.0.1", KeyType: API}
+
+		mockStorage.On("GCRA", ctx, rk.Key, 200*time.Millisecond, opts.MaxRequestIP, opts.BlockDuration, 1).
+			Return(false, -1, 42*time.Second, 42*time.Second, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.True(t, resp.Blocked)
+		assert.Equal(t, DecisionBlocked, resp.Decision())
+		assert.Equal(t, 0, resp.RequestsLeft)
+		assert.Equal(t, opts.MaxRequestIP, resp.Limit)
+		assert.WithinDuration(t, time.Now().Add(42*time.Second), resp.RetryAfter, 10*time.Millisecond)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should return error when GCRA fails", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("GCRA", ctx, rk.Key, 100*time.Millisecond, opts.MaxRequestToken, opts.BlockDuration, 1).
+			Return(false, 0, time.Duration(0), time.Duration(0), errors.New("storage error"))
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.Error(t, err)
+		assert.False(t, resp.Allowed)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestRateLimiter_AllowAtomicFixedWindow(t *testing.T) {
+	mockStorage := new(mocks.AtomicStorageMock)
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	opts := Options{
+		MaxRequestIP:    5,
+		MaxRequestToken: 10,
+		WindowDuration:  time.Minute,
+		BlockDuration:   time.Minute * 5,
+	}
+	rateLimiter := NewRateLimiter(mockStorage, opts, logger.NewLogger())
+
+	t.Run("should allow request with a single Hit", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("Hit", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, opts.BlockDuration, 1).Return(false, 4, 30*time.Second, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 6, resp.RequestsLeft)
+		mockStorage.AssertNotCalled(t, "IsBlocked", mock.Anything, mock.Anything)
+		mockStorage.AssertNotCalled(t, "IncrRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should deny request when already blocked", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("Hit", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, opts.BlockDuration, 1).Return(true, 0, time.Minute, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), resp.RetryAfter, 10*time.Millisecond)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should deny request over limit without a separate BlockRequest", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("Hit", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, opts.BlockDuration, 1).Return(false, 11, 30*time.Second, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Equal(t, 0, resp.RequestsLeft)
+		assert.WithinDuration(t, time.Now().Add(opts.BlockDuration), resp.RetryAfter, 10*time.Millisecond)
+		mockStorage.AssertNotCalled(t, "BlockRequest", mock.Anything, mock.Anything, mock.Anything)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should return error when Hit fails", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "test-key", KeyType: Token}
+
+		mockStorage.On("Hit", ctx, rk.Key, opts.WindowDuration, opts.MaxRequestToken, opts.BlockDuration, 1).Return(false, 0, time.Duration(0), errors.New("storage error"))
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.Error(t, err)
+		assert.False(t, resp.Allowed)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+type staticTokenRegistry map[string]TokenLimit
+
+func (r staticTokenRegistry) Lookup(ctx context.Context, token string) (TokenLimit, bool, error) {
+	limit, ok := r[token]
+	return limit, ok, nil
+}
+
+func TestRateLimiter_AllowScope(t *testing.T) {
+	mockStorage := new(mocks.StorageMock)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	opts := Options{
+		MaxRequestIP:    5,
+		MaxRequestToken: 10,
+		WindowDuration:  time.Minute,
+		BlockDuration:   time.Minute * 5,
+	}
+	rateLimiter := NewRateLimiter(mockStorage, opts, logger)
+
+	ctx := context.Background()
+	rk := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "search"}
+
+	mockStorage.On("IsBlocked", ctx, "search:127.0.0.1").Return(false, time.Duration(0), nil)
+	mockStorage.On("IncrRequest", ctx, "search:127.0.0.1", opts.WindowDuration, opts.MaxRequestIP, 1).Return(1, time.Minute, nil)
+
+	resp, err := rateLimiter.Allow(ctx, rk)
+
+	assert.NoError(t, err)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, 4, resp.RequestsLeft)
+	mockStorage.AssertExpectations(t)
+}
+
+func TestRateLimiter_AllowShadow(t *testing.T) {
+	storage := NewMemoryStorage(MemoryOptions{})
+	defer storage.Close()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	limiter := NewRateLimiter(storage, Options{
+		MaxRequestIP:   1,
+		WindowDuration: time.Minute,
+		BlockDuration:  time.Minute,
+		Shadow:         true,
+	}, logger)
+
+	ctx := context.Background()
+	rk := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "login-strict"}
+
+	resp, err := limiter.Allow(ctx, rk)
+
+	assert.NoError(t, err)
+	assert.True(t, resp.Allowed)
+	assert.True(t, resp.Shadow)
+	assert.Empty(t, logs.String())
+
+	for _, decision := range []string{DecisionDenied, DecisionBlocked} {
+		resp, err = limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Shadow)
+		assert.Equal(t, decision, resp.Decision())
+	}
+
+	assert.True(t, limiter.Shadow())
+	assert.Equal(t, 2, strings.Count(logs.String(), `"msg":"Rate limiter would have denied request"`))
+	assert.Contains(t, logs.String(), `"policy":"login-strict","key":"login-strict:127.0.0.1","key_type":"ip","decision":"blocked","limit":1`)
+}
+
+func TestRateLimiter_AllowEscalatingBlocks(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctx := context.Background()
+	rk := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "login"}
+
+	for _, algorithm := range []Algorithm{FixedWindow, TokenBucket, SlidingLog} {
+		t.Run("should multiply the block of repeat offenses with "+string(algorithm), func(t *testing.T) {
+			storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+			limiter := NewRateLimiter(storage, Options{
+				MaxRequestIP:     1,
+				WindowDuration:   time.Minute,
+				BlockDuration:    time.Minute,
+				Algorithm:        algorithm,
+				RefillRate:       1000,
+				BlockMultiplier:  2,
+				MaxBlockDuration: 3 * time.Minute,
+				OffenseLookback:  time.Hour,
+			}, logger)
+
+			offend := func() RateLimiterResponse {
+				t.Helper()
+
+				resp, err := limiter.Allow(ctx, rk)
+				require.NoError(t, err)
+				require.True(t, resp.Allowed)
+
+				resp, err = limiter.Allow(ctx, rk)
+				require.NoError(t, err)
+				require.False(t, resp.Allowed)
+
+				return resp
+			}
+
+			for level, block := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+				resp := offend()
+
+				assert.Equal(t, level+1, resp.PenaltyLevel)
+				assert.WithinDuration(t, time.Now().Add(block), resp.RetryAfter, time.Second)
+
+				_, ttl, err := storage.IsBlocked(ctx, "login:127.0.0.1")
+				require.NoError(t, err)
+				assert.Equal(t, block, ttl)
+
+				resp, err = limiter.Allow(ctx, rk)
+				require.NoError(t, err)
+				assert.True(t, resp.Blocked)
+				assert.Equal(t, level+1, resp.PenaltyLevel)
+
+				clock.Advance(block)
+			}
+
+			clock.Advance(time.Hour)
+
+			resp := offend()
+			assert.Equal(t, 1, resp.PenaltyLevel)
+			assert.WithinDuration(t, time.Now().Add(time.Minute), resp.RetryAfter, time.Second)
+		})
+	}
+
+	t.Run("should not record offenses without a multiplier", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		limiter := NewRateLimiter(mockStorage, Options{
+			MaxRequestIP:   1,
+			WindowDuration: time.Minute,
+			BlockDuration:  time.Minute,
+		}, logger)
+
+		mockStorage.On("IsBlocked", ctx, "login:127.0.0.1").Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, "login:127.0.0.1", time.Minute, 1, 1).Return(2, time.Minute, nil)
+		mockStorage.On("BlockRequest", ctx, "login:127.0.0.1", time.Minute).Return(nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Zero(t, resp.PenaltyLevel)
+		mockStorage.AssertNotCalled(t, "RecordOffense", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("should return error when RecordOffense fails", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		limiter := NewRateLimiter(mockStorage, Options{
+			MaxRequestIP:    1,
+			WindowDuration:  time.Minute,
+			BlockDuration:   time.Minute,
+			BlockMultiplier: 2,
+		}, logger)
+
+		mockStorage.On("IsBlocked", ctx, "login:127.0.0.1").Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, "login:127.0.0.1", time.Minute, 1, 1).Return(2, time.Minute, nil)
+		mockStorage.On("RecordOffense", ctx, "login:127.0.0.1", DefaultOffenseLookback).Return(0, errors.New("connection refused"))
+
+		_, err := limiter.Allow(ctx, rk)
+
+		assert.Error(t, err)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestRateLimiter_AllowN(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctx := context.Background()
+	rk := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "export"}
+
+	for _, algorithm := range []Algorithm{FixedWindow, TokenBucket, SlidingLog, SlidingCounter, GCRA} {
+		t.Run("should weight requests by cost with "+string(algorithm), func(t *testing.T) {
+			storage, _ := newTestMemoryStorage(t, MemoryOptions{})
+			limiter := NewRateLimiter(storage, Options{
+				MaxRequestIP:   10,
+				WindowDuration: time.Minute,
+				BlockDuration:  time.Minute,
+				Algorithm:      algorithm,
+			}, logger)
+
+			for _, left := range []int{6, 2} {
+				resp, err := limiter.AllowN(ctx, rk, 4)
+				require.NoError(t, err)
+				assert.True(t, resp.Allowed)
+				assert.Equal(t, left, resp.RequestsLeft)
+				assert.Equal(t, 4, resp.Cost)
+			}
+
+			resp, err := limiter.AllowN(ctx, rk, 4)
+			require.NoError(t, err)
+			assert.False(t, resp.Allowed)
+			assert.False(t, resp.Blocked)
+			assert.Equal(t, 2, resp.RequestsLeft)
+			assert.False(t, resp.RetryAfter.IsZero())
+
+			blocked, _, err := storage.IsBlocked(ctx, "export:127.0.0.1")
+			require.NoError(t, err)
+			assert.False(t, blocked, "a request that does not fit must not block the key")
+
+			resp, err = limiter.AllowN(ctx, rk, 2)
+			require.NoError(t, err)
+			assert.True(t, resp.Allowed)
+			assert.Equal(t, 0, resp.RequestsLeft)
+
+			resp, err = limiter.Allow(ctx, rk)
+			require.NoError(t, err)
+			assert.False(t, resp.Allowed)
+			assert.Equal(t, 1, resp.Cost)
+
+			blocked, _, err = storage.IsBlocked(ctx, "export:127.0.0.1")
+			require.NoError(t, err)
+			assert.True(t, blocked)
+		})
+	}
+
+	t.Run("should not use the quota of a request that does not fit", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		limiter := NewRateLimiter(mockStorage, Options{
+			MaxRequestIP:   10,
+			WindowDuration: time.Minute,
+			BlockDuration:  time.Minute,
+		}, logger)
+
+		mockStorage.On("IsBlocked", ctx, "export:127.0.0.1").Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, "export:127.0.0.1", time.Minute, 10, 4).Return(12, 30*time.Second, nil)
+
+		resp, err := limiter.AllowN(ctx, rk, 4)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Equal(t, 2, resp.RequestsLeft)
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), resp.RetryAfter, time.Second)
+		mockStorage.AssertNotCalled(t, "BlockRequest", mock.Anything, mock.Anything, mock.Anything)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should count a cost below 1 as 1", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		limiter := NewRateLimiter(mockStorage, Options{MaxRequestIP: 10, WindowDuration: time.Minute}, logger)
+
+		mockStorage.On("IsBlocked", ctx, "export:127.0.0.1").Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, "export:127.0.0.1", time.Minute, 10, 1).Return(1, time.Minute, nil)
+
+		resp, err := limiter.AllowN(ctx, rk, 0)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 1, resp.Cost)
+	})
+}
+
+func TestRateLimiter_AllowWindows(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctx := context.Background()
+	rk := RateLimitKey{Key: "abc123", KeyType: Token, IP: "127.0.0.1", Scope: "api"}
+
+	windows := []Window{{10, time.Second}, {500, time.Minute}, {50000, 24 * time.Hour}}
+	durations := []time.Duration{time.Second, time.Minute, 24 * time.Hour}
+	limits := []int{10, 500, 50000}
+
+	newLimiter := func(opts Options) (*RateLimiter, *mocks.StorageMock) {
+		mockStorage := new(mocks.StorageMock)
+		opts.Windows = windows
+		return NewRateLimiter(mockStorage, opts, logger), mockStorage
+	}
+
+	t.Run("should report the window with the fewest requests left", func(t *testing.T) {
+		limiter, mockStorage := newLimiter(Options{})
+		mockStorage.On("HitWindows", ctx, "api:abc123", durations, limits, time.Duration(0), 1).
+			Return(true, []int{3, 495, 1000}, []time.Duration{time.Second, 30 * time.Second, 5 * time.Hour}, time.Duration(0), nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 500, resp.Limit)
+		assert.Equal(t, time.Minute, resp.Window)
+		assert.Equal(t, 5, resp.RequestsLeft)
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), resp.ResetTime, time.Second)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should report the window a denied request waits on", func(t *testing.T) {
+		limiter, mockStorage := newLimiter(Options{})
+		mockStorage.On("HitWindows", ctx, "api:abc123", durations, limits, time.Duration(0), 1).
+			Return(false, []int{10, 500, 1000}, []time.Duration{time.Second, 30 * time.Second, 5 * time.Hour}, time.Duration(0), nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.False(t, resp.Blocked)
+		assert.Equal(t, 500, resp.Limit)
+		assert.Equal(t, time.Minute, resp.Window)
+		assert.Equal(t, 0, resp.RequestsLeft)
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), resp.RetryAfter, time.Second)
+	})
+
+	t.Run("should escalate the block set by the storage", func(t *testing.T) {
+		limiter, mockStorage := newLimiter(Options{BlockDuration: time.Minute, BlockMultiplier: 2})
+		mockStorage.On("HitWindows", ctx, "api:abc123", durations, limits, time.Minute, 1).
+			Return(false, []int{4, 500, 1000}, []time.Duration{time.Second, 30 * time.Second, 5 * time.Hour}, time.Minute, nil)
+		mockStorage.On("RecordOffense", ctx, "api:abc123", DefaultOffenseLookback).Return(2, nil)
+		mockStorage.On("BlockRequest", ctx, "api:abc123", 2*time.Minute).Return(nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Equal(t, 2, resp.PenaltyLevel)
+		assert.WithinDuration(t, time.Now().Add(2*time.Minute), resp.RetryAfter, time.Second)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should reject a blocked key", func(t *testing.T) {
+		limiter, mockStorage := newLimiter(Options{BlockDuration: time.Minute})
+		mockStorage.On("HitWindows", ctx, "api:abc123", durations, limits, time.Minute, 1).
+			Return(false, nil, nil, 40*time.Second, nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Blocked)
+		assert.Equal(t, 10, resp.Limit)
+		assert.Equal(t, time.Second, resp.Window)
+		assert.WithinDuration(t, time.Now().Add(40*time.Second), resp.RetryAfter, time.Second)
+	})
+
+	t.Run("should count a request in all windows with the memory storage", func(t *testing.T) {
+		storage, _ := newTestMemoryStorage(t, MemoryOptions{})
+		limiter := NewRateLimiter(storage, Options{
+			Windows:       []Window{{3, time.Second}, {4, time.Hour}},
+			BlockDuration: time.Minute,
+		}, logger)
+
+		for _, left := range []int{2, 1} {
+			resp, err := limiter.AllowN(ctx, rk, 1)
+			require.NoError(t, err)
+			assert.True(t, resp.Allowed)
+			assert.Equal(t, left, resp.RequestsLeft)
+		}
+
+		resp, err := limiter.AllowN(ctx, rk, 2)
+		require.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.False(t, resp.Blocked)
+		assert.Equal(t, 1, resp.RequestsLeft)
+		assert.Equal(t, time.Second, resp.Window)
+
+		resp, err = limiter.Allow(ctx, rk)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 0, resp.RequestsLeft)
+
+		resp, err = limiter.Allow(ctx, rk)
+		require.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.False(t, resp.Blocked)
+
+		resp, err = limiter.Allow(ctx, rk)
+		require.NoError(t, err)
+		assert.True(t, resp.Blocked)
+	})
+}
+
+func TestRateLimiter_AllowFailureMode(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctx := context.Background()
+	rk := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "login"}
+
+	newLimiter := func(mode FailureMode, fallback Storage) (*RateLimiter, *mocks.StorageMock) {
+		mockStorage := new(mocks.StorageMock)
+		mockStorage.On("IsBlocked", ctx, "login:127.0.0.1").Return(false, time.Duration(0), errors.New("connection refused"))
+
+		return NewRateLimiter(mockStorage, Options{
+			MaxRequestIP:    2,
+			WindowDuration:  time.Minute,
+			FailureMode:     mode,
+			FallbackStorage: fallback,
+		}, logger), mockStorage
+	}
+
+	t.Run("should return the error without a failure mode", func(t *testing.T) {
+		limiter, _ := newLimiter("", nil)
+
+		_, err := limiter.Allow(ctx, rk)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("should allow requests when failing open", func(t *testing.T) {
+		limiter, mockStorage := newLimiter(FailOpen, nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.True(t, resp.Degraded)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should deny requests when failing closed", func(t *testing.T) {
+		limiter, _ := newLimiter(FailClosed, nil)
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.True(t, resp.Degraded)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), resp.RetryAfter, time.Second)
+	})
+
+	t.Run("should limit requests with the fallback storage", func(t *testing.T) {
+		fallback := NewMemoryStorage(MemoryOptions{})
+		defer fallback.Close()
+		limiter, _ := newLimiter(FailFallback, fallback)
+
+		for i := 0; i < 2; i++ {
+			resp, err := limiter.Allow(ctx, rk)
+			assert.NoError(t, err)
+			assert.True(t, resp.Allowed)
+			assert.True(t, resp.Degraded)
+		}
+
+		resp, err := limiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.True(t, resp.Degraded)
+		assert.Equal(t, FailFallback, resp.FailureMode)
+		assert.Equal(t, 1, fallback.Len())
+	})
+
+	t.Run("should not hide unknown tokens", func(t *testing.T) {
+		limiter := NewRateLimiter(new(mocks.StorageMock), Options{
+			TokenRegistry: staticTokenRegistry{},
+			UnknownTokens: UnknownTokenReject,
+			FailureMode:   FailOpen,
+		}, logger)
+
+		_, err := limiter.Allow(ctx, RateLimitKey{Key: "abc", KeyType: Token, IP: "127.0.0.1"})
+
+		assert.ErrorIs(t, err, ErrUnknownToken)
+	})
+}
+
+func TestRateLimiter_AllowTokenRegistry(t *testing.T) {
+	mockStorage := new(mocks.StorageMock)
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	registry := staticTokenRegistry{
+		"premium": {Limit: 1000, Window: time.Minute, BlockDuration: time.Second},
+		"partial": {Limit: 50},
+		"expired": {Limit: 1000, ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	opts := Options{
+		MaxRequestIP:    5,
+		MaxRequestToken: 10,
+		WindowDuration:  time.Second,
+		BlockDuration:   time.Minute * 5,
+		TokenRegistry:   registry,
+	}
+	rateLimiter := NewRateLimiter(mockStorage, opts, logger.NewLogger())
+
+	t.Run("should apply the limits of a registered token", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "premium", KeyType: Token, IP: "127.0.0.1"}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, rk.Key, time.Minute, 1000, 1).Return(1, time.Minute, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 1000, resp.Limit)
+		assert.Equal(t, 999, resp.RequestsLeft)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should inherit unset token limits from options", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "partial", KeyType: Token, IP: "127.0.0.1"}
+
+		mockStorage.On("IsBlocked", ctx, rk.Key).Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, rk.Key, opts.WindowDuration, 50, 1).Return(51, time.Second, nil)
+		mockStorage.On("BlockRequest", ctx, rk.Key, opts.BlockDuration).Return(nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Equal(t, 50, resp.Limit)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should fall back to IP limiting for unknown and expired tokens", func(t *testing.T) {
+		for _, token := range []string{"unknown", "expired"} {
+			ctx := context.Background()
+			rk := RateLimitKey{Key: token, KeyType: Token, IP: "127.0.0.1"}
+
+			mockStorage.On("IsBlocked", ctx, rk.IP).Return(false, time.Duration(0), nil)
+			mockStorage.On("IncrRequest", ctx, rk.IP, opts.WindowDuration, opts.MaxRequestIP, 1).Return(1, time.Second, nil)
+
+			resp, err := rateLimiter.Allow(ctx, rk)
+
+			assert.NoError(t, err)
+			assert.True(t, resp.Allowed)
+			assert.Equal(t, opts.MaxRequestIP, resp.Limit)
+			mockStorage.AssertExpectations(t)
+			mockStorage.ClearMocks()
+		}
+	})
+
+	t.Run("should reject unknown tokens when configured", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		rejectOpts := opts
+		rejectOpts.UnknownTokens = UnknownTokenReject
+		limiter := NewRateLimiter(mockStorage, rejectOpts, logger.NewLogger())
+
+		resp, err := limiter.Allow(context.Background(), RateLimitKey{Key: "unknown", KeyType: Token, IP: "127.0.0.1"})
+
+		assert.ErrorIs(t, err, ErrUnknownToken)
+		assert.False(t, resp.Allowed)
+		mockStorage.AssertNotCalled(t, "IsBlocked", mock.Anything, mock.Anything)
+	})
+
+	t.Run("should scope the fallback IP key", func(t *testing.T) {
+		defer mockStorage.ClearMocks()
+
+		ctx := context.Background()
+		rk := RateLimitKey{Key: "unknown", KeyType: Token, IP: "127.0.0.1", Scope: "login"}
+
+		mockStorage.On("IsBlocked", ctx, "login:127.0.0.1").Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, "login:127.0.0.1", opts.WindowDuration, opts.MaxRequestIP, 1).Return(1, time.Second, nil)
+
+		resp, err := rateLimiter.Allow(ctx, rk)
+
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "login"}, resp.Key)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should resolve the client without counting a request", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		limiter := NewRateLimiter(mockStorage, opts, logger.NewLogger())
+
+		client, err := limiter.Resolve(context.Background(), RateLimitKey{Key: "premium", KeyType: Token, IP: "127.0.0.1", Scope: "api"})
+		assert.NoError(t, err)
+		assert.Equal(t, RateLimitKey{Key: "premium", KeyType: Token, IP: "127.0.0.1", Scope: "api"}, client)
+
+		client, err = limiter.Resolve(context.Background(), RateLimitKey{Key: "unknown", KeyType: Token, IP: "127.0.0.1", Scope: "api"})
+		assert.NoError(t, err)
+		assert.Equal(t, RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "api"}, client)
+
+		mockStorage.AssertNotCalled(t, "IncrRequest", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
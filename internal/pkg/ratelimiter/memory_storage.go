@@ -0,0 +1,785 @@
+package ratelimiter
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemoryShards          = 32
+	defaultMemoryCleanupInterval = time.Minute
+	evictionSampleSize           = 5
+)
+
+type MemoryOptions struct {
+	Shards          int
+	MaxKeys         int
+	CleanupInterval time.Duration
+}
+
+// MemoryStorage keeps the limiter state in process. Keys are spread over
+// lock-striped shards, and every state kept for a key lives in the same shard
+// so multi-key operations take a single lock. A janitor goroutine evicts
+// expired entries until Close is called.
+type MemoryStorage struct {
+	shards    []*memoryShard
+	now       func() time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	maxKeys int
+}
+
+type memoryEntry struct {
+	value      interface{}
+	expiresAt  time.Time
+	lastAccess time.Time
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type memoryQuota struct {
+	period string
+	used   int
+}
+
+type memoryWindow struct {
+	index int64
+	count int
+}
+
+type memoryCounter struct {
+	window int64
+	curr   int
+	prev   int
+}
+
+func NewMemoryStorage(opts MemoryOptions) *MemoryStorage {
+	return newMemoryStorage(opts, time.Now)
+}
+
+func newMemoryStorage(opts MemoryOptions, now func() time.Time) *MemoryStorage {
+	if opts.Shards <= 0 {
+		opts.Shards = defaultMemoryShards
+	}
+	if opts.CleanupInterval <= 0 {
+		opts.CleanupInterval = defaultMemoryCleanupInterval
+	}
+
+	maxKeys := 0
+	if opts.MaxKeys > 0 {
+		maxKeys = max(opts.MaxKeys/opts.Shards, 1)
+	}
+
+	m := &MemoryStorage{
+		shards: make([]*memoryShard, opts.Shards),
+		now:    now,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			entries: make(map[string]*memoryEntry),
+			maxKeys: maxKeys,
+		}
+	}
+
+	go m.janitor(opts.CleanupInterval)
+
+	return m
+}
+
+// Close stops the janitor goroutine and waits for it to return.
+func (m *MemoryStorage) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		<-m.done
+	})
+
+	return nil
+}
+
+// Len returns the number of live entries across all shards.
+func (m *MemoryStorage) Len() int {
+	total := 0
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		total += len(shard.entries)
+		shard.mu.Unlock()
+	}
+
+	return total
+}
+
+func (m *MemoryStorage) CountBlocked(ctx context.Context) (int, error) {
+	now := m.now()
+	total := 0
+
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if strings.HasPrefix(key, "block:") && !e.expired(now) {
+				total++
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return total, nil
+}
+
+func (m *MemoryStorage) Inspect(ctx context.Context, key string) (KeyState, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	state := KeyState{Key: key}
+	if e := shard.get("req:"+key, now); e != nil {
+		state.Count = e.value.(int)
+		if !e.expiresAt.IsZero() {
+			state.TTL = e.expiresAt.Sub(now)
+		}
+	}
+	state.Blocked, state.BlockTTL = shard.blocked("block:"+key, now)
+	if e := shard.get("offense:"+key, now); e != nil {
+		state.Offenses = e.value.(int)
+	}
+
+	return state, nil
+}
+
+func (m *MemoryStorage) Reset(ctx context.Context, key string) error {
+	shard := m.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	for _, prefix := range []string{"req:", "bucket:", "log:", "counter:", "tat:", "windows:", "inflight:", "quota:"} {
+		delete(shard.entries, prefix+key)
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) Unblock(ctx context.Context, key string) error {
+	shard := m.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.entries, "block:"+key)
+	delete(shard.entries, "offense:"+key)
+
+	return nil
+}
+
+// ListBlocked returns the blocked keys in lexical order, after the key given
+// as cursor.
+func (m *MemoryStorage) ListBlocked(ctx context.Context, cursor string, count int) ([]KeyState, string, error) {
+	now := m.now()
+
+	var blocked []KeyState
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			key, ok := strings.CutPrefix(key, "block:")
+			if ok && key > cursor && !e.expired(now) && !e.expiresAt.IsZero() {
+				blocked = append(blocked, KeyState{Key: key, Blocked: true, BlockTTL: e.expiresAt.Sub(now)})
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	slices.SortFunc(blocked, func(a, b KeyState) int { return strings.Compare(a.Key, b.Key) })
+
+	if count <= 0 || len(blocked) <= count {
+		return blocked, "", nil
+	}
+
+	return blocked[:count], blocked[count-1].Key, nil
+}
+
+func (m *MemoryStorage) IncrRequest(ctx context.Context, key string, window time.Duration, limit int, cost int) (int, time.Duration, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	requestKey := "req:" + key
+	if count, ttl := shard.count(requestKey, window, now); count < limit && count+cost > limit {
+		return count + cost, ttl, nil
+	}
+
+	count, ttl := shard.incr(requestKey, window, cost, now)
+
+	return count, ttl, nil
+}
+
+func (m *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, time.Duration, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	blocked, ttl := shard.blocked("block:"+key, now)
+
+	return blocked, ttl, nil
+}
+
+func (m *MemoryStorage) BlockRequest(ctx context.Context, key string, duration time.Duration) error {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.set("block:"+key, true, duration, now)
+
+	return nil
+}
+
+func (m *MemoryStorage) RecordOffense(ctx context.Context, key string, lookback time.Duration) (int, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	offenses := 1
+	if e := shard.get("offense:"+key, now); e != nil {
+		offenses += e.value.(int)
+	}
+	shard.set("offense:"+key, offenses, lookback, now)
+
+	return offenses, nil
+}
+
+func (m *MemoryStorage) Offenses(ctx context.Context, key string) (int, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if e := shard.get("offense:"+key, now); e != nil {
+		return e.value.(int), nil
+	}
+
+	return 0, nil
+}
+
+func (m *MemoryStorage) Hit(ctx context.Context, key string, window time.Duration, limit int, blockDuration time.Duration, cost int) (bool, int, time.Duration, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if blocked, ttl := shard.blocked("block:"+key, now); blocked {
+		return true, 0, ttl, nil
+	}
+
+	requestKey := "req:" + key
+	if count, ttl := shard.count(requestKey, window, now); count < limit && count+cost > limit {
+		return false, count + cost, ttl, nil
+	}
+
+	count, ttl := shard.incr(requestKey, window, cost, now)
+	if count > limit && blockDuration > 0 {
+		shard.set("block:"+key, true, blockDuration, now)
+	}
+
+	return false, count, ttl, nil
+}
+
+func (m *MemoryStorage) TakeToken(ctx context.Context, key string, rate float64, capacity int, cost int) (bool, float64, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	bucketKey := "bucket:" + key
+	bucket := &memoryBucket{tokens: float64(capacity), updatedAt: now}
+	if e := shard.get(bucketKey, now); e != nil {
+		bucket = e.value.(*memoryBucket)
+	}
+
+	elapsed := max(now.Sub(bucket.updatedAt).Seconds(), 0)
+	bucket.tokens = math.Min(float64(capacity), bucket.tokens+elapsed*rate)
+	bucket.updatedAt = now
+
+	allowed := bucket.tokens >= float64(cost)
+	if allowed {
+		bucket.tokens -= float64(cost)
+	}
+
+	ttl := secondsToDuration((float64(capacity)-bucket.tokens)/rate) + time.Second
+	shard.set(bucketKey, bucket, ttl, now)
+
+	return allowed, bucket.tokens, nil
+}
+
+func (m *MemoryStorage) SlidingLog(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	logKey := "log:" + key
+	var entries []time.Time
+	if e := shard.get(logKey, now); e != nil {
+		entries = e.value.([]time.Time)
+	}
+
+	cutoff := now.Add(-window)
+	first := 0
+	for first < len(entries) && !entries[first].After(cutoff) {
+		first++
+	}
+	entries = entries[first:]
+
+	allowed := len(entries)+cost <= limit
+	if allowed {
+		for range cost {
+			entries = append(entries, now)
+		}
+	}
+
+	shard.set(logKey, entries, window, now)
+
+	reset := window
+	if len(entries) > 0 {
+		// A rejected request waits for the entries it does not fit in to
+		// leave the window.
+		leaving := 1
+		if !allowed {
+			leaving = min(max(len(entries)+cost-limit, 1), len(entries))
+		}
+		reset = entries[leaving-1].Add(window).Sub(now)
+	}
+
+	return allowed, len(entries), reset, nil
+}
+
+func (m *MemoryStorage) SlidingCounter(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	counterKey := "counter:" + key
+	current := now.UnixNano() / int64(window)
+	elapsed := time.Duration(now.UnixNano() - current*int64(window))
+
+	counter := &memoryCounter{window: current}
+	if e := shard.get(counterKey, now); e != nil {
+		counter = e.value.(*memoryCounter)
+	}
+
+	switch counter.window {
+	case current:
+	case current - 1:
+		counter.prev, counter.curr = counter.curr, 0
+	default:
+		counter.prev, counter.curr = 0, 0
+	}
+	counter.window = current
+
+	weighted := float64(counter.prev)*float64(window-elapsed)/float64(window) + float64(counter.curr)
+
+	allowed := weighted+float64(cost) <= float64(limit)
+	if allowed {
+		counter.curr += cost
+		weighted += float64(cost)
+	}
+
+	shard.set(counterKey, counter, 2*window, now)
+
+	reset := window - elapsed
+	if !allowed && counter.prev > 0 && counter.curr+cost <= limit {
+		needed := float64(window) * (1 - float64(limit-cost-counter.curr)/float64(counter.prev))
+		reset = max(time.Duration(needed)-elapsed, 0)
+	}
+
+	return allowed, int(math.Ceil(weighted)), reset, nil
+}
+
+func (m *MemoryStorage) GCRA(ctx context.Context, key string, emissionInterval time.Duration, burst int, blockDuration time.Duration, cost int) (bool, int, time.Duration, time.Duration, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	blockKey := "block:" + key
+	if blocked, ttl := shard.blocked(blockKey, now); blocked {
+		return false, -1, ttl, ttl, nil
+	}
+
+	tatKey := "tat:" + key
+	tat := now
+	if e := shard.get(tatKey, now); e != nil {
+		tat = e.value.(time.Time)
+	}
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(time.Duration(cost) * emissionInterval)
+	allowAt := newTat.Add(-time.Duration(burst) * emissionInterval)
+
+	if allowAt.After(now) {
+		// A key with quota left for a cheaper request is not blocked.
+		if left := int(now.Sub(tat.Add(-time.Duration(burst)*emissionInterval)) / emissionInterval); left > 0 {
+			return false, left, allowAt.Sub(now), tat.Sub(now), nil
+		}
+
+		retryAfter := allowAt.Sub(now)
+		if blockDuration > 0 {
+			shard.set(blockKey, true, blockDuration, now)
+			retryAfter = blockDuration
+		}
+		return false, 0, retryAfter, tat.Sub(now), nil
+	}
+
+	resetAfter := newTat.Sub(now)
+	shard.set(tatKey, newTat, resetAfter, now)
+
+	return true, int(now.Sub(allowAt) / emissionInterval), 0, resetAfter, nil
+}
+
+func (m *MemoryStorage) HitWindows(ctx context.Context, key string, windows []time.Duration, limits []int, blockDuration time.Duration, cost int) (bool, []int, []time.Duration, time.Duration, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	blockKey := "block:" + key
+	if blocked, ttl := shard.blocked(blockKey, now); blocked {
+		return false, nil, nil, ttl, nil
+	}
+
+	windowsKey := "windows:" + key
+	counters := map[time.Duration]*memoryWindow{}
+	if e := shard.get(windowsKey, now); e != nil {
+		counters = e.value.(map[time.Duration]*memoryWindow)
+	}
+
+	counts := make([]int, len(windows))
+	resets := make([]time.Duration, len(windows))
+	allowed, exhausted := true, false
+	var longest time.Duration
+	for i, window := range windows {
+		index := now.UnixNano() / int64(window)
+		counter := counters[window]
+		if counter == nil || counter.index != index {
+			counter = &memoryWindow{index: index}
+			counters[window] = counter
+		}
+
+		counts[i] = counter.count
+		resets[i] = time.Duration((index+1)*int64(window) - now.UnixNano())
+		longest = max(longest, resets[i])
+		if counter.count+cost > limits[i] {
+			allowed = false
+			exhausted = exhausted || counter.count >= limits[i]
+		}
+	}
+
+	if !allowed {
+		if exhausted && blockDuration > 0 {
+			shard.set(blockKey, true, blockDuration, now)
+			return false, counts, resets, blockDuration, nil
+		}
+		return false, counts, resets, 0, nil
+	}
+
+	for i, window := range windows {
+		counters[window].count += cost
+		counts[i] += cost
+	}
+	shard.set(windowsKey, counters, longest, now)
+
+	return true, counts, resets, 0, nil
+}
+
+func (m *MemoryStorage) AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, int, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	leases := shard.leases("inflight:"+key, now)
+	if len(leases) >= limit {
+		return false, len(leases), nil
+	}
+
+	leases[id] = now.Add(lease)
+	shard.set("inflight:"+key, leases, lease, now)
+
+	return true, len(leases), nil
+}
+
+func (m *MemoryStorage) RenewLease(ctx context.Context, key, id string, lease time.Duration) error {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	leases := shard.leases("inflight:"+key, now)
+	if _, ok := leases[id]; ok {
+		leases[id] = now.Add(lease)
+		shard.set("inflight:"+key, leases, lease, now)
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if e := shard.get("inflight:"+key, now); e != nil {
+		leases := e.value.(map[string]time.Time)
+		delete(leases, id)
+		if len(leases) == 0 {
+			delete(shard.entries, "inflight:"+key)
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (bool, int, error) {
+	shard := m.shard(key)
+	now := m.now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	quota := shard.quota(key, period, now)
+	if quota.used+cost > limit {
+		return false, quota.used, nil
+	}
+
+	quota.used += cost
+	shard.set("quota:"+key, quota, ttl, now)
+
+	return true, quota.used, nil
+}
+
+func (m *MemoryStorage) QuotaUsage(ctx context.Context, key, period string) (int, error) {
+	shard := m.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return shard.quota(key, period, m.now()).used, nil
+}
+
+func (m *MemoryStorage) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+func (m *MemoryStorage) janitor(interval time.Duration) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.deleteExpired()
+		}
+	}
+}
+
+func (m *MemoryStorage) deleteExpired() {
+	now := m.now()
+
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if e.expired(now) {
+				delete(shard.entries, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// get returns the live entry stored under key, deleting it when expired. The
+// shard lock must be held.
+func (s *memoryShard) get(key string, now time.Time) *memoryEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if e.expired(now) {
+		delete(s.entries, key)
+		return nil
+	}
+
+	e.lastAccess = now
+
+	return e
+}
+
+// set stores value under key for ttl, or without expiration when ttl is not
+// positive, evicting another entry when the shard is full. The shard lock must
+// be held.
+func (s *memoryShard) set(key string, value interface{}, ttl time.Duration, now time.Time) *memoryEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		if s.maxKeys > 0 && len(s.entries) >= s.maxKeys {
+			s.evict(now)
+		}
+		e = &memoryEntry{}
+		s.entries[key] = e
+	}
+
+	e.value = value
+	e.lastAccess = now
+	e.expiresAt = time.Time{}
+	if ttl > 0 {
+		e.expiresAt = now.Add(ttl)
+	}
+
+	return e
+}
+
+// count returns the count stored under key and the time left in its window,
+// which is window for a key that was not counted yet.
+func (s *memoryShard) count(key string, window time.Duration, now time.Time) (int, time.Duration) {
+	e := s.get(key, now)
+	if e == nil {
+		return 0, window
+	}
+
+	return e.value.(int), e.expiresAt.Sub(now)
+}
+
+func (s *memoryShard) incr(key string, window time.Duration, cost int, now time.Time) (int, time.Duration) {
+	e := s.get(key, now)
+	if e == nil {
+		e = s.set(key, 0, window, now)
+	}
+
+	count := e.value.(int) + cost
+	e.value = count
+
+	if e.expiresAt.IsZero() {
+		return count, -1
+	}
+
+	return count, e.expiresAt.Sub(now)
+}
+
+// leases returns the unexpired leases stored under key, which the caller may
+// change in place.
+func (s *memoryShard) leases(key string, now time.Time) map[string]time.Time {
+	e := s.get(key, now)
+	if e == nil {
+		return make(map[string]time.Time)
+	}
+
+	leases := e.value.(map[string]time.Time)
+	for id, expiresAt := range leases {
+		if !expiresAt.After(now) {
+			delete(leases, id)
+		}
+	}
+
+	return leases
+}
+
+// quota returns the usage of key in period, which is empty when the stored
+// usage is of another period.
+func (s *memoryShard) quota(key, period string, now time.Time) *memoryQuota {
+	if e := s.get("quota:"+key, now); e != nil {
+		if quota := e.value.(*memoryQuota); quota.period == period {
+			return quota
+		}
+	}
+
+	return &memoryQuota{period: period}
+}
+
+func (s *memoryShard) blocked(key string, now time.Time) (bool, time.Duration) {
+	e := s.get(key, now)
+	if e == nil || e.expiresAt.IsZero() {
+		return false, 0
+	}
+
+	return true, e.expiresAt.Sub(now)
+}
+
+// evict removes an expired entry, or the least recently used one among a small
+// sample of entries, in the same way Redis approximates LRU eviction. Blocks
+// are only evicted from a sample holding nothing else, as evicting one lets
+// its key through before the block ends.
+func (s *memoryShard) evict(now time.Time) {
+	var (
+		victim      string
+		victimBlock bool
+		oldest      time.Time
+		seen        int
+	)
+
+	for key, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, key)
+			return
+		}
+
+		block := strings.HasPrefix(key, "block:")
+		if seen == 0 || (victimBlock && !block) || (block == victimBlock && e.lastAccess.Before(oldest)) {
+			victim, victimBlock, oldest = key, block, e.lastAccess
+		}
+
+		seen++
+		if seen == evictionSampleSize {
+			break
+		}
+	}
+
+	delete(s.entries, victim)
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
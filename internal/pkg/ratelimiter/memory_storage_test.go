@@ -0,0 +1,651 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestMemoryStorage(t *testing.T, opts MemoryOptions) (*MemoryStorage, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	storage := newMemoryStorage(opts, clock.Now)
+	t.Cleanup(func() { storage.Close() })
+
+	return storage, clock
+}
+
+func TestMemoryStorage_IncrRequest(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	t.Run("increments request count within the window", func(t *testing.T) {
+		count, ttl, err := storage.IncrRequest(ctx, "test_key", 10*time.Second, 10, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, 10*time.Second, ttl)
+
+		clock.Advance(4 * time.Second)
+
+		count, ttl, err = storage.IncrRequest(ctx, "test_key", 10*time.Second, 10, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+		assert.Equal(t, 6*time.Second, ttl)
+	})
+
+	t.Run("starts a new window after expiration", func(t *testing.T) {
+		clock.Advance(6 * time.Second)
+
+		count, ttl, err := storage.IncrRequest(ctx, "test_key", 10*time.Second, 10, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, 10*time.Second, ttl)
+	})
+
+	t.Run("does not count a request that does not fit", func(t *testing.T) {
+		count, _, err := storage.IncrRequest(ctx, "test_key", 10*time.Second, 3, 3)
+		require.NoError(t, err)
+		assert.Equal(t, 4, count)
+
+		count, _, err = storage.IncrRequest(ctx, "test_key", 10*time.Second, 3, 2)
+		require.NoError(t, err)
+		assert.Equal(t, 3, count)
+
+		count, _, err = storage.IncrRequest(ctx, "test_key", 10*time.Second, 3, 2)
+		require.NoError(t, err)
+		assert.Equal(t, 5, count, "a key with nothing left is counted")
+	})
+}
+
+func TestMemoryStorage_Block(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	blocked, ttl, err := storage.IsBlocked(ctx, "test_key")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	require.NoError(t, storage.BlockRequest(ctx, "test_key", time.Minute))
+
+	blocked, ttl, err = storage.IsBlocked(ctx, "test_key")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	assert.Equal(t, time.Minute, ttl)
+
+	clock.Advance(time.Minute)
+
+	blocked, _, err = storage.IsBlocked(ctx, "test_key")
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestMemoryStorage_CountBlocked(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	require.NoError(t, storage.BlockRequest(ctx, "a", time.Minute))
+	require.NoError(t, storage.BlockRequest(ctx, "b", time.Hour))
+	_, _, err := storage.IncrRequest(ctx, "c", time.Hour, 10, 1)
+	require.NoError(t, err)
+
+	count, err := storage.CountBlocked(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	clock.Advance(time.Minute)
+
+	count, err = storage.CountBlocked(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestMemoryStorage_KeyAdmin(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	_, _, err := storage.IncrRequest(ctx, "ip:a", time.Minute, 10, 1)
+	require.NoError(t, err)
+	_, _, err = storage.IncrRequest(ctx, "ip:a", time.Minute, 10, 1)
+	require.NoError(t, err)
+	require.NoError(t, storage.BlockRequest(ctx, "ip:a", time.Hour))
+	_, _, err = storage.IncrQuota(ctx, "ip:a", "2026-10-01", 31*24*time.Hour, 10, 3)
+	require.NoError(t, err)
+	acquired, _, err := storage.AcquireLease(ctx, "ip:a", "lease-1", 1, time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	state, err := storage.Inspect(ctx, "ip:a")
+	require.NoError(t, err)
+	assert.Equal(t, KeyState{Key: "ip:a", Count: 2, TTL: time.Minute, Blocked: true, BlockTTL: time.Hour}, state)
+
+	require.NoError(t, storage.Reset(ctx, "ip:a"))
+	state, err = storage.Inspect(ctx, "ip:a")
+	require.NoError(t, err)
+	assert.Equal(t, 0, state.Count)
+	assert.True(t, state.Blocked)
+
+	used, err := storage.QuotaUsage(ctx, "ip:a", "2026-10-01")
+	require.NoError(t, err)
+	assert.Zero(t, used)
+	acquired, _, err = storage.AcquireLease(ctx, "ip:a", "lease-2", 1, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	_, err = storage.RecordOffense(ctx, "ip:a", time.Hour)
+	require.NoError(t, err)
+	state, err = storage.Inspect(ctx, "ip:a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, state.Offenses)
+
+	require.NoError(t, storage.Unblock(ctx, "ip:a"))
+	state, err = storage.Inspect(ctx, "ip:a")
+	require.NoError(t, err)
+	assert.False(t, state.Blocked)
+	assert.Zero(t, state.Offenses)
+
+	for _, key := range []string{"ip:c", "ip:b", "ip:d", "ip:e"} {
+		require.NoError(t, storage.BlockRequest(ctx, key, time.Minute))
+	}
+	require.NoError(t, storage.BlockRequest(ctx, "ip:f", time.Second))
+	clock.Advance(time.Second)
+
+	page, cursor, err := storage.ListBlocked(ctx, "", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ip:b", "ip:c", "ip:d"}, keysOf(page))
+	assert.Equal(t, "ip:d", cursor)
+
+	page, cursor, err = storage.ListBlocked(ctx, cursor, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ip:e"}, keysOf(page))
+	assert.Empty(t, cursor)
+}
+
+func keysOf(states []KeyState) []string {
+	keys := make([]string, 0, len(states))
+	for _, state := range states {
+		keys = append(keys, state.Key)
+	}
+	return keys
+}
+
+func TestMemoryStorage_Hit(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestMemoryStorage(t, MemoryOptions{})
+
+	for i := 1; i <= 3; i++ {
+		blocked, count, _, err := storage.Hit(ctx, "test_key", time.Second, 2, time.Minute, 1)
+		require.NoError(t, err)
+		assert.False(t, blocked)
+		assert.Equal(t, i, count)
+	}
+
+	blocked, _, ttl, err := storage.Hit(ctx, "test_key", time.Second, 2, time.Minute, 1)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	assert.Equal(t, time.Minute, ttl)
+}
+
+func TestMemoryStorage_HitCost(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestMemoryStorage(t, MemoryOptions{})
+
+	blocked, count, _, err := storage.Hit(ctx, "test_key", time.Second, 5, time.Minute, 3)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, 3, count)
+
+	// Not enough quota left: the request is not counted nor the key blocked.
+	blocked, count, _, err = storage.Hit(ctx, "test_key", time.Second, 5, time.Minute, 3)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, 6, count)
+
+	blocked, count, _, err = storage.Hit(ctx, "test_key", time.Second, 5, time.Minute, 2)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, 5, count)
+
+	blocked, count, _, err = storage.Hit(ctx, "test_key", time.Second, 5, time.Minute, 1)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	assert.Equal(t, 6, count)
+
+	blocked, _, err = storage.IsBlocked(ctx, "test_key")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+}
+
+func TestMemoryStorage_HitWindows(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	windows := []time.Duration{time.Second, time.Minute}
+	limits := []int{2, 3}
+
+	t.Run("counts requests in every window", func(t *testing.T) {
+		for i := 1; i <= 2; i++ {
+			allowed, counts, resets, blockTTL, err := storage.HitWindows(ctx, "test_key", windows, limits, time.Minute, 1)
+			require.NoError(t, err)
+			assert.True(t, allowed)
+			assert.Equal(t, []int{i, i}, counts)
+			// The clock is 20 seconds into its minute.
+			assert.Equal(t, []time.Duration{time.Second, 40 * time.Second}, resets)
+			assert.Zero(t, blockTTL)
+		}
+	})
+
+	t.Run("counts a request in no window when one has no room for it", func(t *testing.T) {
+		allowed, counts, _, blockTTL, err := storage.HitWindows(ctx, "test_key", windows, limits, 0, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, []int{2, 2}, counts)
+		assert.Zero(t, blockTTL)
+
+		clock.Advance(time.Second)
+
+		allowed, counts, _, blockTTL, err = storage.HitWindows(ctx, "test_key", windows, limits, time.Minute, 2)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, []int{0, 2}, counts)
+		assert.Zero(t, blockTTL, "a window with quota left does not block the key")
+	})
+
+	t.Run("blocks the key once a window ran out", func(t *testing.T) {
+		allowed, counts, _, _, err := storage.HitWindows(ctx, "test_key", windows, limits, time.Minute, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, []int{1, 3}, counts)
+
+		clock.Advance(time.Second)
+
+		allowed, counts, _, blockTTL, err := storage.HitWindows(ctx, "test_key", windows, limits, time.Minute, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, []int{0, 3}, counts)
+		assert.Equal(t, time.Minute, blockTTL)
+
+		allowed, counts, _, blockTTL, err = storage.HitWindows(ctx, "test_key", windows, limits, time.Minute, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Nil(t, counts)
+		assert.Equal(t, time.Minute, blockTTL)
+	})
+
+	t.Run("starts windows over when they reset", func(t *testing.T) {
+		require.NoError(t, storage.Unblock(ctx, "test_key"))
+		clock.Advance(time.Minute)
+
+		allowed, counts, _, _, err := storage.HitWindows(ctx, "test_key", windows, limits, time.Minute, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, []int{1, 1}, counts)
+
+		require.NoError(t, storage.Reset(ctx, "test_key"))
+		_, counts, _, _, err = storage.HitWindows(ctx, "test_key", windows, limits, time.Minute, 1)
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 1}, counts)
+	})
+}
+
+func TestMemoryStorage_TakeToken(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	for range 2 {
+		allowed, _, err := storage.TakeToken(ctx, "test_key", 2, 2, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	allowed, tokens, err := storage.TakeToken(ctx, "test_key", 2, 2, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 0.0, tokens)
+
+	clock.Advance(750 * time.Millisecond)
+
+	allowed, tokens, err = storage.TakeToken(ctx, "test_key", 2, 2, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.InDelta(t, 0.5, tokens, 1e-9)
+}
+
+func TestMemoryStorage_SlidingLog(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	allowed, count, _, err := storage.SlidingLog(ctx, "test_key", 10*time.Second, 2, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, count)
+
+	clock.Advance(6 * time.Second)
+
+	allowed, count, reset, err := storage.SlidingLog(ctx, "test_key", 10*time.Second, 2, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 4*time.Second, reset)
+
+	allowed, _, reset, err = storage.SlidingLog(ctx, "test_key", 10*time.Second, 2, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 4*time.Second, reset)
+
+	clock.Advance(4 * time.Second)
+
+	allowed, count, reset, err = storage.SlidingLog(ctx, "test_key", 10*time.Second, 2, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 6*time.Second, reset)
+}
+
+func TestMemoryStorage_SlidingLogCost(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	allowed, count, _, err := storage.SlidingLog(ctx, "test_key", 10*time.Second, 4, 2)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 2, count)
+
+	clock.Advance(4 * time.Second)
+
+	allowed, count, _, err = storage.SlidingLog(ctx, "test_key", 10*time.Second, 4, 2)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 4, count)
+
+	// Both requests logged first have to leave the window.
+	allowed, _, reset, err := storage.SlidingLog(ctx, "test_key", 10*time.Second, 4, 2)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 6*time.Second, reset)
+
+	clock.Advance(6 * time.Second)
+
+	allowed, count, _, err = storage.SlidingLog(ctx, "test_key", 10*time.Second, 4, 2)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 4, count)
+}
+
+func TestMemoryStorage_SlidingCounter(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	for range 4 {
+		allowed, _, _, err := storage.SlidingCounter(ctx, "test_key", 10*time.Second, 4, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	allowed, count, _, err := storage.SlidingCounter(ctx, "test_key", 10*time.Second, 4, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 4, count)
+
+	clock.Advance(15 * time.Second)
+
+	allowed, count, _, err = storage.SlidingCounter(ctx, "test_key", 10*time.Second, 4, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 3, count)
+
+	allowed, count, _, err = storage.SlidingCounter(ctx, "test_key", 10*time.Second, 4, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 4, count)
+
+	allowed, _, reset, err := storage.SlidingCounter(ctx, "test_key", 10*time.Second, 4, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 2500*time.Millisecond, reset)
+}
+
+func TestMemoryStorage_GCRA(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	for i := 2; i >= 0; i-- {
+		allowed, remaining, _, _, err := storage.GCRA(ctx, "test_key", 100*time.Millisecond, 3, 0, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, i, remaining)
+	}
+
+	allowed, _, retryAfter, resetAfter, err := storage.GCRA(ctx, "test_key", 100*time.Millisecond, 3, 0, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 100*time.Millisecond, retryAfter)
+	assert.Equal(t, 300*time.Millisecond, resetAfter)
+
+	clock.Advance(100 * time.Millisecond)
+
+	allowed, remaining, _, _, err := storage.GCRA(ctx, "test_key", 100*time.Millisecond, 3, time.Minute, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 0, remaining)
+
+	allowed, _, retryAfter, _, err = storage.GCRA(ctx, "test_key", 100*time.Millisecond, 3, time.Minute, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Minute, retryAfter)
+
+	blocked, _, err := storage.IsBlocked(ctx, "test_key")
+	require.NoError(t, err)
+	assert.True(t, blocked)
+
+	allowed, remaining, retryAfter, _, err = storage.GCRA(ctx, "test_key", 100*time.Millisecond, 3, time.Minute, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, -1, remaining)
+	assert.Equal(t, time.Minute, retryAfter)
+}
+
+func TestMemoryStorage_Eviction(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("caps the number of keys", func(t *testing.T) {
+		storage, _ := newTestMemoryStorage(t, MemoryOptions{Shards: 2, MaxKeys: 10})
+
+		for i := range 100 {
+			_, _, err := storage.IncrRequest(ctx, fmt.Sprintf("key-%d", i), time.Minute, 10, 1)
+			require.NoError(t, err)
+		}
+
+		assert.LessOrEqual(t, storage.Len(), 10)
+	})
+
+	t.Run("caps quotas like any other entry", func(t *testing.T) {
+		storage, _ := newTestMemoryStorage(t, MemoryOptions{Shards: 1, MaxKeys: 10})
+
+		for i := range 100 {
+			_, _, err := storage.IncrQuota(ctx, fmt.Sprintf("key-%d", i), "2026-10-01", 31*24*time.Hour, 10, 1)
+			require.NoError(t, err)
+			_, _, err = storage.IncrRequest(ctx, fmt.Sprintf("key-%d", i), time.Minute, 10, 1)
+			require.NoError(t, err)
+		}
+
+		assert.LessOrEqual(t, storage.Len(), 10)
+	})
+
+	t.Run("evicts other entries before blocks", func(t *testing.T) {
+		storage, _ := newTestMemoryStorage(t, MemoryOptions{Shards: 1, MaxKeys: 4})
+
+		require.NoError(t, storage.BlockRequest(ctx, "blocked", time.Hour))
+		for i := range 100 {
+			_, _, err := storage.IncrQuota(ctx, fmt.Sprintf("key-%d", i), "2026-10-01", 31*24*time.Hour, 10, 1)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 4, storage.Len())
+
+		blocked, _, err := storage.IsBlocked(ctx, "blocked")
+		require.NoError(t, err)
+		assert.True(t, blocked)
+		used, err := storage.QuotaUsage(ctx, "key-99", "2026-10-01")
+		require.NoError(t, err)
+		assert.Equal(t, 1, used)
+	})
+
+	t.Run("janitor removes expired entries", func(t *testing.T) {
+		storage, clock := newTestMemoryStorage(t, MemoryOptions{CleanupInterval: time.Millisecond})
+
+		_, _, err := storage.IncrRequest(ctx, "test_key", time.Second, 10, 1)
+		require.NoError(t, err)
+		require.NoError(t, storage.BlockRequest(ctx, "test_key", time.Second))
+		assert.Equal(t, 2, storage.Len())
+
+		clock.Advance(time.Second)
+
+		assert.Eventually(t, func() bool { return storage.Len() == 0 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("close stops the janitor", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{CleanupInterval: time.Millisecond})
+
+		assert.NoError(t, storage.Close())
+		assert.NoError(t, storage.Close())
+	})
+}
+
+func TestMemoryStorage_Concurrency(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestMemoryStorage(t, MemoryOptions{})
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				_, _, err := storage.IncrRequest(ctx, "test_key", time.Minute, 10, 1)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	count, _, err := storage.IncrRequest(ctx, "test_key", time.Minute, 10, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1001, count)
+}
+
+func TestMemoryStorage_RecordOffense(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	for want := 1; want <= 3; want++ {
+		offenses, err := storage.RecordOffense(ctx, "ip:a", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, want, offenses)
+
+		clock.Advance(50 * time.Minute)
+	}
+
+	offenses, err := storage.Offenses(ctx, "ip:a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, offenses)
+
+	clock.Advance(10 * time.Minute)
+
+	offenses, err = storage.Offenses(ctx, "ip:a")
+	require.NoError(t, err)
+	assert.Zero(t, offenses)
+}
+
+func TestMemoryStorage_Leases(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	for i, id := range []string{"a", "b"} {
+		acquired, inFlight, err := storage.AcquireLease(ctx, "test_key", id, 2, 10*time.Second)
+		require.NoError(t, err)
+		assert.True(t, acquired)
+		assert.Equal(t, i+1, inFlight)
+	}
+
+	acquired, inFlight, err := storage.AcquireLease(ctx, "test_key", "c", 2, 10*time.Second)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, 2, inFlight)
+
+	require.NoError(t, storage.ReleaseLease(ctx, "test_key", "a"))
+
+	acquired, _, err = storage.AcquireLease(ctx, "test_key", "c", 2, 10*time.Second)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// Only the renewed lease outlives its duration.
+	clock.Advance(6 * time.Second)
+	require.NoError(t, storage.RenewLease(ctx, "test_key", "b", 10*time.Second))
+	clock.Advance(6 * time.Second)
+
+	acquired, inFlight, err = storage.AcquireLease(ctx, "test_key", "d", 2, 10*time.Second)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, 2, inFlight)
+}
+
+func TestMemoryStorage_Quota(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newTestMemoryStorage(t, MemoryOptions{})
+
+	allowed, used, err := storage.IncrQuota(ctx, "test_key", "2026-10-01", 31*24*time.Hour, 5, 3)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 3, used)
+
+	// A request that does not fit is not counted.
+	allowed, used, err = storage.IncrQuota(ctx, "test_key", "2026-10-01", 31*24*time.Hour, 5, 3)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 3, used)
+
+	// Usage is kept until its period ends.
+	clock.Advance(31*24*time.Hour - time.Second)
+
+	used, err = storage.QuotaUsage(ctx, "test_key", "2026-10-01")
+	require.NoError(t, err)
+	assert.Equal(t, 3, used)
+
+	clock.Advance(time.Second)
+
+	used, err = storage.QuotaUsage(ctx, "test_key", "2026-10-01")
+	require.NoError(t, err)
+	assert.Zero(t, used)
+	assert.Zero(t, storage.Len())
+
+	used, err = storage.QuotaUsage(ctx, "test_key", "2026-11-01")
+	require.NoError(t, err)
+	assert.Zero(t, used)
+
+	allowed, used, err = storage.IncrQuota(ctx, "test_key", "2026-11-01", 31*24*time.Hour, 5, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, used)
+}
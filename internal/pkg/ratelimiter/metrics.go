@@ -0,0 +1,288 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const countBlockedTimeout = 5 * time.Second
+
+// Metrics exports the limiter decisions and storage calls to Prometheus. Labels
+// only carry policy names, key types and storage operations, never the keys
+// themselves, so the number of series stays bounded.
+type Metrics struct {
+	decisions      *prometheus.CounterVec
+	storageLatency *prometheus.HistogramVec
+	storageErrors  *prometheus.CounterVec
+	failures       *prometheus.CounterVec
+	breakerState   *prometheus.GaugeVec
+	shadowDenials  *prometheus.CounterVec
+	concurrency    *prometheus.CounterVec
+	quota          *prometheus.CounterVec
+}
+
+// NewMetrics registers the limiter metrics with reg. The gauge of blocked keys
+// is only registered when storage can count them, and is computed on scrape.
+func NewMetrics(reg prometheus.Registerer, storage Storage) *Metrics {
+	m := &Metrics{
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_decisions_total",
+			Help: "Rate limiter decisions by policy, key type and decision (allowed, denied or blocked).",
+		}, []string{"policy", "key_type", "decision"}),
+		storageLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ratelimiter_storage_duration_seconds",
+			Help:    "Latency of the rate limiter storage calls by operation.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_storage_errors_total",
+			Help: "Rate limiter storage calls that failed, by operation.",
+		}, []string{"operation"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_failure_mode_total",
+			Help: "Requests decided by the failure mode of their policy because the storage failed, by policy and mode.",
+		}, []string{"policy", "mode"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ratelimiter_circuit_breaker_state",
+			Help: "State of the storage circuit breaker, 1 for the current state (closed, open or half_open) and 0 for the others.",
+		}, []string{"state"}),
+		shadowDenials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_shadow_denials_total",
+			Help: "Requests a shadow policy would have denied, by policy, key type and decision (denied or blocked).",
+		}, []string{"policy", "key_type", "decision"}),
+		concurrency: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_concurrency_rejections_total",
+			Help: "Requests rejected because their key had too many requests in flight, by policy and key type.",
+		}, []string{"policy", "key_type"}),
+		quota: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_quota_rejections_total",
+			Help: "Requests rejected because their key used up its quota for the period, by policy and key type.",
+		}, []string{"policy", "key_type"}),
+	}
+
+	reg.MustRegister(m.decisions, m.storageLatency, m.storageErrors, m.failures, m.breakerState, m.shadowDenials, m.concurrency, m.quota)
+
+	if counter, ok := storage.(BlockCounter); ok {
+		reg.MustRegister(&blockedKeysCollector{
+			counter: counter,
+			errors:  m.storageErrors,
+			desc: prometheus.NewDesc(
+				"ratelimiter_blocked_keys",
+				"Keys currently blocked by the rate limiter.",
+				nil, nil,
+			),
+		})
+	}
+
+	return m
+}
+
+// Storage wraps storage so that the latency and errors of its calls are
+// observed.
+func (m *Metrics) Storage(storage Storage) Storage {
+	s := &instrumentedStorage{storage: storage, leases: concurrencyStorageOf(storage), quotas: quotaStorageOf(storage), admin: keyAdminOf(storage), metrics: m}
+	if atomic, ok := storage.(AtomicStorage); ok {
+		return &instrumentedAtomicStorage{instrumentedStorage: s, atomic: atomic}
+	}
+
+	return s
+}
+
+func (m *Metrics) observeDecision(rk RateLimitKey, resp RateLimiterResponse) {
+	if m == nil {
+		return
+	}
+
+	m.decisions.WithLabelValues(rk.Policy(), rk.KeyType.String(), resp.Decision()).Inc()
+}
+
+func (m *Metrics) observeShadowDenial(rk RateLimitKey, resp RateLimiterResponse) {
+	if m == nil {
+		return
+	}
+
+	m.shadowDenials.WithLabelValues(rk.Policy(), rk.KeyType.String(), resp.Decision()).Inc()
+}
+
+func (m *Metrics) observeConcurrencyRejection(rk RateLimitKey) {
+	if m == nil {
+		return
+	}
+
+	m.concurrency.WithLabelValues(rk.Policy(), rk.KeyType.String()).Inc()
+}
+
+func (m *Metrics) observeQuotaRejection(rk RateLimitKey) {
+	if m == nil {
+		return
+	}
+
+	m.quota.WithLabelValues(rk.Policy(), rk.KeyType.String()).Inc()
+}
+
+func (m *Metrics) observeFailure(rk RateLimitKey, mode FailureMode) {
+	if m == nil {
+		return
+	}
+
+	m.failures.WithLabelValues(rk.Policy(), string(mode)).Inc()
+}
+
+func (m *Metrics) observeBreakerState(state BreakerState) {
+	if m == nil {
+		return
+	}
+
+	for _, s := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		m.breakerState.WithLabelValues(s.String()).Set(value)
+	}
+}
+
+func (m *Metrics) observeCall(operation string, start time.Time, err *error) {
+	m.storageLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		m.storageErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+type blockedKeysCollector struct {
+	counter BlockCounter
+	errors  *prometheus.CounterVec
+	desc    *prometheus.Desc
+}
+
+func (c *blockedKeysCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *blockedKeysCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), countBlockedTimeout)
+	defer cancel()
+
+	count, err := c.counter.CountBlocked(ctx)
+	if err != nil {
+		c.errors.WithLabelValues("count_blocked").Inc()
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count))
+}
+
+type instrumentedStorage struct {
+	storage Storage
+	leases  ConcurrencyStorage
+	quotas  QuotaStorage
+	admin   KeyAdmin
+	metrics *Metrics
+}
+
+func (s *instrumentedStorage) IncrRequest(ctx context.Context, key string, window time.Duration, limit int, cost int) (count int, ttl time.Duration, err error) {
+	defer s.metrics.observeCall("incr_request", time.Now(), &err)
+	return s.storage.IncrRequest(ctx, key, window, limit, cost)
+}
+
+func (s *instrumentedStorage) IsBlocked(ctx context.Context, key string) (blocked bool, ttl time.Duration, err error) {
+	defer s.metrics.observeCall("is_blocked", time.Now(), &err)
+	return s.storage.IsBlocked(ctx, key)
+}
+
+func (s *instrumentedStorage) BlockRequest(ctx context.Context, key string, duration time.Duration) (err error) {
+	defer s.metrics.observeCall("block_request", time.Now(), &err)
+	return s.storage.BlockRequest(ctx, key, duration)
+}
+
+func (s *instrumentedStorage) TakeToken(ctx context.Context, key string, rate float64, capacity int, cost int) (allowed bool, tokens float64, err error) {
+	defer s.metrics.observeCall("take_token", time.Now(), &err)
+	return s.storage.TakeToken(ctx, key, rate, capacity, cost)
+}
+
+func (s *instrumentedStorage) SlidingLog(ctx context.Context, key string, window time.Duration, limit int, cost int) (allowed bool, count int, reset time.Duration, err error) {
+	defer s.metrics.observeCall("sliding_log", time.Now(), &err)
+	return s.storage.SlidingLog(ctx, key, window, limit, cost)
+}
+
+func (s *instrumentedStorage) SlidingCounter(ctx context.Context, key string, window time.Duration, limit int, cost int) (allowed bool, count int, reset time.Duration, err error) {
+	defer s.metrics.observeCall("sliding_counter", time.Now(), &err)
+	return s.storage.SlidingCounter(ctx, key, window, limit, cost)
+}
+
+func (s *instrumentedStorage) GCRA(ctx context.Context, key string, emissionInterval time.Duration, burst int, blockDuration time.Duration, cost int) (allowed bool, remaining int, retryAfter, resetAfter time.Duration, err error) {
+	defer s.metrics.observeCall("gcra", time.Now(), &err)
+	return s.storage.GCRA(ctx, key, emissionInterval, burst, blockDuration, cost)
+}
+
+func (s *instrumentedStorage) HitWindows(ctx context.Context, key string, windows []time.Duration, limits []int, blockDuration time.Duration, cost int) (allowed bool, counts []int, resets []time.Duration, blockTTL time.Duration, err error) {
+	defer s.metrics.observeCall("hit_windows", time.Now(), &err)
+	return s.storage.HitWindows(ctx, key, windows, limits, blockDuration, cost)
+}
+
+func (s *instrumentedStorage) RecordOffense(ctx context.Context, key string, lookback time.Duration) (offenses int, err error) {
+	defer s.metrics.observeCall("record_offense", time.Now(), &err)
+	return s.storage.RecordOffense(ctx, key, lookback)
+}
+
+func (s *instrumentedStorage) Offenses(ctx context.Context, key string) (offenses int, err error) {
+	defer s.metrics.observeCall("offenses", time.Now(), &err)
+	return s.storage.Offenses(ctx, key)
+}
+
+func (s *instrumentedStorage) AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (acquired bool, inFlight int, err error) {
+	defer s.metrics.observeCall("acquire_lease", time.Now(), &err)
+	return s.leases.AcquireLease(ctx, key, id, limit, lease)
+}
+
+func (s *instrumentedStorage) RenewLease(ctx context.Context, key, id string, lease time.Duration) (err error) {
+	defer s.metrics.observeCall("renew_lease", time.Now(), &err)
+	return s.leases.RenewLease(ctx, key, id, lease)
+}
+
+func (s *instrumentedStorage) ReleaseLease(ctx context.Context, key, id string) (err error) {
+	defer s.metrics.observeCall("release_lease", time.Now(), &err)
+	return s.leases.ReleaseLease(ctx, key, id)
+}
+
+func (s *instrumentedStorage) IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (allowed bool, used int, err error) {
+	defer s.metrics.observeCall("incr_quota", time.Now(), &err)
+	return s.quotas.IncrQuota(ctx, key, period, ttl, limit, cost)
+}
+
+func (s *instrumentedStorage) QuotaUsage(ctx context.Context, key, period string) (used int, err error) {
+	defer s.metrics.observeCall("quota_usage", time.Now(), &err)
+	return s.quotas.QuotaUsage(ctx, key, period)
+}
+
+func (s *instrumentedStorage) Inspect(ctx context.Context, key string) (state KeyState, err error) {
+	defer s.metrics.observeCall("inspect", time.Now(), &err)
+	return s.admin.Inspect(ctx, key)
+}
+
+func (s *instrumentedStorage) Reset(ctx context.Context, key string) (err error) {
+	defer s.metrics.observeCall("reset", time.Now(), &err)
+	return s.admin.Reset(ctx, key)
+}
+
+func (s *instrumentedStorage) Unblock(ctx context.Context, key string) (err error) {
+	defer s.metrics.observeCall("unblock", time.Now(), &err)
+	return s.admin.Unblock(ctx, key)
+}
+
+func (s *instrumentedStorage) ListBlocked(ctx context.Context, cursor string, count int) (keys []KeyState, next string, err error) {
+	defer s.metrics.observeCall("list_blocked", time.Now(), &err)
+	return s.admin.ListBlocked(ctx, cursor, count)
+}
+
+type instrumentedAtomicStorage struct {
+	*instrumentedStorage
+	atomic AtomicStorage
+}
+
+func (s *instrumentedAtomicStorage) Hit(ctx context.Context, key string, window time.Duration, limit int, blockDuration time.Duration, cost int) (blocked bool, count int, ttl time.Duration, err error) {
+	defer s.metrics.observeCall("hit", time.Now(), &err)
+	return s.atomic.Hit(ctx, key, window, limit, blockDuration, cost)
+}
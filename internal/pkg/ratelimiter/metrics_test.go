@@ -0,0 +1,149 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/mocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	t.Run("should count decisions by policy, key type and decision", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{})
+		defer storage.Close()
+
+		reg := prometheus.NewRegistry()
+		metrics := NewMetrics(reg, storage)
+		limiter := NewRateLimiter(metrics.Storage(storage), Options{
+			MaxRequestIP:   1,
+			WindowDuration: time.Minute,
+			BlockDuration:  time.Minute,
+			Metrics:        metrics,
+		}, logger)
+
+		rk := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "login"}
+		for range 3 {
+			_, err := limiter.Allow(ctx, rk)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.decisions.WithLabelValues("login", "ip", DecisionAllowed)))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.decisions.WithLabelValues("login", "ip", DecisionDenied)))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.decisions.WithLabelValues("login", "ip", DecisionBlocked)))
+
+		expected := `
+# HELP ratelimiter_blocked_keys Keys currently blocked by the rate limiter.
+# TYPE ratelimiter_blocked_keys gauge
+ratelimiter_blocked_keys 1
+`
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "ratelimiter_blocked_keys"))
+		assert.Equal(t, 1, testutil.CollectAndCount(metrics.storageLatency))
+	})
+
+	t.Run("should count requests shadow policies would deny", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{})
+		defer storage.Close()
+
+		metrics := NewMetrics(prometheus.NewRegistry(), storage)
+		limiter := NewRateLimiter(storage, Options{
+			MaxRequestIP:   1,
+			WindowDuration: time.Minute,
+			Metrics:        metrics,
+			Shadow:         true,
+		}, logger)
+
+		rk := RateLimitKey{Key: "127.0.0.1", KeyType: API, IP: "127.0.0.1", Scope: "login-strict"}
+		for range 3 {
+			resp, err := limiter.Allow(ctx, rk)
+			require.NoError(t, err)
+			require.True(t, resp.Shadow)
+		}
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.decisions.WithLabelValues("login-strict", "ip", DecisionAllowed)))
+		assert.Equal(t, 2.0, testutil.ToFloat64(metrics.decisions.WithLabelValues("login-strict", "ip", DecisionDenied)))
+		assert.Equal(t, 2.0, testutil.ToFloat64(metrics.shadowDenials.WithLabelValues("login-strict", "ip", DecisionDenied)))
+	})
+
+	t.Run("should count concurrency rejections", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{})
+		defer storage.Close()
+
+		metrics := NewMetrics(prometheus.NewRegistry(), storage)
+		limiter := NewConcurrencyLimiter(metrics.Storage(storage).(ConcurrencyStorage), ConcurrencyOptions{MaxInFlightToken: 1, Metrics: metrics}, logger)
+
+		rk := RateLimitKey{Key: "abc123", KeyType: Token, Scope: "export"}
+		lease, _, err := limiter.Acquire(ctx, rk)
+		require.NoError(t, err)
+		defer lease.Release()
+
+		_, resp, err := limiter.Acquire(ctx, rk)
+		require.NoError(t, err)
+		require.False(t, resp.Allowed)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.concurrency.WithLabelValues("export", "token")))
+		assert.Equal(t, 1, testutil.CollectAndCount(metrics.storageLatency))
+	})
+
+	t.Run("should count quota rejections", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{})
+		defer storage.Close()
+
+		metrics := NewMetrics(prometheus.NewRegistry(), storage)
+		limiter := NewQuotaLimiter(metrics.Storage(storage).(QuotaStorage), QuotaOptions{Limit: 1, Metrics: metrics}, logger)
+
+		rk := RateLimitKey{Key: "abc123", KeyType: Token, Scope: "plan"}
+		for _, want := range []bool{true, false} {
+			resp, err := limiter.AllowN(ctx, rk, 1)
+			require.NoError(t, err)
+			require.Equal(t, want, resp.Allowed)
+		}
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.quota.WithLabelValues("plan", "token")))
+		assert.Equal(t, 1, testutil.CollectAndCount(metrics.storageLatency))
+	})
+
+	t.Run("should observe storage latency and errors by operation", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		metrics := NewMetrics(prometheus.NewRegistry(), mockStorage)
+		limiter := NewRateLimiter(metrics.Storage(mockStorage), Options{
+			MaxRequestToken: 10,
+			WindowDuration:  time.Minute,
+			Metrics:         metrics,
+		}, logger)
+
+		mockStorage.On("IsBlocked", ctx, "abc").Return(false, time.Duration(0), nil)
+		mockStorage.On("IncrRequest", ctx, "abc", time.Minute, 10, 1).Return(0, time.Duration(0), errors.New("connection refused"))
+
+		_, err := limiter.Allow(ctx, RateLimitKey{Key: "abc", KeyType: Token})
+
+		assert.Error(t, err)
+		assert.Equal(t, 2, testutil.CollectAndCount(metrics.storageLatency))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.storageErrors.WithLabelValues("incr_request")))
+		assert.Equal(t, 0, testutil.CollectAndCount(metrics.decisions))
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("should keep atomic storages atomic", func(t *testing.T) {
+		storage := NewMemoryStorage(MemoryOptions{})
+		defer storage.Close()
+
+		metrics := NewMetrics(prometheus.NewRegistry(), storage)
+
+		_, ok := metrics.Storage(storage).(AtomicStorage)
+		assert.True(t, ok)
+		_, ok = metrics.Storage(new(mocks.StorageMock)).(AtomicStorage)
+		assert.False(t, ok)
+	})
+}
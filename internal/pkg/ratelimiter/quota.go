@@ -0,0 +1,194 @@
+package ratelimiter
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// QuotaPeriod is the calendar period a quota is granted for.
+type QuotaPeriod string
+
+const (
+	QuotaDay   QuotaPeriod = "day"
+	QuotaWeek  QuotaPeriod = "week"
+	QuotaMonth QuotaPeriod = "month"
+)
+
+// Bounds returns the start of the period holding t, in the location of t, and
+// the start of the next one. Weeks start on Monday.
+func (p QuotaPeriod) Bounds(t time.Time) (time.Time, time.Time) {
+	y, m, d := t.Date()
+
+	switch p {
+	case QuotaWeek:
+		start := time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 0, 7)
+	case QuotaMonth:
+		start := time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// QuotaStorage is implemented by storages able to keep the usage of long
+// quotas. Usage is kept per key for a single period at a time, named by the
+// date it starts, and starts over when the period changes. Redis keeps the
+// counters without expiration, so evicting the keys that have one under
+// memory pressure does not give quota back, while the memory storage drops
+// them once their period ends.
+type QuotaStorage interface {
+	// IncrQuota adds cost to the usage of key in period when it stays within
+	// limit, reporting whether it did and the usage. ttl is the time left in
+	// period, after which its usage is no longer needed.
+	IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (bool, int, error)
+	QuotaUsage(ctx context.Context, key, period string) (int, error)
+}
+
+// quotaStorageOf returns storage as a QuotaStorage, or one failing with
+// errors.ErrUnsupported when storage cannot keep quotas, for decorators to
+// pass quotas through.
+func quotaStorageOf(storage Storage) QuotaStorage {
+	if quotas, ok := storage.(QuotaStorage); ok {
+		return quotas
+	}
+
+	return unsupportedStorage{}
+}
+
+// QuotaOptions are the limits of a QuotaLimiter. Periods start at midnight in
+// Location, UTC by default. WarnAt are the fractions of Limit, such as 0.8 and
+// 0.9, from which responses carry a warning. FailureMode tells how requests
+// are decided while the storage fails: open and fallback admit them without
+// counting them, closed rejects them.
+type QuotaOptions struct {
+	Limit       int
+	Period      QuotaPeriod
+	Location    *time.Location
+	WarnAt      []float64
+	FailureMode FailureMode
+	Metrics     *Metrics
+}
+
+// QuotaResponse is the usage of the quota of a key in the current period,
+// including the request when Allowed. Warning is the highest WarnAt reached,
+// or 0, and Degraded tells a decision taken by the failure mode because the
+// storage failed, without usage.
+type QuotaResponse struct {
+	Allowed   bool        `json:"allowed"`
+	Degraded  bool        `json:"degraded,omitempty"`
+	Policy    string      `json:"policy,omitempty"`
+	Period    QuotaPeriod `json:"period"`
+	Limit     int         `json:"limit"`
+	Used      int         `json:"used"`
+	Remaining int         `json:"remaining"`
+	ResetTime time.Time   `json:"reset_time"`
+	Warning   float64     `json:"warning,omitempty"`
+}
+
+// QuotaLimiter limits the requests of each key over a calendar period, such
+// as 100k per month, unlike RateLimiter, whose windows start with the first
+// request of the key.
+type QuotaLimiter struct {
+	storage QuotaStorage
+	opts    QuotaOptions
+	logger  *slog.Logger
+	now     func() time.Time
+}
+
+func NewQuotaLimiter(storage QuotaStorage, opts QuotaOptions, logger *slog.Logger) *QuotaLimiter {
+	if opts.Period == "" {
+		opts.Period = QuotaMonth
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	opts.WarnAt = slices.Sorted(slices.Values(opts.WarnAt))
+
+	return &QuotaLimiter{
+		storage: storage,
+		opts:    opts,
+		logger:  logger,
+		now:     time.Now,
+	}
+}
+
+// AllowN counts a request that uses up cost units of quota, at least 1, when
+// it fits in the quota left in the current period. A rejected request is not
+// counted.
+func (ql *QuotaLimiter) AllowN(ctx context.Context, rk RateLimitKey, cost int) (QuotaResponse, error) {
+	resp, key, period := ql.response(rk)
+
+	allowed, used, err := ql.storage.IncrQuota(ctx, key, period, resp.ResetTime.Sub(ql.now()), ql.opts.Limit, max(cost, 1))
+	if err != nil {
+		if ql.opts.FailureMode == "" {
+			return QuotaResponse{}, err
+		}
+
+		ql.logger.Warn("Quota limiter storage failed",
+			slog.String("policy", rk.Policy()),
+			slog.String("failure_mode", string(ql.opts.FailureMode)),
+			slog.String("error", err.Error()),
+		)
+		ql.opts.Metrics.observeFailure(rk, ql.opts.FailureMode)
+
+		resp.Allowed, resp.Degraded = ql.opts.FailureMode != FailClosed, true
+		resp.Remaining = resp.Limit
+		return resp, nil
+	}
+
+	resp.Allowed = allowed
+	ql.setUsage(&resp, used)
+	if !allowed {
+		ql.opts.Metrics.observeQuotaRejection(rk)
+	}
+
+	return resp, nil
+}
+
+// Usage returns the usage of the quota of rk in the current period, without
+// counting a request.
+func (ql *QuotaLimiter) Usage(ctx context.Context, rk RateLimitKey) (QuotaResponse, error) {
+	resp, key, period := ql.response(rk)
+
+	used, err := ql.storage.QuotaUsage(ctx, key, period)
+	if err != nil {
+		return QuotaResponse{}, err
+	}
+
+	resp.Allowed = used < resp.Limit
+	ql.setUsage(&resp, used)
+
+	return resp, nil
+}
+
+// response returns the response of rk without usage, with its storage key and
+// current period.
+func (ql *QuotaLimiter) response(rk RateLimitKey) (QuotaResponse, string, string) {
+	start, end := ql.opts.Period.Bounds(ql.now().In(ql.opts.Location))
+
+	key := rk.Key
+	if rk.Scope != "" {
+		key = rk.Scope + ":" + key
+	}
+
+	return QuotaResponse{
+		Policy:    rk.Policy(),
+		Period:    ql.opts.Period,
+		Limit:     ql.opts.Limit,
+		ResetTime: end,
+	}, key, start.Format(time.DateOnly)
+}
+
+func (ql *QuotaLimiter) setUsage(resp *QuotaResponse, used int) {
+	resp.Used, resp.Remaining = used, max(resp.Limit-used, 0)
+
+	for _, threshold := range ql.opts.WarnAt {
+		if float64(used) >= threshold*float64(resp.Limit) {
+			resp.Warning = threshold
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaPeriod_Bounds(t *testing.T) {
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	require.NoError(t, err)
+
+	date := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, saoPaulo)
+	}
+
+	tests := []struct {
+		name   string
+		period QuotaPeriod
+		t      time.Time
+		start  time.Time
+		end    time.Time
+	}{
+		{"day", QuotaDay, date(2026, 10, 17, 15), date(2026, 10, 17, 0), date(2026, 10, 18, 0)},
+		{"week from a saturday", QuotaWeek, date(2026, 10, 17, 15), date(2026, 10, 12, 0), date(2026, 10, 19, 0)},
+		{"week from a sunday", QuotaWeek, date(2026, 10, 18, 23), date(2026, 10, 12, 0), date(2026, 10, 19, 0)},
+		{"week from a monday", QuotaWeek, date(2026, 10, 19, 0), date(2026, 10, 19, 0), date(2026, 10, 26, 0)},
+		{"month", QuotaMonth, date(2026, 10, 17, 15), date(2026, 10, 1, 0), date(2026, 11, 1, 0)},
+		{"month across years", QuotaMonth, date(2026, 12, 31, 23), date(2026, 12, 1, 0), date(2027, 1, 1, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.period.Bounds(tt.t)
+			assert.Equal(t, tt.start, start)
+			assert.Equal(t, tt.end, end)
+		})
+	}
+}
+
+func TestQuotaLimiter_AllowN(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	ctx := context.Background()
+	rk := RateLimitKey{Key: "abc123", KeyType: Token, Scope: "plan"}
+
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	require.NoError(t, err)
+
+	storage, _ := newTestMemoryStorage(t, MemoryOptions{})
+	limiter := NewQuotaLimiter(storage, QuotaOptions{
+		Limit:    10,
+		Period:   QuotaMonth,
+		Location: saoPaulo,
+		WarnAt:   []float64{0.9, 0.5},
+	}, logger)
+
+	now := time.Date(2026, 10, 17, 15, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	t.Run("should count requests in the quota of the month", func(t *testing.T) {
+		resp, err := limiter.AllowN(ctx, rk, 4)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 4, resp.Used)
+		assert.Equal(t, 6, resp.Remaining)
+		assert.Zero(t, resp.Warning)
+		assert.Equal(t, "plan", resp.Policy)
+		assert.True(t, resp.ResetTime.Equal(time.Date(2026, 11, 1, 3, 0, 0, 0, time.UTC)))
+
+		resp, err = limiter.AllowN(ctx, rk, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 0.5, resp.Warning)
+	})
+
+	t.Run("should reject requests that do not fit without counting them", func(t *testing.T) {
+		resp, err := limiter.AllowN(ctx, rk, 6)
+		require.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.Equal(t, 5, resp.Used)
+		assert.Equal(t, 5, resp.Remaining)
+
+		resp, err = limiter.AllowN(ctx, rk, 4)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 0.9, resp.Warning)
+	})
+
+	t.Run("should report the usage without counting a request", func(t *testing.T) {
+		resp, err := limiter.Usage(ctx, rk)
+		require.NoError(t, err)
+		assert.Equal(t, 9, resp.Used)
+		assert.Equal(t, 1, resp.Remaining)
+		assert.Equal(t, QuotaMonth, resp.Period)
+	})
+
+	t.Run("should start over at midnight of the timezone", func(t *testing.T) {
+		// Still October 31 in São Paulo.
+		now = time.Date(2026, 11, 1, 2, 59, 0, 0, time.UTC)
+		resp, err := limiter.Usage(ctx, rk)
+		require.NoError(t, err)
+		assert.Equal(t, 9, resp.Used)
+
+		now = time.Date(2026, 11, 1, 3, 0, 0, 0, time.UTC)
+		resp, err = limiter.AllowN(ctx, rk, 1)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.Equal(t, 1, resp.Used)
+		assert.True(t, resp.ResetTime.Equal(time.Date(2026, 12, 1, 3, 0, 0, 0, time.UTC)))
+	})
+
+	t.Run("should follow the failure mode when the storage fails", func(t *testing.T) {
+		mockStorage := new(mocks.StorageMock)
+		mockStorage.On("IncrQuota", ctx, "plan:abc123", "2026-10-01", 345*time.Hour, 10, 1).Return(false, 0, errors.New("connection refused"))
+
+		newLimiter := func(mode FailureMode) *QuotaLimiter {
+			ql := NewQuotaLimiter(mockStorage, QuotaOptions{Limit: 10, FailureMode: mode}, logger)
+			ql.now = func() time.Time { return time.Date(2026, 10, 17, 15, 0, 0, 0, time.UTC) }
+			return ql
+		}
+
+		_, err := newLimiter("").AllowN(ctx, rk, 1)
+		assert.Error(t, err)
+
+		resp, err := newLimiter(FailOpen).AllowN(ctx, rk, 1)
+		assert.NoError(t, err)
+		assert.True(t, resp.Allowed)
+		assert.True(t, resp.Degraded)
+
+		resp, err = newLimiter(FailClosed).AllowN(ctx, rk, 1)
+		assert.NoError(t, err)
+		assert.False(t, resp.Allowed)
+		assert.True(t, resp.Degraded)
+	})
+}
@@ -0,0 +1,58 @@
+package ratelimiter
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/mocks"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisScriptStorage_Hit(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	storage := NewRedisScriptStorage(client, logger.NewLogger())
+
+	key := "test_key"
+	keys := []string{RateLimitPrefix + "req:" + key, RateLimitPrefix + "block:" + key}
+
+	t.Run("counts the request", func(t *testing.T) {
+		mock.ExpectEvalSha(hitScript.Hash(), keys, int64(1000), 5, int64(60000), 1).SetVal([]interface{}{int64(0), int64(3), int64(800)})
+
+		blocked, count, ttl, err := storage.Hit(ctx, key, time.Second, 5, time.Minute, 1)
+		require.NoError(t, err)
+		assert.False(t, blocked)
+		assert.Equal(t, 3, count)
+		assert.Equal(t, 800*time.Millisecond, ttl)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports a blocked key", func(t *testing.T) {
+		mock.ExpectEvalSha(hitScript.Hash(), keys, int64(1000), 5, int64(60000), 1).SetVal([]interface{}{int64(1), int64(0), int64(42000)})
+
+		blocked, count, ttl, err := storage.Hit(ctx, key, time.Second, 5, time.Minute, 1)
+		require.NoError(t, err)
+		assert.True(t, blocked)
+		assert.Equal(t, 0, count)
+		assert.Equal(t, 42*time.Second, ttl)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		mock.ExpectEvalSha(hitScript.Hash(), keys, int64(1000), 5, int64(60000), 1).SetErr(redis.ErrClosed)
+
+		blocked, _, _, err := storage.Hit(ctx, key, time.Second, 5, time.Minute, 1)
+		assert.Error(t, err)
+		assert.False(t, blocked)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -2,7 +2,10 @@ package ratelimiter
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -10,6 +13,287 @@ import (
 
 const RateLimitPrefix = "rate_limiter:"
 
+var incrRequestScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local current = tonumber(redis.call('GET', KEYS[1])) or 0
+if current < limit and current + cost > limit then
+  local ttl = redis.call('PTTL', KEYS[1])
+  if ttl < 0 then
+    ttl = window
+  end
+  return {current + cost, ttl}
+end
+
+local count = redis.call('INCRBY', KEYS[1], cost)
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+  redis.call('PEXPIRE', KEYS[1], window)
+  ttl = window
+end
+
+return {count, ttl}
+`)
+
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[2])
+local rate = tonumber(ARGV[1])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+  tokens = capacity
+  ts = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+if tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate * 1000) + 1000)
+
+return {allowed, tostring(tokens)}
+`)
+
+var slidingLogScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count + cost <= limit then
+  for i = 0, cost - 1 do
+    redis.call('ZADD', KEYS[1], now, time[1] .. '.' .. time[2] .. ':' .. (count + i))
+  end
+  count = count + cost
+  allowed = 1
+end
+
+redis.call('PEXPIRE', KEYS[1], window)
+
+local leaving = 0
+if allowed == 0 then
+  leaving = math.max(math.min(count + cost - limit, count) - 1, 0)
+end
+
+local reset = window
+local oldest = redis.call('ZRANGE', KEYS[1], leaving, leaving, 'WITHSCORES')
+if oldest[2] then
+  reset = tonumber(oldest[2]) + window - now
+end
+
+return {allowed, count, reset}
+`)
+
+var slidingCounterScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local current = math.floor(now / window)
+local elapsed = now - current * window
+local curr = tonumber(redis.call('HGET', KEYS[1], current)) or 0
+local prev = tonumber(redis.call('HGET', KEYS[1], current - 1)) or 0
+local weighted = prev * (window - elapsed) / window + curr
+
+local allowed = 0
+if weighted + cost <= limit then
+  curr = redis.call('HINCRBY', KEYS[1], current, cost)
+  weighted = weighted + cost
+  allowed = 1
+end
+
+redis.call('HDEL', KEYS[1], current - 2)
+redis.call('PEXPIRE', KEYS[1], window * 2)
+
+local reset = window - elapsed
+if allowed == 0 and prev > 0 and curr + cost <= limit then
+  reset = math.max(0, math.ceil(window * (1 - (limit - cost - curr) / prev) - elapsed))
+end
+
+return {allowed, math.ceil(weighted), reset}
+`)
+
+var gcraScript = redis.NewScript(`
+local emission = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local block = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local blockTTL = redis.call('PTTL', KEYS[2])
+if blockTTL > 0 then
+  return {0, -1, blockTTL, blockTTL}
+end
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+
+local newTat = tat + cost * emission
+local allowAt = newTat - burst * emission
+
+if allowAt > now then
+  local retry = math.ceil((allowAt - now) / 1000)
+  local left = math.floor((now - tat + burst * emission) / emission)
+  if left > 0 then
+    return {0, left, retry, math.ceil((tat - now) / 1000)}
+  end
+  if block > 0 then
+    redis.call('SET', KEYS[2], 'blocked', 'PX', block)
+    retry = block
+  end
+  return {0, 0, retry, math.ceil((tat - now) / 1000)}
+end
+
+local resetAfter = math.ceil((newTat - now) / 1000)
+redis.call('SET', KEYS[1], string.format('%.0f', newTat), 'PX', resetAfter)
+
+return {1, math.floor((now - allowAt) / emission), 0, resetAfter}
+`)
+
+// hitWindowsScript keeps the windows of a key in a hash holding, for each
+// window length, the index of its current window and the count in it.
+var hitWindowsScript = redis.NewScript(`
+local block = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+
+local blockTTL = redis.call('PTTL', KEYS[2])
+if blockTTL > 0 then
+  return {0, blockTTL}
+end
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local allowed, exhausted, longest = 1, false, 0
+local counts, resets, indexes = {}, {}, {}
+for i = 1, (#ARGV - 2) / 2 do
+  local window = tonumber(ARGV[2 * i + 1])
+  local limit = tonumber(ARGV[2 * i + 2])
+  local index = math.floor(now / window)
+  local stored = redis.call('HMGET', KEYS[1], window, window .. ':count')
+
+  indexes[i] = index
+  counts[i] = 0
+  if tonumber(stored[1]) == index then
+    counts[i] = tonumber(stored[2]) or 0
+  end
+  resets[i] = (index + 1) * window - now
+  longest = math.max(longest, resets[i])
+
+  if counts[i] + cost > limit then
+    allowed = 0
+    exhausted = exhausted or counts[i] >= limit
+  end
+end
+
+if allowed == 0 then
+  if exhausted and block > 0 then
+    redis.call('SET', KEYS[2], 'blocked', 'PX', block)
+    blockTTL = block
+  else
+    blockTTL = 0
+  end
+else
+  blockTTL = 0
+  for i = 1, #counts do
+    local window = ARGV[2 * i + 1]
+    counts[i] = counts[i] + cost
+    redis.call('HSET', KEYS[1], window, indexes[i], window .. ':count', counts[i])
+  end
+  if redis.call('PTTL', KEYS[1]) < longest then
+    redis.call('PEXPIRE', KEYS[1], longest)
+  end
+end
+
+local result = {allowed, blockTTL}
+for i = 1, #counts do
+  table.insert(result, counts[i])
+  table.insert(result, resets[i])
+end
+
+return result
+`)
+
+// incrQuotaScript keeps the usage of a key in a hash holding its period and
+// the usage in it, without expiration.
+var incrQuotaScript = redis.NewScript(`
+local limit = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local stored = redis.call('HMGET', KEYS[1], 'period', 'used')
+local used = 0
+if stored[1] == ARGV[1] then
+  used = tonumber(stored[2]) or 0
+end
+
+if used + cost > limit then
+  return {0, used}
+end
+
+redis.call('HSET', KEYS[1], 'period', ARGV[1], 'used', used + cost)
+redis.call('PERSIST', KEYS[1])
+
+return {1, used + cost}
+`)
+
+// acquireLeaseScript keeps the leases of a key in a sorted set scored by their
+// expiration, dropping the expired ones before counting them.
+var acquireLeaseScript = redis.NewScript(`
+local limit = tonumber(ARGV[2])
+local lease = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+
+local count = redis.call('ZCARD', KEYS[1])
+if count >= limit then
+  return {0, count}
+end
+
+redis.call('ZADD', KEYS[1], now + lease, ARGV[1])
+if redis.call('PTTL', KEYS[1]) < lease then
+  redis.call('PEXPIRE', KEYS[1], lease)
+end
+
+return {1, count + 1}
+`)
+
+var renewLeaseScript = redis.NewScript(`
+local lease = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+if redis.call('ZADD', KEYS[1], 'XX', 'CH', now + lease, ARGV[1]) == 1 and redis.call('PTTL', KEYS[1]) < lease then
+  redis.call('PEXPIRE', KEYS[1], lease)
+end
+
+return 1
+`)
+
 type RedisStorage struct {
 	client *redis.Client
 	logger *slog.Logger
@@ -22,49 +306,38 @@ func NewRedisStorage(client *redis.Client, logger *slog.Logger) *RedisStorage {
 	}
 }
 
-func (r *RedisStorage) IncrRequest(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
+// IncrRequest checks that cost fits, increments the counter of key and gives
+// it its expiration in a single script, so a counter is never left without an
+// expiration and a request that does not fit is never seen counted. Counters
+// left without one by earlier versions get it back on their next increment.
+func (r *RedisStorage) IncrRequest(ctx context.Context, key string, window time.Duration, limit int, cost int) (int, time.Duration, error) {
 	requestKey := RateLimitPrefix + "req:" + key
-	count := r.client.Incr(ctx, requestKey)
 
 	r.logger.Info("Incrementing request count",
 		slog.String("key", requestKey),
-		slog.Int("count", int(count.Val())),
+		slog.String("window", window.String()),
+		slog.Int("limit", limit),
 	)
 
-	if count.Err() != nil {
+	res, err := incrRequestScript.Run(ctx, r.client, []string{requestKey}, window.Milliseconds(), limit, cost).Slice()
+	if err != nil {
 		r.logger.Error("Error incrementing request count",
 			slog.String("key", requestKey),
-			slog.String("error", count.Err().Error()),
+			slog.String("error", err.Error()),
 		)
-		return 0, 0, count.Err()
+		return 0, 0, err
 	}
 
-	if count.Val() == 1 {
-		r.logger.Info("Setting expiration for key",
-			slog.String("key", requestKey),
-			slog.String("window", window.String()),
-		)
-
-		err := r.client.Expire(ctx, requestKey, window)
-		if err.Err() != nil {
-			r.logger.Error("Error setting expiration",
-				slog.String("key", requestKey),
-				slog.String("error", err.Err().Error()),
-			)
-			return int(count.Val()), 0, err.Err()
-		}
+	count, err := scriptInt(res, 0)
+	if err != nil {
+		return 0, 0, err
 	}
-
-	ttl := r.client.TTL(ctx, requestKey)
-	if ttl.Err() != nil {
-		r.logger.Error("Error getting TTL",
-			slog.String("key", requestKey),
-			slog.String("error", ttl.Err().Error()),
-		)
-		return int(count.Val()), 0, ttl.Err()
+	ttl, err := scriptInt(res, 1)
+	if err != nil {
+		return int(count), 0, err
 	}
 
-	return int(count.Val()), ttl.Val(), nil
+	return int(count), time.Duration(ttl) * time.Millisecond, nil
 }
 
 func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, time.Duration, error) {
@@ -122,3 +395,461 @@ func (r *RedisStorage) BlockRequest(ctx context.Context, key string, duration ti
 
 	return nil
 }
+
+// RecordOffense increments the offense count of key and restarts its
+// expiration in a single transaction.
+func (r *RedisStorage) RecordOffense(ctx context.Context, key string, lookback time.Duration) (int, error) {
+	offenseKey := RateLimitPrefix + "offense:" + key
+
+	pipe := r.client.TxPipeline()
+	count := pipe.Incr(ctx, offenseKey)
+	pipe.PExpire(ctx, offenseKey, lookback)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		r.logger.Error("Error recording offense",
+			slog.String("key", offenseKey),
+			slog.String("error", err.Error()),
+		)
+		return 0, err
+	}
+
+	return int(count.Val()), nil
+}
+
+func (r *RedisStorage) Offenses(ctx context.Context, key string) (int, error) {
+	offenseKey := RateLimitPrefix + "offense:" + key
+
+	count, err := r.client.Get(ctx, offenseKey).Int()
+	if err != nil && err != redis.Nil {
+		r.logger.Error("Error getting offense count",
+			slog.String("key", offenseKey),
+			slog.String("error", err.Error()),
+		)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Ping checks that Redis answers.
+func (r *RedisStorage) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// CountBlocked scans the block keys. It walks the whole keyspace, so it is
+// meant for periodic use, such as a metrics scrape.
+func (r *RedisStorage) CountBlocked(ctx context.Context) (int, error) {
+	var (
+		cursor uint64
+		total  int
+	)
+
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, RateLimitPrefix+"block:*", 1000).Result()
+		if err != nil {
+			r.logger.Error("Error scanning blocked keys",
+				slog.String("error", err.Error()),
+			)
+			return 0, err
+		}
+
+		total += len(keys)
+		cursor = next
+		if cursor == 0 {
+			return total, nil
+		}
+	}
+}
+
+func (r *RedisStorage) Inspect(ctx context.Context, key string) (KeyState, error) {
+	requestKey := RateLimitPrefix + "req:" + key
+
+	count, err := r.client.Get(ctx, requestKey).Int()
+	if err != nil && err != redis.Nil {
+		r.logger.Error("Error getting request count",
+			slog.String("key", requestKey),
+			slog.String("error", err.Error()),
+		)
+		return KeyState{}, err
+	}
+
+	ttl, err := r.client.TTL(ctx, requestKey).Result()
+	if err != nil {
+		return KeyState{}, err
+	}
+
+	blocked, blockTTL, err := r.IsBlocked(ctx, key)
+	if err != nil {
+		return KeyState{}, err
+	}
+
+	offenses, err := r.Offenses(ctx, key)
+	if err != nil {
+		return KeyState{}, err
+	}
+
+	return KeyState{Key: key, Count: count, TTL: max(ttl, 0), Blocked: blocked, BlockTTL: blockTTL, Offenses: offenses}, nil
+}
+
+func (r *RedisStorage) Reset(ctx context.Context, key string) error {
+	keys := make([]string, 0, 8)
+	for _, prefix := range []string{"req:", "bucket:", "log:", "counter:", "tat:", "windows:", "inflight:", "quota:"} {
+		keys = append(keys, RateLimitPrefix+prefix+key)
+	}
+
+	if err := r.client.Del(ctx, keys...).Err(); err != nil {
+		r.logger.Error("Error resetting key",
+			slog.String("key", key),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) Unblock(ctx context.Context, key string) error {
+	blockKey := RateLimitPrefix + "block:" + key
+
+	if err := r.client.Del(ctx, blockKey, RateLimitPrefix+"offense:"+key).Err(); err != nil {
+		r.logger.Error("Error unblocking key",
+			slog.String("key", blockKey),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	return nil
+}
+
+// ListBlocked scans a page of block keys. The cursor is the SCAN cursor, so a
+// key may show up in more than one page.
+func (r *RedisStorage) ListBlocked(ctx context.Context, cursor string, count int) ([]KeyState, string, error) {
+	var scanCursor uint64
+	if cursor != "" {
+		var err error
+		if scanCursor, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("ratelimiter: invalid cursor %q", cursor)
+		}
+	}
+
+	blockPrefix := RateLimitPrefix + "block:"
+	keys, next, err := r.client.Scan(ctx, scanCursor, blockPrefix+"*", int64(count)).Result()
+	if err != nil {
+		r.logger.Error("Error scanning blocked keys",
+			slog.String("error", err.Error()),
+		)
+		return nil, "", err
+	}
+
+	blocked := make([]KeyState, 0, len(keys))
+	for _, k := range keys {
+		ttl, err := r.client.TTL(ctx, k).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		if ttl <= 0 {
+			continue
+		}
+		blocked = append(blocked, KeyState{Key: strings.TrimPrefix(k, blockPrefix), Blocked: true, BlockTTL: ttl})
+	}
+
+	if next == 0 {
+		return blocked, "", nil
+	}
+
+	return blocked, strconv.FormatUint(next, 10), nil
+}
+
+func (r *RedisStorage) TakeToken(ctx context.Context, key string, rate float64, capacity int, cost int) (bool, float64, error) {
+	bucketKey := RateLimitPrefix + "bucket:" + key
+
+	r.logger.Info("Taking token from bucket",
+		slog.String("key", bucketKey),
+		slog.Float64("rate", rate),
+		slog.Int("capacity", capacity),
+		slog.Int("cost", cost),
+	)
+
+	res, err := tokenBucketScript.Run(ctx, r.client, []string{bucketKey}, rate, capacity, cost).Slice()
+	if err != nil {
+		r.logger.Error("Error taking token from bucket",
+			slog.String("key", bucketKey),
+			slog.String("error", err.Error()),
+		)
+		return false, 0, err
+	}
+
+	tokens, err := scriptFloat(res, 1)
+	if err != nil {
+		r.logger.Error("Error parsing bucket tokens",
+			slog.String("key", bucketKey),
+			slog.String("error", err.Error()),
+		)
+		return false, 0, err
+	}
+
+	allowed, _ := scriptInt(res, 0)
+
+	return allowed == 1, tokens, nil
+}
+
+func scriptInt(res []interface{}, i int) (int64, error) {
+	if i >= len(res) {
+		return 0, fmt.Errorf("ratelimiter: script reply has no element %d", i)
+	}
+
+	switch v := res[i].(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("ratelimiter: unexpected script reply type %T", v)
+	}
+}
+
+func scriptFloat(res []interface{}, i int) (float64, error) {
+	if i >= len(res) {
+		return 0, fmt.Errorf("ratelimiter: script reply has no element %d", i)
+	}
+
+	switch v := res[i].(type) {
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("ratelimiter: unexpected script reply type %T", v)
+	}
+}
+
+func (r *RedisStorage) SlidingLog(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error) {
+	logKey := RateLimitPrefix + "log:" + key
+
+	r.logger.Info("Recording request in sliding log",
+		slog.String("key", logKey),
+		slog.String("window", window.String()),
+	)
+
+	return r.runSlidingScript(ctx, slidingLogScript, logKey, window, limit, cost)
+}
+
+func (r *RedisStorage) SlidingCounter(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error) {
+	counterKey := RateLimitPrefix + "counter:" + key
+
+	r.logger.Info("Recording request in sliding counter",
+		slog.String("key", counterKey),
+		slog.String("window", window.String()),
+	)
+
+	return r.runSlidingScript(ctx, slidingCounterScript, counterKey, window, limit, cost)
+}
+
+func (r *RedisStorage) runSlidingScript(ctx context.Context, script *redis.Script, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error) {
+	res, err := script.Run(ctx, r.client, []string{key}, window.Milliseconds(), limit, cost).Slice()
+	if err != nil {
+		r.logger.Error("Error running sliding window script",
+			slog.String("key", key),
+			slog.String("error", err.Error()),
+		)
+		return false, 0, 0, err
+	}
+
+	allowed, _ := scriptInt(res, 0)
+	count, err := scriptInt(res, 1)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	reset, err := scriptInt(res, 2)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	return allowed == 1, int(count), time.Duration(reset) * time.Millisecond, nil
+}
+
+func (r *RedisStorage) GCRA(ctx context.Context, key string, emissionInterval time.Duration, burst int, blockDuration time.Duration, cost int) (bool, int, time.Duration, time.Duration, error) {
+	tatKey := RateLimitPrefix + "tat:" + key
+	blockKey := RateLimitPrefix + "block:" + key
+
+	r.logger.Info("Checking theoretical arrival time",
+		slog.String("key", tatKey),
+		slog.String("emission_interval", emissionInterval.String()),
+		slog.Int("burst", burst),
+	)
+
+	emission := float64(emissionInterval) / float64(time.Microsecond)
+
+	res, err := gcraScript.Run(ctx, r.client, []string{tatKey, blockKey}, emission, burst, blockDuration.Milliseconds(), cost).Slice()
+	if err != nil {
+		r.logger.Error("Error running GCRA script",
+			slog.String("key", tatKey),
+			slog.String("error", err.Error()),
+		)
+		return false, 0, 0, 0, err
+	}
+
+	values := make([]int64, 4)
+	for i := range values {
+		if values[i], err = scriptInt(res, i); err != nil {
+			return false, 0, 0, 0, err
+		}
+	}
+
+	return values[0] == 1, int(values[1]), time.Duration(values[2]) * time.Millisecond, time.Duration(values[3]) * time.Millisecond, nil
+}
+
+func (r *RedisStorage) HitWindows(ctx context.Context, key string, windows []time.Duration, limits []int, blockDuration time.Duration, cost int) (bool, []int, []time.Duration, time.Duration, error) {
+	windowsKey := RateLimitPrefix + "windows:" + key
+	blockKey := RateLimitPrefix + "block:" + key
+
+	r.logger.Info("Counting request in windows",
+		slog.String("key", windowsKey),
+		slog.Int("windows", len(windows)),
+	)
+
+	args := []interface{}{blockDuration.Milliseconds(), cost}
+	for i, window := range windows {
+		args = append(args, window.Milliseconds(), limits[i])
+	}
+
+	res, err := hitWindowsScript.Run(ctx, r.client, []string{windowsKey, blockKey}, args...).Slice()
+	if err != nil {
+		r.logger.Error("Error running windows script",
+			slog.String("key", windowsKey),
+			slog.String("error", err.Error()),
+		)
+		return false, nil, nil, 0, err
+	}
+
+	allowed, _ := scriptInt(res, 0)
+	block, err := scriptInt(res, 1)
+	if err != nil {
+		return false, nil, nil, 0, err
+	}
+
+	blockTTL := time.Duration(block) * time.Millisecond
+	if len(res) == 2 {
+		return false, nil, nil, blockTTL, nil
+	}
+
+	counts := make([]int, len(windows))
+	resets := make([]time.Duration, len(windows))
+	for i := range windows {
+		count, err := scriptInt(res, 2+2*i)
+		if err != nil {
+			return false, nil, nil, 0, err
+		}
+		reset, err := scriptInt(res, 3+2*i)
+		if err != nil {
+			return false, nil, nil, 0, err
+		}
+		counts[i], resets[i] = int(count), time.Duration(reset)*time.Millisecond
+	}
+
+	return allowed == 1, counts, resets, blockTTL, nil
+}
+
+// IncrQuota keeps the usage without expiration, whatever ttl is, so that the
+// volatile eviction policies never give quota back.
+func (r *RedisStorage) IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (bool, int, error) {
+	quotaKey := RateLimitPrefix + "quota:" + key
+
+	r.logger.Info("Counting quota usage",
+		slog.String("key", quotaKey),
+		slog.String("period", period),
+		slog.Int("limit", limit),
+	)
+
+	res, err := incrQuotaScript.Run(ctx, r.client, []string{quotaKey}, period, limit, cost).Slice()
+	if err != nil {
+		r.logger.Error("Error running quota script",
+			slog.String("key", quotaKey),
+			slog.String("error", err.Error()),
+		)
+		return false, 0, err
+	}
+
+	allowed, _ := scriptInt(res, 0)
+	used, err := scriptInt(res, 1)
+	if err != nil {
+		return false, 0, err
+	}
+
+	return allowed == 1, int(used), nil
+}
+
+func (r *RedisStorage) QuotaUsage(ctx context.Context, key, period string) (int, error) {
+	quotaKey := RateLimitPrefix + "quota:" + key
+
+	stored, err := r.client.HMGet(ctx, quotaKey, "period", "used").Result()
+	if err != nil {
+		r.logger.Error("Error getting quota usage",
+			slog.String("key", quotaKey),
+			slog.String("error", err.Error()),
+		)
+		return 0, err
+	}
+
+	used, ok := stored[1].(string)
+	if stored[0] != period || !ok {
+		return 0, nil
+	}
+
+	return strconv.Atoi(used)
+}
+
+func (r *RedisStorage) AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, int, error) {
+	inflightKey := RateLimitPrefix + "inflight:" + key
+
+	r.logger.Info("Acquiring concurrency lease",
+		slog.String("key", inflightKey),
+		slog.Int("limit", limit),
+	)
+
+	res, err := acquireLeaseScript.Run(ctx, r.client, []string{inflightKey}, id, limit, lease.Milliseconds()).Slice()
+	if err != nil {
+		r.logger.Error("Error acquiring concurrency lease",
+			slog.String("key", inflightKey),
+			slog.String("error", err.Error()),
+		)
+		return false, 0, err
+	}
+
+	acquired, _ := scriptInt(res, 0)
+	count, err := scriptInt(res, 1)
+	if err != nil {
+		return false, 0, err
+	}
+
+	return acquired == 1, int(count), nil
+}
+
+func (r *RedisStorage) RenewLease(ctx context.Context, key, id string, lease time.Duration) error {
+	inflightKey := RateLimitPrefix + "inflight:" + key
+
+	if err := renewLeaseScript.Run(ctx, r.client, []string{inflightKey}, id, lease.Milliseconds()).Err(); err != nil {
+		r.logger.Error("Error renewing concurrency lease",
+			slog.String("key", inflightKey),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	return nil
+}
+
+func (r *RedisStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	inflightKey := RateLimitPrefix + "inflight:" + key
+
+	if err := r.client.ZRem(ctx, inflightKey, id).Err(); err != nil {
+		r.logger.Error("Error releasing concurrency lease",
+			slog.String("key", inflightKey),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	return nil
+}
@@ -23,80 +23,39 @@ func TestRedisStorage_IncrRequest(t *testing.T) {
 
 	storage := NewRedisStorage(client, logger.NewLogger())
 
-	t.Run("increments request count and sets expiration", func(t *testing.T) {
-		key := "test_key"
-		window := 10 * time.Second
-		requestKey := RateLimitPrefix + "req:" + key
+	key := "test_key"
+	window := 10 * time.Second
+	requestKey := RateLimitPrefix + "req:" + key
 
-		mock.ExpectIncr(requestKey).SetVal(1)
-		mock.ExpectExpire(requestKey, window).SetVal(true)
-		mock.ExpectTTL(requestKey).SetVal(window)
+	t.Run("increments and expires the counter in one script", func(t *testing.T) {
+		mock.ExpectEvalSha(incrRequestScript.Hash(), []string{requestKey}, int64(10000), 5, 1).SetVal([]interface{}{int64(1), int64(10000)})
 
-		count, ttl, err := storage.IncrRequest(ctx, key, window)
+		count, ttl, err := storage.IncrRequest(ctx, key, window, 5, 1)
 		require.NoError(t, err)
 		assert.Equal(t, 1, count)
 		assert.Equal(t, window, ttl)
 		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
-	t.Run("increments request count without setting expiration", func(t *testing.T) {
-		key := "test_key"
-		window := 10 * time.Second
-		requestKey := RateLimitPrefix + "req:" + key
-
-		mock.ExpectIncr(requestKey).SetVal(2)
-		mock.ExpectTTL(requestKey).SetVal(window)
+	t.Run("reports a request that does not fit with its cost", func(t *testing.T) {
+		mock.ExpectEvalSha(incrRequestScript.Hash(), []string{requestKey}, int64(10000), 5, 3).SetVal([]interface{}{int64(7), int64(4000)})
 
-		count, ttl, err := storage.IncrRequest(ctx, key, window)
+		count, ttl, err := storage.IncrRequest(ctx, key, window, 5, 3)
 		require.NoError(t, err)
-		assert.Equal(t, 2, count)
-		assert.Equal(t, window, ttl)
+		assert.Equal(t, 7, count)
+		assert.Equal(t, 4*time.Second, ttl)
 		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 
-	t.Run("returns error when incrementing request count fails", func(t *testing.T) {
-		key := "test_key"
-		window := 10 * time.Second
-		requestKey := RateLimitPrefix + "req:" + key
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		mock.ExpectEvalSha(incrRequestScript.Hash(), []string{requestKey}, int64(10000), 5, 1).SetErr(redis.ErrClosed)
 
-		mock.ExpectIncr(requestKey).SetErr(redis.Nil)
-
-		count, ttl, err := storage.IncrRequest(ctx, key, window)
+		count, ttl, err := storage.IncrRequest(ctx, key, window, 5, 1)
 		assert.Error(t, err)
 		assert.Equal(t, 0, count)
 		assert.Equal(t, time.Duration(0), ttl)
 		assert.NoError(t, mock.ExpectationsWereMet())
 	})
-
-	t.Run("returns error when setting expiration fails", func(t *testing.T) {
-		key := "test_key"
-		window := 10 * time.Second
-		requestKey := RateLimitPrefix + "req:" + key
-
-		mock.ExpectIncr(requestKey).SetVal(1)
-		mock.ExpectExpire(requestKey, window).SetErr(redis.Nil)
-
-		count, ttl, err := storage.IncrRequest(ctx, key, window)
-		assert.Error(t, err)
-		assert.Equal(t, 1, count)
-		assert.Equal(t, time.Duration(0), ttl)
-		assert.NoError(t, mock.ExpectationsWereMet())
-	})
-
-	t.Run("returns error when getting TTL fails", func(t *testing.T) {
-		key := "test_key"
-		window := 10 * time.Second
-		requestKey := RateLimitPrefix + "req:" + key
-
-		mock.ExpectIncr(requestKey).SetVal(2)
-		mock.ExpectTTL(requestKey).SetErr(redis.Nil)
-
-		count, ttl, err := storage.IncrRequest(ctx, key, window)
-		assert.Error(t, err)
-		assert.Equal(t, 2, count)
-		assert.Equal(t, time.Duration(0), ttl)
-		assert.NoError(t, mock.ExpectationsWereMet())
-	})
 }
 
 func TestRedisStorage_IsBlocked(t *testing.T) {
@@ -180,3 +139,444 @@ func TestRedisStorage_BlockRequest(t *testing.T) {
 		assert.NoError(t, mock.ExpectationsWereMet())
 	})
 }
+
+func TestRedisStorage_CountBlocked(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	storage := NewRedisStorage(client, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	t.Run("counts block keys across scan pages", func(t *testing.T) {
+		mock.ExpectScan(0, RateLimitPrefix+"block:*", 1000).SetVal([]string{"a", "b"}, 42)
+		mock.ExpectScan(42, RateLimitPrefix+"block:*", 1000).SetVal([]string{"c"}, 0)
+
+		count, err := storage.CountBlocked(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, count)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when scanning fails", func(t *testing.T) {
+		mock.ExpectScan(0, RateLimitPrefix+"block:*", 1000).SetErr(redis.ErrClosed)
+
+		_, err := storage.CountBlocked(ctx)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRedisStorage_KeyAdmin(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	storage := NewRedisStorage(client, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	t.Run("inspects the count, window and block of a key", func(t *testing.T) {
+		mock.ExpectGet(RateLimitPrefix + "req:ip:a").SetVal("3")
+		mock.ExpectTTL(RateLimitPrefix + "req:ip:a").SetVal(40 * time.Second)
+		mock.ExpectTTL(RateLimitPrefix + "block:ip:a").SetVal(5 * time.Minute)
+		mock.ExpectGet(RateLimitPrefix + "offense:ip:a").SetVal("2")
+
+		state, err := storage.Inspect(ctx, "ip:a")
+		require.NoError(t, err)
+		assert.Equal(t, KeyState{Key: "ip:a", Count: 3, TTL: 40 * time.Second, Blocked: true, BlockTTL: 5 * time.Minute, Offenses: 2}, state)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("inspects a key without state", func(t *testing.T) {
+		mock.ExpectGet(RateLimitPrefix + "req:ip:a").RedisNil()
+		mock.ExpectTTL(RateLimitPrefix + "req:ip:a").SetVal(-2)
+		mock.ExpectTTL(RateLimitPrefix + "block:ip:a").SetVal(-2)
+		mock.ExpectGet(RateLimitPrefix + "offense:ip:a").RedisNil()
+
+		state, err := storage.Inspect(ctx, "ip:a")
+		require.NoError(t, err)
+		assert.Equal(t, KeyState{Key: "ip:a"}, state)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("resets the counters of every algorithm", func(t *testing.T) {
+		mock.ExpectDel(
+			RateLimitPrefix+"req:ip:a",
+			RateLimitPrefix+"bucket:ip:a",
+			RateLimitPrefix+"log:ip:a",
+			RateLimitPrefix+"counter:ip:a",
+			RateLimitPrefix+"tat:ip:a",
+			RateLimitPrefix+"windows:ip:a",
+			RateLimitPrefix+"inflight:ip:a",
+			RateLimitPrefix+"quota:ip:a",
+		).SetVal(1)
+
+		require.NoError(t, storage.Reset(ctx, "ip:a"))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unblocks a key and forgets its offenses", func(t *testing.T) {
+		mock.ExpectDel(RateLimitPrefix+"block:ip:a", RateLimitPrefix+"offense:ip:a").SetVal(1)
+
+		require.NoError(t, storage.Unblock(ctx, "ip:a"))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("lists blocked keys page by page", func(t *testing.T) {
+		mock.ExpectScan(0, RateLimitPrefix+"block:*", 2).SetVal([]string{RateLimitPrefix + "block:ip:a", RateLimitPrefix + "block:ip:b"}, 7)
+		mock.ExpectTTL(RateLimitPrefix + "block:ip:a").SetVal(time.Minute)
+		mock.ExpectTTL(RateLimitPrefix + "block:ip:b").SetVal(-2)
+
+		keys, cursor, err := storage.ListBlocked(ctx, "", 2)
+		require.NoError(t, err)
+		assert.Equal(t, []KeyState{{Key: "ip:a", Blocked: true, BlockTTL: time.Minute}}, keys)
+		assert.Equal(t, "7", cursor)
+
+		mock.ExpectScan(7, RateLimitPrefix+"block:*", 2).SetVal(nil, 0)
+
+		keys, cursor, err = storage.ListBlocked(ctx, cursor, 2)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+		assert.Empty(t, cursor)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rejects invalid cursors", func(t *testing.T) {
+		_, _, err := storage.ListBlocked(ctx, "next", 2)
+		assert.Error(t, err)
+	})
+}
+
+func TestRedisStorage_TakeToken(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	storage := NewRedisStorage(client, logger.NewLogger())
+
+	t.Run("takes a token from the bucket", func(t *testing.T) {
+		key := "test_key"
+		bucketKey := RateLimitPrefix + "bucket:" + key
+
+		mock.ExpectEvalSha(tokenBucketScript.Hash(), []string{bucketKey}, 2.0, 10, 1).SetVal([]interface{}{int64(1), "8.5"})
+
+		allowed, tokens, err := storage.TakeToken(ctx, key, 2.0, 10, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, 8.5, tokens)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports an empty bucket", func(t *testing.T) {
+		key := "test_key"
+		bucketKey := RateLimitPrefix + "bucket:" + key
+
+		mock.ExpectEvalSha(tokenBucketScript.Hash(), []string{bucketKey}, 2.0, 10, 1).SetVal([]interface{}{int64(0), "0.25"})
+
+		allowed, tokens, err := storage.TakeToken(ctx, key, 2.0, 10, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, 0.25, tokens)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		key := "test_key"
+		bucketKey := RateLimitPrefix + "bucket:" + key
+
+		mock.ExpectEvalSha(tokenBucketScript.Hash(), []string{bucketKey}, 2.0, 10, 1).SetErr(redis.ErrClosed)
+
+		allowed, tokens, err := storage.TakeToken(ctx, key, 2.0, 10, 1)
+		assert.Error(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, 0.0, tokens)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRedisStorage_SlidingLog(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	storage := NewRedisStorage(client, logger.NewLogger())
+
+	t.Run("records request in the log", func(t *testing.T) {
+		key := "test_key"
+		logKey := RateLimitPrefix + "log:" + key
+
+		mock.ExpectEvalSha(slidingLogScript.Hash(), []string{logKey}, int64(10000), 5, 1).SetVal([]interface{}{int64(1), int64(3), int64(7500)})
+
+		allowed, count, reset, err := storage.SlidingLog(ctx, key, 10*time.Second, 5, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, 3, count)
+		assert.Equal(t, 7500*time.Millisecond, reset)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		key := "test_key"
+		logKey := RateLimitPrefix + "log:" + key
+
+		mock.ExpectEvalSha(slidingLogScript.Hash(), []string{logKey}, int64(10000), 5, 1).SetErr(redis.ErrClosed)
+
+		allowed, count, reset, err := storage.SlidingLog(ctx, key, 10*time.Second, 5, 1)
+		assert.Error(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, 0, count)
+		assert.Equal(t, time.Duration(0), reset)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRedisStorage_SlidingCounter(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	storage := NewRedisStorage(client, logger.NewLogger())
+
+	t.Run("reports a denied request", func(t *testing.T) {
+		key := "test_key"
+		counterKey := RateLimitPrefix + "counter:" + key
+
+		mock.ExpectEvalSha(slidingCounterScript.Hash(), []string{counterKey}, int64(10000), 5, 1).SetVal([]interface{}{int64(0), int64(5), int64(1200)})
+
+		allowed, count, reset, err := storage.SlidingCounter(ctx, key, 10*time.Second, 5, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, 5, count)
+		assert.Equal(t, 1200*time.Millisecond, reset)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error on malformed reply", func(t *testing.T) {
+		key := "test_key"
+		counterKey := RateLimitPrefix + "counter:" + key
+
+		mock.ExpectEvalSha(slidingCounterScript.Hash(), []string{counterKey}, int64(10000), 5, 1).SetVal([]interface{}{int64(1)})
+
+		_, _, _, err := storage.SlidingCounter(ctx, key, 10*time.Second, 5, 1)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRedisStorage_GCRA(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	storage := NewRedisStorage(client, logger.NewLogger())
+
+	key := "test_key"
+	keys := []string{RateLimitPrefix + "tat:" + key, RateLimitPrefix + "block:" + key}
+
+	t.Run("allows request within the burst", func(t *testing.T) {
+		mock.ExpectEvalSha(gcraScript.Hash(), keys, 100000.0, 10, int64(0), 1).SetVal([]interface{}{int64(1), int64(9), int64(0), int64(100)})
+
+		allowed, remaining, retryAfter, resetAfter, err := storage.GCRA(ctx, key, 100*time.Millisecond, 10, 0, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, 9, remaining)
+		assert.Equal(t, time.Duration(0), retryAfter)
+		assert.Equal(t, 100*time.Millisecond, resetAfter)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("denies request and reports retry delay", func(t *testing.T) {
+		mock.ExpectEvalSha(gcraScript.Hash(), keys, 100000.0, 10, int64(60000), 1).SetVal([]interface{}{int64(0), int64(0), int64(60000), int64(1000)})
+
+		allowed, remaining, retryAfter, resetAfter, err := storage.GCRA(ctx, key, 100*time.Millisecond, 10, time.Minute, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, 0, remaining)
+		assert.Equal(t, time.Minute, retryAfter)
+		assert.Equal(t, time.Second, resetAfter)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports a key already blocked", func(t *testing.T) {
+		mock.ExpectEvalSha(gcraScript.Hash(), keys, 100000.0, 10, int64(60000), 1).SetVal([]interface{}{int64(0), int64(-1), int64(42000), int64(42000)})
+
+		allowed, remaining, retryAfter, _, err := storage.GCRA(ctx, key, 100*time.Millisecond, 10, time.Minute, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Equal(t, -1, remaining)
+		assert.Equal(t, 42*time.Second, retryAfter)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		mock.ExpectEvalSha(gcraScript.Hash(), keys, 100000.0, 10, int64(0), 1).SetErr(redis.ErrClosed)
+
+		allowed, _, _, _, err := storage.GCRA(ctx, key, 100*time.Millisecond, 10, 0, 1)
+		assert.Error(t, err)
+		assert.False(t, allowed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRedisStorage_RecordOffense(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	storage := NewRedisStorage(client, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	offenseKey := RateLimitPrefix + "offense:ip:a"
+
+	t.Run("counts offenses and restarts the lookback", func(t *testing.T) {
+		mock.ExpectTxPipeline()
+		mock.ExpectIncr(offenseKey).SetVal(3)
+		mock.ExpectPExpire(offenseKey, time.Hour).SetVal(true)
+		mock.ExpectTxPipelineExec()
+
+		offenses, err := storage.RecordOffense(ctx, "ip:a", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 3, offenses)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reads the offenses of a key", func(t *testing.T) {
+		mock.ExpectGet(offenseKey).SetVal("3")
+
+		offenses, err := storage.Offenses(ctx, "ip:a")
+		require.NoError(t, err)
+		assert.Equal(t, 3, offenses)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the transaction fails", func(t *testing.T) {
+		mock.ExpectTxPipeline()
+		mock.ExpectIncr(offenseKey).SetErr(redis.ErrClosed)
+
+		_, err := storage.RecordOffense(ctx, "ip:a", time.Hour)
+		assert.Error(t, err)
+	})
+}
+
+func TestRedisStorage_HitWindows(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	storage := NewRedisStorage(client, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	keys := []string{RateLimitPrefix + "windows:ip:a", RateLimitPrefix + "block:ip:a"}
+	windows := []time.Duration{time.Second, time.Minute}
+	limits := []int{10, 500}
+
+	t.Run("counts a request in every window in one script", func(t *testing.T) {
+		mock.ExpectEvalSha(hitWindowsScript.Hash(), keys, int64(60000), 1, int64(1000), 10, int64(60000), 500).
+			SetVal([]interface{}{int64(1), int64(0), int64(3), int64(400), int64(120), int64(20000)})
+
+		allowed, counts, resets, blockTTL, err := storage.HitWindows(ctx, "ip:a", windows, limits, time.Minute, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, []int{3, 120}, counts)
+		assert.Equal(t, []time.Duration{400 * time.Millisecond, 20 * time.Second}, resets)
+		assert.Zero(t, blockTTL)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports a key already blocked without window counts", func(t *testing.T) {
+		mock.ExpectEvalSha(hitWindowsScript.Hash(), keys, int64(60000), 1, int64(1000), 10, int64(60000), 500).
+			SetVal([]interface{}{int64(0), int64(42000)})
+
+		allowed, counts, _, blockTTL, err := storage.HitWindows(ctx, "ip:a", windows, limits, time.Minute, 1)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+		assert.Nil(t, counts)
+		assert.Equal(t, 42*time.Second, blockTTL)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		mock.ExpectEvalSha(hitWindowsScript.Hash(), keys, int64(0), 1, int64(1000), 10, int64(60000), 500).SetErr(redis.ErrClosed)
+
+		_, _, _, _, err := storage.HitWindows(ctx, "ip:a", windows, limits, 0, 1)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRedisStorage_Leases(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	storage := NewRedisStorage(client, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	inflightKey := RateLimitPrefix + "inflight:ip:a"
+
+	t.Run("acquires a lease in one script", func(t *testing.T) {
+		mock.ExpectEvalSha(acquireLeaseScript.Hash(), []string{inflightKey}, "lease-1", 2, int64(30000)).SetVal([]interface{}{int64(1), int64(1)})
+
+		acquired, inFlight, err := storage.AcquireLease(ctx, "ip:a", "lease-1", 2, 30*time.Second)
+		require.NoError(t, err)
+		assert.True(t, acquired)
+		assert.Equal(t, 1, inFlight)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports a key without free slots", func(t *testing.T) {
+		mock.ExpectEvalSha(acquireLeaseScript.Hash(), []string{inflightKey}, "lease-2", 2, int64(30000)).SetVal([]interface{}{int64(0), int64(2)})
+
+		acquired, inFlight, err := storage.AcquireLease(ctx, "ip:a", "lease-2", 2, 30*time.Second)
+		require.NoError(t, err)
+		assert.False(t, acquired)
+		assert.Equal(t, 2, inFlight)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("renews and releases a lease", func(t *testing.T) {
+		mock.ExpectEvalSha(renewLeaseScript.Hash(), []string{inflightKey}, "lease-1", int64(30000)).SetVal(int64(1))
+		mock.ExpectZRem(inflightKey, "lease-1").SetVal(1)
+
+		require.NoError(t, storage.RenewLease(ctx, "ip:a", "lease-1", 30*time.Second))
+		require.NoError(t, storage.ReleaseLease(ctx, "ip:a", "lease-1"))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		mock.ExpectEvalSha(acquireLeaseScript.Hash(), []string{inflightKey}, "lease-3", 2, int64(30000)).SetErr(redis.ErrClosed)
+
+		_, _, err := storage.AcquireLease(ctx, "ip:a", "lease-3", 2, 30*time.Second)
+		assert.Error(t, err)
+	})
+}
+
+func TestRedisStorage_Quota(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	storage := NewRedisStorage(client, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	quotaKey := RateLimitPrefix + "quota:ip:a"
+
+	t.Run("counts the usage in one script", func(t *testing.T) {
+		mock.ExpectEvalSha(incrQuotaScript.Hash(), []string{quotaKey}, "2026-10-01", 100, 3).SetVal([]interface{}{int64(1), int64(42)})
+
+		allowed, used, err := storage.IncrQuota(ctx, "ip:a", "2026-10-01", 31*24*time.Hour, 100, 3)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, 42, used)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the script fails", func(t *testing.T) {
+		mock.ExpectEvalSha(incrQuotaScript.Hash(), []string{quotaKey}, "2026-10-01", 100, 3).SetErr(redis.ErrClosed)
+
+		_, _, err := storage.IncrQuota(ctx, "ip:a", "2026-10-01", 31*24*time.Hour, 100, 3)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports the usage of the current period", func(t *testing.T) {
+		mock.ExpectHMGet(quotaKey, "period", "used").SetVal([]interface{}{"2026-10-01", "42"})
+
+		used, err := storage.QuotaUsage(ctx, "ip:a", "2026-10-01")
+		require.NoError(t, err)
+		assert.Equal(t, 42, used)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports no usage for a previous period", func(t *testing.T) {
+		mock.ExpectHMGet(quotaKey, "period", "used").SetVal([]interface{}{"2026-09-01", "42"})
+
+		used, err := storage.QuotaUsage(ctx, "ip:a", "2026-10-01")
+		require.NoError(t, err)
+		assert.Zero(t, used)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
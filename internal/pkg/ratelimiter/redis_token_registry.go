@@ -0,0 +1,107 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisTokenRegistry reads token limits from hashes stored under
+// rate_limiter:token:<token> with the fields limit, window, block_duration and
+// expires_at (RFC 3339).
+type RedisTokenRegistry struct {
+	client *redis.Client
+	logger *slog.Logger
+}
+
+func NewRedisTokenRegistry(client *redis.Client, logger *slog.Logger) *RedisTokenRegistry {
+	return &RedisTokenRegistry{
+		client: client,
+		logger: logger,
+	}
+}
+
+func (r *RedisTokenRegistry) Lookup(ctx context.Context, token string) (TokenLimit, bool, error) {
+	tokenKey := RateLimitPrefix + "token:" + token
+
+	fields, err := r.client.HGetAll(ctx, tokenKey).Result()
+	if err != nil {
+		r.logger.Error("Error looking up token",
+			slog.String("key", tokenKey),
+			slog.String("error", err.Error()),
+		)
+		return TokenLimit{}, false, err
+	}
+
+	if len(fields) == 0 {
+		return TokenLimit{}, false, nil
+	}
+
+	limit, err := parseTokenFields(fields)
+	if err != nil {
+		r.logger.Error("Invalid token limit",
+			slog.String("key", tokenKey),
+			slog.String("error", err.Error()),
+		)
+		return TokenLimit{}, false, err
+	}
+
+	return limit, true, nil
+}
+
+func (r *RedisTokenRegistry) Register(ctx context.Context, token string, limit TokenLimit) error {
+	tokenKey := RateLimitPrefix + "token:" + token
+
+	fields := map[string]interface{}{
+		"limit":          limit.Limit,
+		"window":         limit.Window.String(),
+		"block_duration": limit.BlockDuration.String(),
+		"expires_at":     "",
+	}
+	if !limit.ExpiresAt.IsZero() {
+		fields["expires_at"] = limit.ExpiresAt.Format(time.RFC3339)
+	}
+
+	if err := r.client.HSet(ctx, tokenKey, fields).Err(); err != nil {
+		r.logger.Error("Error registering token",
+			slog.String("key", tokenKey),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+
+	return nil
+}
+
+func parseTokenFields(fields map[string]string) (TokenLimit, error) {
+	var (
+		limit TokenLimit
+		err   error
+	)
+
+	if v := fields["limit"]; v != "" {
+		if limit.Limit, err = strconv.Atoi(v); err != nil {
+			return TokenLimit{}, fmt.Errorf("limit: %w", err)
+		}
+	}
+
+	if limit.Window, err = parseOptionalDuration(fields["window"]); err != nil {
+		return TokenLimit{}, fmt.Errorf("window: %w", err)
+	}
+
+	if limit.BlockDuration, err = parseOptionalDuration(fields["block_duration"]); err != nil {
+		return TokenLimit{}, fmt.Errorf("block_duration: %w", err)
+	}
+
+	if v := fields["expires_at"]; v != "" {
+		if limit.ExpiresAt, err = time.Parse(time.RFC3339, v); err != nil {
+			return TokenLimit{}, fmt.Errorf("expires_at: %w", err)
+		}
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,91 @@
+package ratelimiter
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/jhonasalves/go-expert-fc-rate-limiter/internal/mocks"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisTokenRegistry_Lookup(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	registry := NewRedisTokenRegistry(client, logger.NewLogger())
+	tokenKey := RateLimitPrefix + "token:abc123"
+
+	t.Run("returns the limits of a registered token", func(t *testing.T) {
+		mock.ExpectHGetAll(tokenKey).SetVal(map[string]string{
+			"limit":          "10",
+			"window":         "1s",
+			"block_duration": "1m0s",
+			"expires_at":     "2030-01-01T00:00:00Z",
+		})
+
+		limit, found, err := registry.Lookup(ctx, "abc123")
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, 10, limit.Limit)
+		assert.Equal(t, time.Second, limit.Window)
+		assert.Equal(t, time.Minute, limit.BlockDuration)
+		assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), limit.ExpiresAt)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("does not find unknown tokens", func(t *testing.T) {
+		mock.ExpectHGetAll(tokenKey).SetVal(map[string]string{})
+
+		_, found, err := registry.Lookup(ctx, "abc123")
+		require.NoError(t, err)
+		assert.False(t, found)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error on invalid fields", func(t *testing.T) {
+		mock.ExpectHGetAll(tokenKey).SetVal(map[string]string{"limit": "ten"})
+
+		_, found, err := registry.Lookup(ctx, "abc123")
+		assert.Error(t, err)
+		assert.False(t, found)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when redis fails", func(t *testing.T) {
+		mock.ExpectHGetAll(tokenKey).SetErr(redis.ErrClosed)
+
+		_, found, err := registry.Lookup(ctx, "abc123")
+		assert.Error(t, err)
+		assert.False(t, found)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRedisTokenRegistry_Register(t *testing.T) {
+	ctx := context.Background()
+	client, mock := redismock.NewClientMock()
+	logger := &mocks.LoggerMock{}
+	logger.On("NewLogger").Return(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	registry := NewRedisTokenRegistry(client, logger.NewLogger())
+	tokenKey := RateLimitPrefix + "token:abc123"
+
+	mock.ExpectHSet(tokenKey, map[string]interface{}{
+		"limit":          10,
+		"window":         "1s",
+		"block_duration": "1m0s",
+		"expires_at":     "",
+	}).SetVal(4)
+
+	err := registry.Register(ctx, "abc123", TokenLimit{Limit: 10, Window: time.Second, BlockDuration: time.Minute})
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -2,11 +2,154 @@ package ratelimiter
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+// Storage keeps the state of the limiting algorithms. Every request uses up
+// cost units of quota, and a request whose cost does not fit in the quota
+// left is rejected without using any of it.
 type Storage interface {
-	IncrRequest(ctx context.Context, key string, window time.Duration) (int, time.Duration, error)
+	// IncrRequest adds cost to the count of key in the current window,
+	// returning the count plus cost and the time left in the window. A
+	// request that does not fit in what is left of limit is not counted, in
+	// the same step, and a key with nothing left is counted.
+	IncrRequest(ctx context.Context, key string, window time.Duration, limit int, cost int) (int, time.Duration, error)
 	IsBlocked(ctx context.Context, key string) (bool, time.Duration, error)
 	BlockRequest(ctx context.Context, key string, duration time.Duration) error
+	// TakeToken refills the bucket at rate tokens per second up to capacity and
+	// takes cost tokens, reporting whether it succeeded and the tokens left.
+	TakeToken(ctx context.Context, key string, rate float64, capacity int, cost int) (bool, float64, error)
+	// SlidingLog admits a request when the requests logged in the last window
+	// plus cost stay within limit, logging cost requests. It returns the
+	// logged count and the time until enough logged requests leave the window
+	// for another request of the same cost.
+	SlidingLog(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error)
+	// SlidingCounter admits a request when the current window count plus the
+	// previous window count, weighted by its remaining overlap, plus cost stays
+	// within limit. It returns the weighted count and the time until another
+	// request of the same cost could be admitted.
+	SlidingCounter(ctx context.Context, key string, window time.Duration, limit int, cost int) (bool, int, time.Duration, error)
+	// GCRA admits a request when the theoretical arrival time of key, moved
+	// by cost emission intervals, is within burst emission intervals of now,
+	// returning the requests left, the retry delay and the time until the key
+	// is fully replenished. A blocked key is rejected with -1 requests left
+	// and its block TTL as both delays, and a key that would not even admit a
+	// request of cost 1 is blocked for blockDuration when it is positive, in
+	// the same call.
+	GCRA(ctx context.Context, key string, emissionInterval time.Duration, burst int, blockDuration time.Duration, cost int) (bool, int, time.Duration, time.Duration, error)
+	// HitWindows counts key in several fixed windows, aligned to the Unix
+	// epoch, at once: a request is counted in all of them only when cost fits
+	// within the limit of each. It reports whether it did, the count in every
+	// window and the time until it resets, nil for a key that was already
+	// blocked, and the block of key, which is set for blockDuration when it is
+	// positive and a window had no quota left.
+	HitWindows(ctx context.Context, key string, windows []time.Duration, limits []int, blockDuration time.Duration, cost int) (bool, []int, []time.Duration, time.Duration, error)
+	// RecordOffense counts a limit violation of key and returns its offenses.
+	// They are forgotten once key goes lookback without another one.
+	RecordOffense(ctx context.Context, key string, lookback time.Duration) (int, error)
+	// Offenses returns the offenses of key that were not forgotten yet.
+	Offenses(ctx context.Context, key string) (int, error)
+}
+
+// AtomicStorage is implemented by storages able to check the block, count the
+// request and block the key in a single round trip. Hit reports whether the key
+// was already blocked, the request count in the current window plus cost and
+// the remaining block or window time. A request that does not fit in the quota
+// left is not counted, and a key that had no quota left is counted and blocked
+// for blockDuration when it is positive.
+type AtomicStorage interface {
+	Hit(ctx context.Context, key string, window time.Duration, limit int, blockDuration time.Duration, cost int) (bool, int, time.Duration, error)
+}
+
+// BlockCounter is implemented by storages able to count the keys that are
+// currently blocked.
+type BlockCounter interface {
+	CountBlocked(ctx context.Context) (int, error)
+}
+
+// KeyState is the fixed window state of a key. TTL is the time left in the
+// current window, BlockTTL the time left in the block of the key and Offenses
+// the violations that escalate its next block.
+type KeyState struct {
+	Key      string
+	Count    int
+	TTL      time.Duration
+	Blocked  bool
+	BlockTTL time.Duration
+	Offenses int
+}
+
+// KeyAdmin is implemented by storages able to inspect and change the state of
+// single keys, for support tools. Keys are storage keys, prefixed with the
+// policy name. Blocking a key is done with BlockRequest.
+type KeyAdmin interface {
+	// Inspect returns the fixed window count of key, its block and its
+	// offenses. The state kept by the other algorithms is not reported.
+	Inspect(ctx context.Context, key string) (KeyState, error)
+	// Reset deletes the counters kept for key by every algorithm, its leases
+	// and its quota, keeping its block.
+	Reset(ctx context.Context, key string) error
+	// Unblock deletes the block of key and its offenses, so its next block
+	// starts over at the base duration.
+	Unblock(ctx context.Context, key string) error
+	// ListBlocked returns a page of about count blocked keys starting at
+	// cursor, with the cursor of the next page, empty after the last one.
+	ListBlocked(ctx context.Context, cursor string, count int) ([]KeyState, string, error)
+}
+
+// keyAdminOf returns storage as a KeyAdmin, or one failing with
+// errors.ErrUnsupported when storage cannot administer keys, for decorators to
+// pass key administration through.
+func keyAdminOf(storage Storage) KeyAdmin {
+	if admin, ok := storage.(KeyAdmin); ok {
+		return admin
+	}
+
+	return unsupportedStorage{}
+}
+
+// unsupportedStorage stands for the optional interfaces a wrapped storage does
+// not implement, failing every call with errors.ErrUnsupported. The storage
+// wrappers of CircuitBreaker, Metrics and Tracing always implement
+// ConcurrencyStorage, QuotaStorage and KeyAdmin, passing leases, quotas and
+// key administration through to the wrapped storage or else to
+// unsupportedStorage, and implement
+// AtomicStorage only when the wrapped storage does.
+type unsupportedStorage struct{}
+
+func (unsupportedStorage) AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, int, error) {
+	return false, 0, errors.ErrUnsupported
+}
+
+func (unsupportedStorage) RenewLease(ctx context.Context, key, id string, lease time.Duration) error {
+	return errors.ErrUnsupported
+}
+
+func (unsupportedStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	return errors.ErrUnsupported
+}
+
+func (unsupportedStorage) IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (bool, int, error) {
+	return false, 0, errors.ErrUnsupported
+}
+
+func (unsupportedStorage) QuotaUsage(ctx context.Context, key, period string) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (unsupportedStorage) Inspect(ctx context.Context, key string) (KeyState, error) {
+	return KeyState{}, errors.ErrUnsupported
+}
+
+func (unsupportedStorage) Reset(ctx context.Context, key string) error {
+	return errors.ErrUnsupported
+}
+
+func (unsupportedStorage) Unblock(ctx context.Context, key string) error {
+	return errors.ErrUnsupported
+}
+
+func (unsupportedStorage) ListBlocked(ctx context.Context, cursor string, count int) ([]KeyState, string, error) {
+	return nil, "", errors.ErrUnsupported
 }
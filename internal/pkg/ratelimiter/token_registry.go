@@ -0,0 +1,120 @@
+package ratelimiter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TokenLimit holds the limits of a single API token. Zero values inherit the
+// limiter Options, and a zero ExpiresAt means the token never expires.
+type TokenLimit struct {
+	Limit         int
+	Window        time.Duration
+	BlockDuration time.Duration
+	ExpiresAt     time.Time
+}
+
+type TokenRegistry interface {
+	Lookup(ctx context.Context, token string) (TokenLimit, bool, error)
+}
+
+func (t TokenLimit) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+func (t *TokenLimit) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Limit         int       `json:"limit"`
+		Window        string    `json:"window"`
+		BlockDuration string    `json:"block_duration"`
+		ExpiresAt     time.Time `json:"expires_at"`
+	}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	window, err := parseOptionalDuration(raw.Window)
+	if err != nil {
+		return fmt.Errorf("window: %w", err)
+	}
+
+	blockDuration, err := parseOptionalDuration(raw.BlockDuration)
+	if err != nil {
+		return fmt.Errorf("block_duration: %w", err)
+	}
+
+	if raw.Limit < 0 || window < 0 || blockDuration < 0 {
+		return fmt.Errorf("limit, window and block_duration must not be negative")
+	}
+
+	*t = TokenLimit{
+		Limit:         raw.Limit,
+		Window:        window,
+		BlockDuration: blockDuration,
+		ExpiresAt:     raw.ExpiresAt,
+	}
+
+	return nil
+}
+
+// FileTokenRegistry reads token limits from a JSON file shaped as
+// {"tokens": {"<token>": {"limit": 100, "window": "1s", ...}}}.
+type FileTokenRegistry struct {
+	path   string
+	mu     sync.RWMutex
+	tokens map[string]TokenLimit
+}
+
+func NewFileTokenRegistry(path string) (*FileTokenRegistry, error) {
+	r := &FileTokenRegistry{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the file again and replaces the registered tokens. The current
+// tokens are kept when the file cannot be read or parsed.
+func (r *FileTokenRegistry) Reload() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("ratelimiter: reading token registry: %w", err)
+	}
+
+	var file struct {
+		Tokens map[string]TokenLimit `json:"tokens"`
+	}
+
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("ratelimiter: parsing token registry %s: %w", r.path, err)
+	}
+
+	r.mu.Lock()
+	r.tokens = file.Tokens
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *FileTokenRegistry) Lookup(ctx context.Context, token string) (TokenLimit, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	limit, ok := r.tokens[token]
+
+	return limit, ok, nil
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,79 @@
+package ratelimiter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTokenFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestFileTokenRegistry(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	writeTokenFile(t, path, `{
+		"tokens": {
+			"abc123": {"limit": 10, "window": "1s", "block_duration": "1m"},
+			"old": {"limit": 5, "expires_at": "2020-01-01T00:00:00Z"}
+		}
+	}`)
+
+	registry, err := NewFileTokenRegistry(path)
+	require.NoError(t, err)
+
+	t.Run("returns the limits of a registered token", func(t *testing.T) {
+		limit, found, err := registry.Lookup(ctx, "abc123")
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, TokenLimit{Limit: 10, Window: time.Second, BlockDuration: time.Minute}, limit)
+		assert.False(t, limit.Expired(time.Now()))
+	})
+
+	t.Run("reports expired tokens", func(t *testing.T) {
+		limit, found, err := registry.Lookup(ctx, "old")
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.True(t, limit.Expired(time.Now()))
+	})
+
+	t.Run("does not find unknown tokens", func(t *testing.T) {
+		_, found, err := registry.Lookup(ctx, "unknown")
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("keeps the current tokens when reload fails", func(t *testing.T) {
+		writeTokenFile(t, path, `{"tokens": {"abc123": {"window": "soon"}}}`)
+
+		assert.Error(t, registry.Reload())
+
+		_, found, err := registry.Lookup(ctx, "abc123")
+		require.NoError(t, err)
+		assert.True(t, found)
+	})
+
+	t.Run("replaces the tokens on reload", func(t *testing.T) {
+		writeTokenFile(t, path, `{"tokens": {"new": {"limit": 1}}}`)
+
+		require.NoError(t, registry.Reload())
+
+		_, found, _ := registry.Lookup(ctx, "abc123")
+		assert.False(t, found)
+		_, found, _ = registry.Lookup(ctx, "new")
+		assert.True(t, found)
+	})
+
+	t.Run("fails on missing file", func(t *testing.T) {
+		_, err := NewFileTokenRegistry(filepath.Join(t.TempDir(), "missing.json"))
+		assert.Error(t, err)
+	})
+}
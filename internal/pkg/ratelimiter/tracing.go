@@ -0,0 +1,214 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jhonasalves/go-expert-fc-rate-limiter/internal/pkg/ratelimiter"
+
+// Tracing records OpenTelemetry spans for Allow and the storage calls. Span
+// attributes carry the policy, key type and decision, never the keys.
+type Tracing struct {
+	tracer trace.Tracer
+}
+
+func NewTracing(tp trace.TracerProvider) *Tracing {
+	return &Tracing{tracer: tp.Tracer(tracerName)}
+}
+
+// Storage wraps storage so that each call gets its own span.
+func (t *Tracing) Storage(storage Storage) Storage {
+	s := &tracedStorage{storage: storage, leases: concurrencyStorageOf(storage), quotas: quotaStorageOf(storage), admin: keyAdminOf(storage), tracer: t.tracer}
+	if atomic, ok := storage.(AtomicStorage); ok {
+		return &tracedAtomicStorage{tracedStorage: s, atomic: atomic}
+	}
+
+	return s
+}
+
+func (t *Tracing) startAllow(ctx context.Context, rk RateLimitKey, cost int) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	return t.tracer.Start(ctx, "ratelimiter.Allow", trace.WithAttributes(
+		attribute.String("ratelimiter.policy", rk.Policy()),
+		attribute.String("ratelimiter.key_type", rk.KeyType.String()),
+		attribute.Int("ratelimiter.cost", cost),
+	))
+}
+
+// endAllow records the decision on span, resolving the key type again since
+// unknown tokens may have been limited by IP.
+func (t *Tracing) endAllow(span trace.Span, rk RateLimitKey, resp RateLimiterResponse, err error) {
+	if t == nil {
+		return
+	}
+	defer span.End()
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("ratelimiter.key_type", rk.KeyType.String()),
+		attribute.String("ratelimiter.decision", resp.Decision()),
+		attribute.Int("ratelimiter.limit", resp.Limit),
+		attribute.Int("ratelimiter.remaining", resp.RequestsLeft),
+	)
+}
+
+type tracedStorage struct {
+	storage Storage
+	leases  ConcurrencyStorage
+	quotas  QuotaStorage
+	admin   KeyAdmin
+	tracer  trace.Tracer
+}
+
+func (s *tracedStorage) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "ratelimiter.storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("ratelimiter.operation", operation)),
+	)
+}
+
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+func (s *tracedStorage) IncrRequest(ctx context.Context, key string, window time.Duration, limit int, cost int) (count int, ttl time.Duration, err error) {
+	ctx, span := s.start(ctx, "incr_request")
+	defer endSpan(span, &err)
+	return s.storage.IncrRequest(ctx, key, window, limit, cost)
+}
+
+func (s *tracedStorage) IsBlocked(ctx context.Context, key string) (blocked bool, ttl time.Duration, err error) {
+	ctx, span := s.start(ctx, "is_blocked")
+	defer endSpan(span, &err)
+	return s.storage.IsBlocked(ctx, key)
+}
+
+func (s *tracedStorage) BlockRequest(ctx context.Context, key string, duration time.Duration) (err error) {
+	ctx, span := s.start(ctx, "block_request")
+	defer endSpan(span, &err)
+	return s.storage.BlockRequest(ctx, key, duration)
+}
+
+func (s *tracedStorage) TakeToken(ctx context.Context, key string, rate float64, capacity int, cost int) (allowed bool, tokens float64, err error) {
+	ctx, span := s.start(ctx, "take_token")
+	defer endSpan(span, &err)
+	return s.storage.TakeToken(ctx, key, rate, capacity, cost)
+}
+
+func (s *tracedStorage) SlidingLog(ctx context.Context, key string, window time.Duration, limit int, cost int) (allowed bool, count int, reset time.Duration, err error) {
+	ctx, span := s.start(ctx, "sliding_log")
+	defer endSpan(span, &err)
+	return s.storage.SlidingLog(ctx, key, window, limit, cost)
+}
+
+func (s *tracedStorage) SlidingCounter(ctx context.Context, key string, window time.Duration, limit int, cost int) (allowed bool, count int, reset time.Duration, err error) {
+	ctx, span := s.start(ctx, "sliding_counter")
+	defer endSpan(span, &err)
+	return s.storage.SlidingCounter(ctx, key, window, limit, cost)
+}
+
+func (s *tracedStorage) GCRA(ctx context.Context, key string, emissionInterval time.Duration, burst int, blockDuration time.Duration, cost int) (allowed bool, remaining int, retryAfter, resetAfter time.Duration, err error) {
+	ctx, span := s.start(ctx, "gcra")
+	defer endSpan(span, &err)
+	return s.storage.GCRA(ctx, key, emissionInterval, burst, blockDuration, cost)
+}
+
+func (s *tracedStorage) HitWindows(ctx context.Context, key string, windows []time.Duration, limits []int, blockDuration time.Duration, cost int) (allowed bool, counts []int, resets []time.Duration, blockTTL time.Duration, err error) {
+	ctx, span := s.start(ctx, "hit_windows")
+	defer endSpan(span, &err)
+	return s.storage.HitWindows(ctx, key, windows, limits, blockDuration, cost)
+}
+
+func (s *tracedStorage) RecordOffense(ctx context.Context, key string, lookback time.Duration) (offenses int, err error) {
+	ctx, span := s.start(ctx, "record_offense")
+	defer endSpan(span, &err)
+	return s.storage.RecordOffense(ctx, key, lookback)
+}
+
+func (s *tracedStorage) Offenses(ctx context.Context, key string) (offenses int, err error) {
+	ctx, span := s.start(ctx, "offenses")
+	defer endSpan(span, &err)
+	return s.storage.Offenses(ctx, key)
+}
+
+func (s *tracedStorage) AcquireLease(ctx context.Context, key, id string, limit int, lease time.Duration) (acquired bool, inFlight int, err error) {
+	ctx, span := s.start(ctx, "acquire_lease")
+	defer endSpan(span, &err)
+	return s.leases.AcquireLease(ctx, key, id, limit, lease)
+}
+
+func (s *tracedStorage) RenewLease(ctx context.Context, key, id string, lease time.Duration) (err error) {
+	ctx, span := s.start(ctx, "renew_lease")
+	defer endSpan(span, &err)
+	return s.leases.RenewLease(ctx, key, id, lease)
+}
+
+func (s *tracedStorage) ReleaseLease(ctx context.Context, key, id string) (err error) {
+	ctx, span := s.start(ctx, "release_lease")
+	defer endSpan(span, &err)
+	return s.leases.ReleaseLease(ctx, key, id)
+}
+
+func (s *tracedStorage) IncrQuota(ctx context.Context, key, period string, ttl time.Duration, limit, cost int) (allowed bool, used int, err error) {
+	ctx, span := s.start(ctx, "incr_quota")
+	defer endSpan(span, &err)
+	return s.quotas.IncrQuota(ctx, key, period, ttl, limit, cost)
+}
+
+func (s *tracedStorage) QuotaUsage(ctx context.Context, key, period string) (used int, err error) {
+	ctx, span := s.start(ctx, "quota_usage")
+	defer endSpan(span, &err)
+	return s.quotas.QuotaUsage(ctx, key, period)
+}
+
+func (s *tracedStorage) Inspect(ctx context.Context, key string) (state KeyState, err error) {
+	ctx, span := s.start(ctx, "inspect")
+	defer endSpan(span, &err)
+	return s.admin.Inspect(ctx, key)
+}
+
+func (s *tracedStorage) Reset(ctx context.Context, key string) (err error) {
+	ctx, span := s.start(ctx, "reset")
+	defer endSpan(span, &err)
+	return s.admin.Reset(ctx, key)
+}
+
+func (s *tracedStorage) Unblock(ctx context.Context, key string) (err error) {
+	ctx, span := s.start(ctx, "unblock")
+	defer endSpan(span, &err)
+	return s.admin.Unblock(ctx, key)
+}
+
+func (s *tracedStorage) ListBlocked(ctx context.Context, cursor string, count int) (keys []KeyState, next string, err error) {
+	ctx, span := s.start(ctx, "list_blocked")
+	defer endSpan(span, &err)
+	return s.admin.ListBlocked(ctx, cursor, count)
+}
+
+type tracedAtomicStorage struct {
+	*tracedStorage
+	atomic AtomicStorage
+}
+
+func (s *tracedAtomicStorage) Hit(ctx context.Context, key string, window time.Duration, limit int, blockDuration time.Duration, cost int) (blocked bool, count int, ttl time.Duration, err error) {
+	ctx, span := s.start(ctx, "hit")
+	defer endSpan(span, &err)
+	return s.atomic.Hit(ctx, key, window, limit, blockDuration, cost)
+}
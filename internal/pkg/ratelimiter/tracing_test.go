@@ -0,0 +1,60 @@
+package ratelimiter
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	storage := NewMemoryStorage(MemoryOptions{})
+	defer storage.Close()
+
+	tracing := NewTracing(tp)
+	limiter := NewRateLimiter(tracing.Storage(storage), Options{
+		MaxRequestIP:   5,
+		WindowDuration: time.Minute,
+		Algorithm:      SlidingLog,
+		Tracing:        tracing,
+	}, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	_, err := limiter.Allow(context.Background(), RateLimitKey{Key: "127.0.0.1", KeyType: API, Scope: "search"})
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+
+	allow := spans[len(spans)-1]
+	assert.Equal(t, "ratelimiter.Allow", allow.Name())
+
+	attrs := spanAttributes(allow)
+	assert.Equal(t, "search", attrs["ratelimiter.policy"].AsString())
+	assert.Equal(t, "ip", attrs["ratelimiter.key_type"].AsString())
+	assert.Equal(t, DecisionAllowed, attrs["ratelimiter.decision"].AsString())
+	assert.Equal(t, int64(4), attrs["ratelimiter.remaining"].AsInt64())
+
+	for i, name := range []string{"ratelimiter.storage.is_blocked", "ratelimiter.storage.sliding_log"} {
+		assert.Equal(t, name, spans[i].Name())
+		assert.Equal(t, allow.SpanContext().SpanID(), spans[i].Parent().SpanID())
+	}
+}